@@ -0,0 +1,537 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 22:48:51
+ * @LastEditTime: 2026-10-20 02:03:25
+ * @LastEditors: FunctionSir
+ * @Description: Acquisitions, vendors, purchase orders and fund budgets.
+ * @FilePath: /biblio-matrix/acquisitions.go
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Vendor struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Contact string `json:"contact"`
+	Phone   string `json:"phone"`
+	Email   string `json:"email"`
+	Note    string `json:"note"`
+}
+
+// Amounts of funds are in cents, like prices of books, and BIGINT in the DB.
+type Fund struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Year       int    `json:"year"` // Fiscal year
+	Budget     int    `json:"budget"`
+	Encumbered int    `json:"encumbered"` // Reserved by open orders for copies not received yet
+	Expended   int    `json:"expended"`   // Actually paid for copies received
+	Available  int    `json:"available"`  // Budget - encumbered - expended
+}
+
+type OrderLine struct {
+	Seq      int    `json:"seq"`
+	Book     string `json:"book"` // ID of the book to add, or whose count to increase
+	Name     string `json:"name"`
+	Author   string `json:"author"`
+	Isbn     string `json:"isbn"`
+	Quantity int    `json:"quantity"`
+	Price    int    `json:"price"` // Estimated price of one copy
+	Received int    `json:"received"`
+	Spent    int    `json:"spent"` // Actual price of all copies received
+}
+
+type PurchaseOrder struct {
+	Id        int         `json:"id"`
+	Vendor    string      `json:"vendor"`
+	Fund      string      `json:"fund"`
+	Status    string      `json:"status"` // "open", "closed" or "cancelled"
+	Created   time.Time   `json:"created"`
+	CreatedBy string      `json:"created_by"`
+	Note      string      `json:"note"`
+	Lines     []OrderLine `json:"lines,omitempty"`
+}
+
+// Cols of a fund, with encumbrance and expenditure calculated from lines.
+const fundCols = "F.ID,F.\"NAME\",F.FISCAL_YEAR,F.BUDGET," +
+	"COALESCE((SELECT SUM(CAST(L.QTY-L.RECEIVED AS BIGINT)*L.EST_PRICE) FROM ORDER_LINES L JOIN PURCHASE_ORDERS O ON L.OID=O.OID WHERE O.FUND_ID=F.ID AND O.STATUS='open'),0)," +
+	"COALESCE((SELECT SUM(CAST(L.SPENT AS BIGINT)) FROM ORDER_LINES L JOIN PURCHASE_ORDERS O ON L.OID=O.OID WHERE O.FUND_ID=F.ID),0)"
+
+func scanFund(row RowScanner) (Fund, error) {
+	var f Fund
+	err := row.Scan(&f.Id, &f.Name, &f.Year, &f.Budget, &f.Encumbered, &f.Expended)
+	f.Available = f.Budget - f.Encumbered - f.Expended
+	return f, err
+}
+
+func AddVendor(v Vendor) error {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "INSERT INTO VENDORS (ID,\"NAME\",CONTACT,PHONE,EMAIL,NOTE) VALUES (?,?,?,?,?,?)")
+	_, err := stmt.Exec(v.Id, v.Name, v.Contact, v.Phone, v.Email, v.Note)
+	return err
+}
+
+func ListVendors() ([]Vendor, error) {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "SELECT ID,\"NAME\",CONTACT,PHONE,EMAIL,NOTE FROM VENDORS ORDER BY \"NAME\"")
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]Vendor, 0)
+	var tmp Vendor
+	for rows.Next() {
+		rows.Scan(&tmp.Id, &tmp.Name, &tmp.Contact, &tmp.Phone, &tmp.Email, &tmp.Note)
+		res = append(res, tmp)
+	}
+	return res, nil
+}
+
+func AddFund(f Fund) error {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "INSERT INTO FUNDS (ID,\"NAME\",FISCAL_YEAR,BUDGET) VALUES (?,?,?,?)")
+	_, err := stmt.Exec(f.Id, f.Name, f.Year, f.Budget)
+	return err
+}
+
+func ListFunds() ([]Fund, error) {
+	db := DbOpen(DbConn)
+	rows, err := db.Query("SELECT " + fundCols + " FROM FUNDS F ORDER BY F.FISCAL_YEAR DESC,F.ID")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]Fund, 0)
+	for rows.Next() {
+		tmp, err := scanFund(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, tmp)
+	}
+	return res, nil
+}
+
+// Create an order with its lines, the estimated cost is encumbered on the
+// fund, which must have enough budget available.
+func CreateOrder(ctx context.Context, admin string, o PurchaseOrder) (int, string) {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	// Lock the fund, so that orders on it are created one by one.
+	row := tx.QueryRowContext(ctx, "SELECT "+fundCols+" FROM FUNDS F WITH (UPDLOCK) WHERE F.ID=?", o.Fund)
+	fund, err := scanFund(row)
+	if err == sql.ErrNoRows {
+		return 0, "该经费不存在."
+	}
+	if err != nil {
+		return 0, "无法完成查询. 请联系管理员."
+	}
+	cost := 0
+	for _, line := range o.Lines {
+		cost += line.Quantity * line.Price
+	}
+	if cost > fund.Available {
+		return 0, "经费余额不足, 可用" + formatYuan(fund.Available) + "元, 订单预计" + formatYuan(cost) + "元."
+	}
+	row = tx.QueryRowContext(ctx, "INSERT INTO PURCHASE_ORDERS (VENDOR_ID,FUND_ID,STATUS,CREATED,CREATED_BY,NOTE) OUTPUT INSERTED.OID VALUES (?,?,?,?,?,?)",
+		o.Vendor, o.Fund, "open", time.Now().UTC(), admin, o.Note)
+	var oid int
+	err = row.Scan(&oid)
+	if err != nil {
+		return 0, "无法创建订单, 请检查供应商是否存在."
+	}
+	for i, line := range o.Lines {
+		_, err = tx.ExecContext(ctx, "INSERT INTO ORDER_LINES (OID,SEQ,BOOK_ID,\"NAME\",AUTHOR,ISBN,QTY,EST_PRICE) VALUES (?,?,?,?,?,?,?,?)",
+			oid, i+1, line.Book, line.Name, line.Author, line.Isbn, line.Quantity, line.Price)
+		if err != nil {
+			return 0, "无法保存订单明细, 请联系管理员."
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, "无法成功提交事务. 请联系管理员."
+	}
+	return oid, ""
+}
+
+func formatYuan(cents int) string {
+	return strconv.FormatFloat(float64(cents)/100, 'f', 2, 64)
+}
+
+// List orders with the status given, or all orders if status is empty.
+func ListOrders(status string) ([]PurchaseOrder, error) {
+	db := DbOpen(DbConn)
+	query := "SELECT OID,VENDOR_ID,FUND_ID,STATUS,CREATED,CREATED_BY,NOTE FROM PURCHASE_ORDERS"
+	args := make([]any, 0)
+	if status != "" {
+		query += " WHERE STATUS=?"
+		args = append(args, status)
+	}
+	rows, err := db.Query(query+" ORDER BY OID DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]PurchaseOrder, 0)
+	var tmp PurchaseOrder
+	for rows.Next() {
+		rows.Scan(&tmp.Id, &tmp.Vendor, &tmp.Fund, &tmp.Status, &tmp.Created, &tmp.CreatedBy, &tmp.Note)
+		res = append(res, tmp)
+	}
+	return res, nil
+}
+
+// Get an order with its lines.
+func GetOrderInfo(oid int) (PurchaseOrder, error) {
+	db := DbOpen(DbConn)
+	row := db.QueryRow("SELECT OID,VENDOR_ID,FUND_ID,STATUS,CREATED,CREATED_BY,NOTE FROM PURCHASE_ORDERS WHERE OID=?", oid)
+	var res PurchaseOrder
+	err := row.Scan(&res.Id, &res.Vendor, &res.Fund, &res.Status, &res.Created, &res.CreatedBy, &res.Note)
+	if err != nil {
+		return PurchaseOrder{}, err
+	}
+	rows, err := db.Query("SELECT SEQ,BOOK_ID,\"NAME\",AUTHOR,ISBN,QTY,EST_PRICE,RECEIVED,SPENT FROM ORDER_LINES WHERE OID=? ORDER BY SEQ", oid)
+	if err != nil {
+		return PurchaseOrder{}, err
+	}
+	defer rows.Close()
+	res.Lines = make([]OrderLine, 0)
+	var tmp OrderLine
+	for rows.Next() {
+		rows.Scan(&tmp.Seq, &tmp.Book, &tmp.Name, &tmp.Author, &tmp.Isbn, &tmp.Quantity, &tmp.Price, &tmp.Received, &tmp.Spent)
+		res.Lines = append(res.Lines, tmp)
+	}
+	return res, nil
+}
+
+// Receive copies of an order line at the actual price of one copy. Like
+// /add, the count of the book is increased if it exists, or else b is
+// added as a new book, with ID, name, author and ISBN of the line. The
+// order is closed when all lines are fully received. Copies of a withdrawn
+// book are refused, the book must be restored first.
+func ReceiveOrderLine(ctx context.Context, oid int, seq int, count int, price int, b Book) string {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	row := tx.QueryRowContext(ctx, "SELECT O.STATUS,L.BOOK_ID,L.\"NAME\",L.AUTHOR,L.ISBN,L.QTY,L.RECEIVED FROM PURCHASE_ORDERS O WITH (UPDLOCK) JOIN ORDER_LINES L WITH (UPDLOCK) ON O.OID=L.OID WHERE L.OID=? AND L.SEQ=?",
+		oid, seq)
+	var status string
+	var line OrderLine
+	err = row.Scan(&status, &line.Book, &line.Name, &line.Author, &line.Isbn, &line.Quantity, &line.Received)
+	if err == sql.ErrNoRows {
+		return "该订单明细不存在."
+	}
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if status != "open" {
+		return "该订单已完成或已取消."
+	}
+	if count > line.Quantity-line.Received {
+		return "到货数量超过未到货数量(" + strconv.Itoa(line.Quantity-line.Received) + ")."
+	}
+	row = tx.QueryRowContext(ctx, "SELECT STATUS FROM BOOKS WITH (UPDLOCK) WHERE ID=?", line.Book)
+	var bookStatus string
+	err = row.Scan(&bookStatus)
+	if err != nil && err != sql.ErrNoRows {
+		return "无法完成查询. 请联系管理员."
+	}
+	exists := err == nil
+	if bookStatus == "withdrawn" {
+		return "该书已下架, 请先恢复(/restore/book)再入藏."
+	}
+	if exists {
+		_, err = tx.ExecContext(ctx, "UPDATE BOOKS SET CNT=CNT+? WHERE ID=?", count, line.Book)
+	} else {
+		b.Id, b.Name, b.Author, b.Isbn, b.Price, b.Count = line.Book, line.Name, line.Author, line.Isbn, price, count
+		err = AddBookTx(ctx, tx, b)
+	}
+	if err != nil {
+		return "无法入藏图书, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE ORDER_LINES SET RECEIVED=RECEIVED+?,SPENT=SPENT+? WHERE OID=? AND SEQ=?", count, count*price, oid, seq)
+	if err != nil {
+		return "无法更新订单明细, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE PURCHASE_ORDERS SET STATUS='closed' WHERE OID=? AND NOT EXISTS (SELECT * FROM ORDER_LINES WHERE OID=? AND RECEIVED<QTY)", oid, oid)
+	if err != nil {
+		return "无法更新订单, 请联系管理员."
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+// Close an open order, copies not received are no longer encumbered, or
+// cancel it, which is only allowed if nothing was received.
+func FinishOrder(ctx context.Context, oid int, status string) string {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	row := tx.QueryRowContext(ctx, "SELECT STATUS,(SELECT COALESCE(SUM(RECEIVED),0) FROM ORDER_LINES WHERE OID=?) FROM PURCHASE_ORDERS WITH (UPDLOCK) WHERE OID=?", oid, oid)
+	var oldStatus string
+	var received int
+	err = row.Scan(&oldStatus, &received)
+	if err == sql.ErrNoRows {
+		return "该订单不存在."
+	}
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if oldStatus != "open" {
+		return "该订单已完成或已取消."
+	}
+	if status == "cancelled" && received > 0 {
+		return "该订单已有图书到货, 无法取消, 请改为结束订单."
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE PURCHASE_ORDERS SET STATUS=? WHERE OID=?", status, oid)
+	if err != nil {
+		return "无法更新订单, 请联系管理员."
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+// Parse an amount in yuan into cents.
+func parseYuan(s string) (int, error) {
+	yuan, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int(math.Round(yuan * 100)), nil
+}
+
+func newVendorHandler(w http.ResponseWriter, r *http.Request) {
+	vendor := Vendor{Id: r.PostFormValue("vendor"), Name: r.PostFormValue("name"), Contact: r.PostFormValue("contact"),
+		Phone: r.PostFormValue("phone"), Email: r.PostFormValue("email"), Note: r.PostFormValue("note")}
+	if vendor.Id == "" || vendor.Name == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	err := AddVendor(vendor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func listVendorsHandler(w http.ResponseWriter, r *http.Request) {
+	vendors, err := ListVendors()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(vendors)
+}
+
+// Add a fund, "budget" is in yuan.
+func newFundHandler(w http.ResponseWriter, r *http.Request) {
+	fund := Fund{Id: r.PostFormValue("fund"), Name: r.PostFormValue("name")}
+	var err error
+	fund.Year, err = strconv.Atoi(r.PostFormValue("year"))
+	if err != nil || fund.Id == "" || fund.Name == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	fund.Budget, err = parseYuan(r.PostFormValue("budget"))
+	if err != nil || fund.Budget < 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	err = AddFund(fund)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func listFundsHandler(w http.ResponseWriter, r *http.Request) {
+	funds, err := ListFunds()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(funds)
+}
+
+// Create an order, lines are given by repeated "line_book", "line_name",
+// "line_author", "line_isbn", "line_qty" and "line_price" (in yuan) fields
+// at the same positions.
+func newOrderHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	order := PurchaseOrder{Vendor: r.PostFormValue("vendor"), Fund: r.PostFormValue("fund"), Note: r.PostFormValue("note")}
+	books := r.PostForm["line_book"]
+	if order.Vendor == "" || order.Fund == "" || len(books) == 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	field := func(name string, i int) string {
+		if values := r.PostForm[name]; i < len(values) {
+			return values[i]
+		}
+		return ""
+	}
+	for i, book := range books {
+		line := OrderLine{Book: book, Name: field("line_name", i), Author: field("line_author", i)}
+		line.Isbn, err = NormalizeIsbn(field("line_isbn", i))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		line.Quantity, err = strconv.Atoi(field("line_qty", i))
+		if err != nil || line.Quantity <= 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		line.Price, err = parseYuan(field("line_price", i))
+		if err != nil || line.Price < 0 || line.Book == "" || line.Name == "" || line.Author == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		order.Lines = append(order.Lines, line)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	oid, result := CreateOrder(ctx, GetTokenUsername(tokenCookie.Value), order)
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(strconv.Itoa(oid)))
+}
+
+// List orders, of one status if "status" is given.
+func listOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	orders, err := ListOrders(r.PostFormValue("status"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(orders)
+}
+
+func orderInfoHandler(w http.ResponseWriter, r *http.Request) {
+	oid, err := strconv.Atoi(r.PostFormValue("order"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	order, err := GetOrderInfo(oid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(order)
+}
+
+// Receive copies of an order line, by "order", "seq", "count" and the actual
+// "price" of one copy in yuan. For a new book, metadata fields like those
+// of /add can be given.
+func receiveHandler(w http.ResponseWriter, r *http.Request) {
+	oid, errOid := strconv.Atoi(r.PostFormValue("order"))
+	seq, errSeq := strconv.Atoi(r.PostFormValue("seq"))
+	count, errCount := strconv.Atoi(r.PostFormValue("count"))
+	price, errPrice := parseYuan(r.PostFormValue("price"))
+	if errOid != nil || errSeq != nil || errCount != nil || errPrice != nil || count <= 0 || price < 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	// Name and author of the line are needed to generate the call number.
+	order, err := GetOrderInfo(oid)
+	if err != nil || seq < 1 || seq > len(order.Lines) {
+		http.Error(w, "该订单明细不存在.", http.StatusConflict)
+		return
+	}
+	line := order.Lines[seq-1]
+	book := Book{Id: line.Book, Name: line.Name, Author: line.Author, Isbn: line.Isbn}
+	err = parseBookMeta(r, &book)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := ReceiveOrderLine(ctx, oid, seq, count, price, book)
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+// Close or cancel an order, by "action" of "close" or "cancel".
+func finishOrderHandler(w http.ResponseWriter, r *http.Request) {
+	oid, err := strconv.Atoi(r.PostFormValue("order"))
+	action := r.PostFormValue("action")
+	if err != nil || (action != "close" && action != "cancel") {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	status := "closed"
+	if action == "cancel" {
+		status = "cancelled"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := FinishOrder(ctx, oid, status)
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
@@ -0,0 +1,499 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 14:35:52
+ * @LastEditTime: 2026-10-20 03:02:00
+ * @LastEditors: FunctionSir
+ * @Description: Bulk import and export of books as CSV or XLSX.
+ * @FilePath: /biblio-matrix/bulk.go
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Fields of a book in sheets, also the header row of exported sheets.
+var SheetFields = []string{"id", "name", "author", "price", "count", "publisher", "year", "edition", "language",
+	"pages", "subjects", "summary", "contributors", "clc", "ddc", "callno", "shelf", "series", "volume", "isbn"}
+
+// Headers which are recognized without a column mapping, besides SheetFields.
+var SheetHeaderAliases = map[string]string{
+	"书号": "id", "编号": "id", "书名": "name", "题名": "name", "作者": "author", "著者": "author",
+	"价格": "price", "定价": "price", "数量": "count", "册数": "count", "出版社": "publisher",
+	"出版年": "year", "版次": "edition", "语种": "language", "页数": "pages", "主题词": "subjects",
+	"摘要": "summary", "责任者": "contributors", "中图法分类号": "clc", "杜威分类号": "ddc",
+	"索书号": "callno", "馆藏位置": "shelf", "丛书": "series", "卷次": "volume",
+	"ISBN": "isbn",
+}
+
+type ImportRowResult struct {
+	Row     int    `json:"row"` // Row number in the sheet, the header row is 1
+	Id      string `json:"id"`
+	Action  string `json:"action"` // "insert", "add", or "error"
+	Message string `json:"message,omitempty"`
+}
+
+type ImportReport struct {
+	Inserted int               `json:"inserted"`
+	Added    int               `json:"added"`
+	Failed   int               `json:"failed"`
+	DryRun   bool              `json:"dry_run"`
+	Rows     []ImportRowResult `json:"rows"`
+}
+
+// Guess sheet format ("csv" or "xlsx") by file name.
+func SheetFormat(fileName string) string {
+	if strings.EqualFold(filepath.Ext(fileName), ".xlsx") {
+		return "xlsx"
+	}
+	return "csv"
+}
+
+// Read all rows of a sheet, for XLSX only the first worksheet is read.
+func ReadSheet(r io.Reader, format string) ([][]string, error) {
+	if format == "xlsx" {
+		f, err := excelize.OpenReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return f.GetRows(f.GetSheetName(0))
+	}
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	// Drop BOM written by some spreadsheet programs.
+	if len(rows) > 0 && len(rows[0]) > 0 {
+		rows[0][0] = strings.TrimPrefix(rows[0][0], "\ufeff")
+	}
+	return rows, nil
+}
+
+func WriteSheet(w io.Writer, format string, rows [][]string) error {
+	if format == "xlsx" {
+		f := excelize.NewFile()
+		defer f.Close()
+		sheet := f.GetSheetName(0)
+		for i, row := range rows {
+			cell, err := excelize.CoordinatesToCellName(1, i+1)
+			if err != nil {
+				return err
+			}
+			err = f.SetSheetRow(sheet, cell, &row)
+			if err != nil {
+				return err
+			}
+		}
+		return f.Write(w)
+	}
+	writer := csv.NewWriter(w)
+	writer.WriteAll(rows)
+	return writer.Error()
+}
+
+// Parse a column mapping like "题名=name,备注=-", mapping a header to "-"
+// makes the column ignored.
+func ParseColumnMapping(mapping string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, pair := range strings.Split(mapping, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		header, field, found := strings.Cut(pair, "=")
+		header = strings.TrimSpace(header)
+		field = strings.TrimSpace(field)
+		if !found || header == "" || (field != "-" && !slices.Contains(SheetFields, field)) {
+			return nil, errors.New("illegal column mapping: " + pair)
+		}
+		res[header] = field
+	}
+	return res, nil
+}
+
+// Parse contributors written like "Name (role); Name (role)".
+func parseContributors(s string) ([]Contributor, error) {
+	res := make([]Contributor, 0)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		c := Contributor{Name: item, Role: "author"}
+		if open := strings.LastIndex(item, "("); open > 0 && strings.HasSuffix(item, ")") {
+			c.Name = strings.TrimSpace(item[:open])
+			c.Role = item[open+1 : len(item)-1]
+		}
+		if !slices.Contains(ContributorRoles, c.Role) {
+			return nil, errors.New("illegal contributor role: " + c.Role)
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// Build a book from a sheet row, the same checks as addHandler are done.
+func bookFromRow(get func(field string) string) (Book, error) {
+	var b Book
+	var err error
+	b.Id = get("id")
+	if b.Id == "" {
+		return b, errors.New("缺少书号")
+	}
+	b.Count, err = strconv.Atoi(get("count"))
+	if err != nil {
+		return b, errors.New("数量不合法")
+	}
+	b.Name = get("name")
+	b.Author = get("author")
+	price, err := strconv.ParseFloat(get("price"), 64)
+	if err != nil {
+		return b, errors.New("价格不合法")
+	}
+	b.Price = int(math.Round(price * 100))
+	b.Publisher = get("publisher")
+	b.Edition = get("edition")
+	b.Language = get("language")
+	b.Summary = get("summary")
+	b.Clc = strings.ToUpper(get("clc"))
+	b.Ddc = get("ddc")
+	b.CallNumber = get("callno")
+	b.Shelf = get("shelf")
+	b.Series = get("series")
+	b.Isbn, err = NormalizeIsbn(get("isbn"))
+	if err != nil {
+		return b, errors.New("ISBN不合法")
+	}
+	if year := get("year"); year != "" {
+		b.Year, err = strconv.Atoi(year)
+		if err != nil || b.Year < 0 {
+			return b, errors.New("出版年不合法")
+		}
+	}
+	if volume := get("volume"); volume != "" {
+		b.Volume, err = strconv.Atoi(volume)
+		if err != nil || b.Volume < 0 {
+			return b, errors.New("卷次不合法")
+		}
+	}
+	if pages := get("pages"); pages != "" {
+		b.Pages, err = strconv.Atoi(pages)
+		if err != nil || b.Pages < 0 {
+			return b, errors.New("页数不合法")
+		}
+	}
+	b.Subjects = make([]string, 0)
+	for _, subject := range strings.Split(get("subjects"), ";") {
+		if subject = strings.TrimSpace(subject); subject != "" {
+			b.Subjects = append(b.Subjects, subject)
+		}
+	}
+	b.Contributors, err = parseContributors(get("contributors"))
+	if err != nil {
+		return b, err
+	}
+	if b.CallNumber == "" {
+		b.CallNumber = GenCallNumber(b)
+	}
+	return b, nil
+}
+
+// Add count copies to an existing book, refusing withdrawn ones like
+// ReceiveOrderLine does. With dryRun, only the checks are done.
+func addImportedCnt(id string, count int, dryRun bool) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	var status string
+	err = tx.QueryRowContext(ctx, "SELECT STATUS FROM BOOKS WITH (UPDLOCK) WHERE ID=?", id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "该书不存在."
+	}
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if status == "withdrawn" {
+		return "该书已下架, 请先恢复(/restore/book)再入藏."
+	}
+	if dryRun {
+		return ""
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE BOOKS SET CNT=CNT+? WHERE ID=?", count, id)
+	if err != nil {
+		return "无法增加数量. 请联系管理员."
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+// Import books from sheet rows, the first row is the header row.
+// Like addHandler, a new ID inserts the book, and an existing ID only
+// adds the count to it, unless withdrawn. Nothing is written if dryRun is
+// true, but rows are checked the same.
+func ImportBooks(rows [][]string, mapping map[string]string, dryRun bool) (ImportReport, error) {
+	report := ImportReport{DryRun: dryRun, Rows: make([]ImportRowResult, 0)}
+	if len(rows) == 0 {
+		return report, errors.New("empty sheet")
+	}
+	cols := make(map[string]int)
+	for i, header := range rows[0] {
+		header = strings.TrimSpace(header)
+		field, ok := mapping[header]
+		if !ok {
+			field, ok = SheetHeaderAliases[header]
+		}
+		if !ok {
+			field = strings.ToLower(header)
+		}
+		if slices.Contains(SheetFields, field) {
+			cols[field] = i
+		}
+	}
+	for _, field := range []string{"id", "count"} {
+		if _, ok := cols[field]; !ok {
+			return report, errors.New("no column for required field: " + field)
+		}
+	}
+	seen := make(map[string]bool)
+	for i, row := range rows[1:] {
+		get := func(field string) string {
+			col, ok := cols[field]
+			if !ok || col >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[col])
+		}
+		if strings.TrimSpace(strings.Join(row, "")) == "" {
+			continue
+		}
+		result := ImportRowResult{Row: i + 2, Id: get("id")}
+		fail := func(msg string) {
+			result.Action = "error"
+			result.Message = msg
+			report.Failed++
+			report.Rows = append(report.Rows, result)
+		}
+		if result.Id == "" {
+			fail("缺少书号")
+			continue
+		}
+		count, err := strconv.Atoi(get("count"))
+		if err != nil {
+			fail("数量不合法")
+			continue
+		}
+		exists, err := IsBookExists(result.Id)
+		if err != nil {
+			return report, err
+		}
+		if exists || seen[result.Id] {
+			if count <= 0 {
+				fail("数量不合法")
+				continue
+			}
+			// Books inserted earlier by a dry run are not there, but would
+			// be active.
+			if exists {
+				if msg := addImportedCnt(result.Id, count, dryRun); msg != "" {
+					fail(msg)
+					continue
+				}
+			}
+			result.Action = "add"
+			report.Added++
+			report.Rows = append(report.Rows, result)
+			continue
+		}
+		b, err := bookFromRow(get)
+		if err != nil {
+			fail(err.Error())
+			continue
+		}
+		if b.Name == "" || b.Author == "" || b.Price < 0 || b.Count <= 0 {
+			fail("书名, 作者, 价格或数量不合法")
+			continue
+		}
+		if !dryRun {
+			err = AddBook(b)
+			if err != nil {
+				fail(err.Error())
+				continue
+			}
+		}
+		seen[b.Id] = true
+		result.Action = "insert"
+		report.Inserted++
+		report.Rows = append(report.Rows, result)
+	}
+	return report, nil
+}
+
+// Rows of all books not withdrawn, with a header row of SheetFields.
+func ExportBooks() ([][]string, error) {
+	books, err := QueryBooks("STATUS='active' ORDER BY ID")
+	if err != nil {
+		return nil, err
+	}
+	rows := [][]string{SheetFields}
+	for _, b := range books {
+		rows = append(rows, []string{b.Id, b.Name, b.Author, fmt.Sprintf("%d.%02d", b.Price/100, b.Price%100),
+			strconv.Itoa(b.Count), b.Publisher, strconv.Itoa(b.Year), b.Edition, b.Language, strconv.Itoa(b.Pages),
+			subjectsString(b.Subjects), b.Summary, contributorsString(b.Contributors), b.Clc, b.Ddc, b.CallNumber, b.Shelf,
+			b.Series, strconv.Itoa(b.Volume), b.Isbn})
+	}
+	return rows, nil
+}
+
+// Import books from the uploaded file "file", format is guessed by the file
+// name unless "format" is given. Set "dry" to "1" to only validate.
+func importBooksHandler(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	format := r.FormValue("format")
+	if format == "" {
+		format = SheetFormat(header.Filename)
+	}
+	if format != "csv" && format != "xlsx" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	mapping, err := ParseColumnMapping(r.FormValue("map"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows, err := ReadSheet(file, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := ImportBooks(rows, mapping, r.FormValue("dry") == "1")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+func exportBooksHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	rows, err := ExportBooks()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if format == "xlsx" {
+		w.Header().Add("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	} else {
+		w.Header().Add("Content-Type", "text/csv; charset=utf-8")
+	}
+	w.Header().Add("Content-Disposition", "attachment; filename=\"books."+format+"\"")
+	w.WriteHeader(http.StatusOK)
+	// Headers are sent already, the client sees a truncated file at worst.
+	if err = WriteSheet(w, format, rows); err != nil {
+		log.Println("Failed to export books: " + err.Error())
+	}
+}
+
+// Usage: import-books CONFIG-FILE SHEET-FILE [COLUMN-MAPPING] [--dry]
+func importBooksCmd(args []string) {
+	dryRun := slices.Contains(args, "--dry")
+	args = slices.DeleteFunc(args, func(arg string) bool { return arg == "--dry" })
+	if len(args) < 2 {
+		panic("usage: import-books CONFIG-FILE SHEET-FILE [COLUMN-MAPPING] [--dry]")
+	}
+	loadConf(args[0])
+	mapping := make(map[string]string)
+	var err error
+	if len(args) > 2 {
+		mapping, err = ParseColumnMapping(args[2])
+		if err != nil {
+			panic(err)
+		}
+	}
+	file, err := os.Open(args[1])
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	rows, err := ReadSheet(file, SheetFormat(args[1]))
+	if err != nil {
+		panic(err)
+	}
+	report, err := ImportBooks(rows, mapping, dryRun)
+	if err != nil {
+		panic(err)
+	}
+	for _, row := range report.Rows {
+		if row.Action == "error" {
+			fmt.Printf("Row %d (%s): %s\n", row.Row, row.Id, row.Message)
+		}
+	}
+	fmt.Printf("Inserted: %d, Added: %d, Failed: %d\n", report.Inserted, report.Added, report.Failed)
+	if dryRun {
+		fmt.Println("Dry run, nothing was written.")
+	}
+}
+
+// Usage: export-books CONFIG-FILE SHEET-FILE
+func exportBooksCmd(args []string) {
+	if len(args) < 2 {
+		panic("usage: export-books CONFIG-FILE SHEET-FILE")
+	}
+	loadConf(args[0])
+	rows, err := ExportBooks()
+	if err != nil {
+		panic(err)
+	}
+	file, err := os.Create(args[1])
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	err = WriteSheet(file, SheetFormat(args[1]), rows)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Exported %d books.\n", len(rows)-1)
+}
@@ -0,0 +1,218 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 15:48:03
+ * @LastEditTime: 2026-10-20 01:17:05
+ * @LastEditors: FunctionSir
+ * @Description: Citations of books in BibTeX, RIS and CSL-JSON.
+ * @FilePath: /biblio-matrix/citation.go
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Content types of citation formats.
+var CitationTypes = map[string]string{
+	"bibtex": "application/x-bibtex",
+	"ris":    "application/x-research-info-systems",
+	"csl":    "application/vnd.citationstyles.csl+json",
+}
+
+// Decide the citation format of a request by the "format" param, or by the
+// Accept header if there is no such param. Returns "" if JSON is wanted, and
+// false if the format asked for by the param is unknown.
+func CitationFormat(r *http.Request) (string, bool) {
+	format := r.FormValue("format")
+	if format == "json" {
+		return "", true
+	}
+	if format != "" {
+		_, ok := CitationTypes[format]
+		return format, ok
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		if mediaType == "application/json" || mediaType == "*/*" {
+			return "", true
+		}
+		for format, contentType := range CitationTypes {
+			if mediaType == contentType {
+				return format, true
+			}
+		}
+	}
+	return "", true
+}
+
+// Names of contributors of a book with the role given, for authors, the
+// author field is used if no author is in contributors.
+func contributorNames(b Book, role string) []string {
+	names := make([]string, 0)
+	for _, c := range b.Contributors {
+		if c.Role == role {
+			names = append(names, c.Name)
+		}
+	}
+	if role == "author" && len(names) == 0 && b.Author != "" {
+		names = append(names, b.Author)
+	}
+	return names
+}
+
+var bibtexEscaper = strings.NewReplacer("\\", "\\textbackslash{}", "{", "\\{", "}", "\\}",
+	"%", "\\%", "&", "\\&", "$", "\\$", "#", "\\#", "_", "\\_")
+
+// Make a BibTeX key from the ID of a book, which can only have safe chars.
+func bibtexKey(id string) string {
+	var key strings.Builder
+	key.WriteString("book")
+	for _, r := range id {
+		if r < 128 && (r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '-') {
+			key.WriteRune(r)
+		}
+	}
+	return key.String()
+}
+
+func WriteBibTeX(w io.Writer, books []Book) {
+	for _, b := range books {
+		fmt.Fprintf(w, "@book{%s,\n", bibtexKey(b.Id))
+		field := func(name, value string) {
+			if value != "" {
+				fmt.Fprintf(w, "  %s = {%s},\n", name, bibtexEscaper.Replace(value))
+			}
+		}
+		field("title", b.Name)
+		field("author", strings.Join(contributorNames(b, "author"), " and "))
+		field("editor", strings.Join(contributorNames(b, "editor"), " and "))
+		field("translator", strings.Join(contributorNames(b, "translator"), " and "))
+		field("publisher", b.Publisher)
+		if b.Year > 0 {
+			field("year", strconv.Itoa(b.Year))
+		}
+		field("edition", b.Edition)
+		field("language", b.Language)
+		if b.Pages > 0 {
+			field("pagetotal", strconv.Itoa(b.Pages))
+		}
+		field("keywords", strings.Join(b.Subjects, ", "))
+		field("abstract", b.Summary)
+		field("isbn", b.Isbn)
+		field("note", b.CallNumber)
+		fmt.Fprint(w, "}\n\n")
+	}
+}
+
+func WriteRIS(w io.Writer, books []Book) {
+	for _, b := range books {
+		tag := func(name, value string) {
+			if value != "" {
+				fmt.Fprintf(w, "%s  - %s\r\n", name, strings.ReplaceAll(value, "\n", " "))
+			}
+		}
+		tag("TY", "BOOK")
+		tag("ID", b.Id)
+		tag("TI", b.Name)
+		for _, name := range contributorNames(b, "author") {
+			tag("AU", name)
+		}
+		for _, name := range contributorNames(b, "editor") {
+			tag("ED", name)
+		}
+		for _, name := range contributorNames(b, "translator") {
+			tag("A4", name)
+		}
+		if b.Year > 0 {
+			tag("PY", strconv.Itoa(b.Year))
+		}
+		tag("PB", b.Publisher)
+		tag("ET", b.Edition)
+		tag("LA", b.Language)
+		for _, subject := range b.Subjects {
+			tag("KW", subject)
+		}
+		tag("AB", b.Summary)
+		tag("SN", b.Isbn)
+		tag("CN", b.CallNumber)
+		fmt.Fprint(w, "ER  - \r\n\r\n")
+	}
+}
+
+type cslName struct {
+	Literal string `json:"literal"`
+}
+
+type cslDate struct {
+	DateParts [][]int `json:"date-parts"`
+}
+
+type cslItem struct {
+	Id         string    `json:"id"`
+	Type       string    `json:"type"`
+	Title      string    `json:"title"`
+	Author     []cslName `json:"author,omitempty"`
+	Editor     []cslName `json:"editor,omitempty"`
+	Translator []cslName `json:"translator,omitempty"`
+	Publisher  string    `json:"publisher,omitempty"`
+	Issued     *cslDate  `json:"issued,omitempty"`
+	Edition    string    `json:"edition,omitempty"`
+	Language   string    `json:"language,omitempty"`
+	Pages      string    `json:"number-of-pages,omitempty"`
+	Keyword    string    `json:"keyword,omitempty"`
+	Abstract   string    `json:"abstract,omitempty"`
+	CallNumber string    `json:"call-number,omitempty"`
+	Isbn       string    `json:"ISBN,omitempty"`
+}
+
+func cslNames(names []string) []cslName {
+	res := make([]cslName, 0, len(names))
+	for _, name := range names {
+		res = append(res, cslName{Literal: name})
+	}
+	return res
+}
+
+func WriteCSLJSON(w io.Writer, books []Book) {
+	items := make([]cslItem, 0, len(books))
+	for _, b := range books {
+		item := cslItem{Id: b.Id, Type: "book", Title: b.Name, Publisher: b.Publisher, Edition: b.Edition,
+			Language: b.Language, Keyword: strings.Join(b.Subjects, ", "), Abstract: b.Summary, CallNumber: b.CallNumber, Isbn: b.Isbn,
+			Author:     cslNames(contributorNames(b, "author")),
+			Editor:     cslNames(contributorNames(b, "editor")),
+			Translator: cslNames(contributorNames(b, "translator"))}
+		if b.Year > 0 {
+			item.Issued = &cslDate{DateParts: [][]int{{b.Year}}}
+		}
+		if b.Pages > 0 {
+			item.Pages = strconv.Itoa(b.Pages)
+		}
+		items = append(items, item)
+	}
+	json.NewEncoder(w).Encode(items)
+}
+
+// Write citations of books in the format given, see CitationTypes.
+func WriteCitations(w http.ResponseWriter, format string, books []Book) {
+	w.Header().Add("Content-Type", CitationTypes[format]+"; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	switch format {
+	case "bibtex":
+		WriteBibTeX(w, books)
+	case "ris":
+		WriteRIS(w, books)
+	case "csl":
+		WriteCSLJSON(w, books)
+	}
+}
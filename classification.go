@@ -0,0 +1,290 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 13:40:16
+ * @LastEditTime: 2026-10-20 01:14:30
+ * @LastEditors: FunctionSir
+ * @Description: Classification numbers, call numbers and browsing by class.
+ * @FilePath: /biblio-matrix/classification.go
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Main classes of the Chinese Library Classification (5th ed.).
+var ClcMainClasses = map[string]string{
+	"A": "马克思主义、列宁主义、毛泽东思想、邓小平理论",
+	"B": "哲学、宗教",
+	"C": "社会科学总论",
+	"D": "政治、法律",
+	"E": "军事",
+	"F": "经济",
+	"G": "文化、科学、教育、体育",
+	"H": "语言、文字",
+	"I": "文学",
+	"J": "艺术",
+	"K": "历史、地理",
+	"N": "自然科学总论",
+	"O": "数理科学和化学",
+	"P": "天文学、地球科学",
+	"Q": "生物科学",
+	"R": "医药、卫生",
+	"S": "农业科学",
+	"T": "工业技术",
+	"U": "交通运输",
+	"V": "航空、航天",
+	"X": "环境科学、安全科学",
+	"Z": "综合性图书",
+}
+
+// Main classes of the Dewey Decimal Classification.
+var DdcMainClasses = map[string]string{
+	"0": "Computer science, information and general works",
+	"1": "Philosophy and psychology",
+	"2": "Religion",
+	"3": "Social sciences",
+	"4": "Language",
+	"5": "Science",
+	"6": "Technology",
+	"7": "Arts and recreation",
+	"8": "Literature",
+	"9": "History and geography",
+}
+
+// Nationality marks like "[英]" or "（美）" before names of authors.
+var nationalityMark = regexp.MustCompile(`^\s*[\[［(（【][^\]］)）】]*[\]］)）】]\s*`)
+
+// Get the main entry of an author used for the author mark, that is the
+// surname of a western author or the pinyin of a Chinese author.
+func AuthorEntry(author string) string {
+	author = nationalityMark.ReplaceAllString(author, "")
+	if before, _, found := strings.Cut(author, ","); found {
+		author = before
+	}
+	hasHan := false
+	for _, r := range author {
+		if unicode.Is(unicode.Han, r) {
+			hasHan = true
+			break
+		}
+	}
+	if !hasHan {
+		fields := strings.Fields(author)
+		if len(fields) == 0 {
+			return ""
+		}
+		author = fields[len(fields)-1]
+	}
+	entry, _ := ToPinyin(author)
+	return entry
+}
+
+// Find the number for c in a cutter table, tables are like "a3e4i5o6r7u8y9",
+// letters before the first one listed get 2.
+func cutterDigit(table string, c byte) byte {
+	digit := byte('2')
+	for i := 0; i+1 < len(table); i += 2 {
+		if table[i] <= c {
+			digit = table[i+1]
+		}
+	}
+	return digit
+}
+
+// Make a cutter number (like "L86") from an entry, using the rules of the
+// Library of Congress cutter table.
+func Cutter(entry string) string {
+	word := make([]byte, 0, len(entry))
+	for _, r := range strings.ToLower(entry) {
+		if r >= 'a' && r <= 'z' {
+			word = append(word, byte(r))
+		}
+	}
+	if len(word) == 0 {
+		return ""
+	}
+	res := []byte{byte(unicode.ToUpper(rune(word[0])))}
+	rest := word[1:]
+	switch {
+	case strings.IndexByte("aeiou", word[0]) >= 0:
+		if len(rest) > 0 {
+			res = append(res, cutterDigit("b2d3l4m4n5p6r7s8t8u9", rest[0]))
+			rest = rest[1:]
+		}
+	case word[0] == 's':
+		if len(rest) > 1 && rest[0] == 'c' && rest[1] == 'h' {
+			res = append(res, '3')
+			rest = rest[2:]
+		} else if len(rest) > 0 {
+			res = append(res, cutterDigit("a2c3e4h5i5m6n6o6p6t7u8w9", rest[0]))
+			rest = rest[1:]
+		}
+	case word[0] == 'q':
+		if len(rest) > 1 && rest[0] == 'u' {
+			res = append(res, cutterDigit("a3e4i5o6r7t8y9", rest[1]))
+			rest = rest[2:]
+		} else if len(rest) > 0 {
+			res = append(res, '2')
+			rest = rest[1:]
+		}
+	default:
+		if len(rest) > 0 {
+			res = append(res, cutterDigit("a3e4i5o6r7u8y9", rest[0]))
+			rest = rest[1:]
+		}
+	}
+	if len(rest) > 0 {
+		res = append(res, cutterDigit("a3e4i5m6p7t8w9", rest[0]))
+	}
+	return string(res)
+}
+
+// Generate a call number for a book, CLC is preferred to DDC.
+// Returns an empty string if the book is not classified.
+func GenCallNumber(b Book) string {
+	class := b.Clc
+	if class == "" {
+		class = b.Ddc
+	}
+	if class == "" {
+		return ""
+	}
+	mark := Cutter(AuthorEntry(b.Author))
+	if mark == "" {
+		return class
+	}
+	return class + " " + mark
+}
+
+// Split a call number into runs of letters and runs of digits, dots between
+// digits are dropped since class numbers and cutters are decimal fractions.
+func callNumberTokens(callNumber string) []string {
+	tokens := make([]string, 0)
+	cur := make([]rune, 0)
+	curIsDigit := false
+	flush := func() {
+		if len(cur) > 0 {
+			tokens = append(tokens, string(cur))
+			cur = cur[:0]
+		}
+	}
+	for _, r := range strings.ToUpper(callNumber) {
+		switch {
+		case r == '.':
+			continue
+		case unicode.IsDigit(r):
+			if !curIsDigit {
+				flush()
+			}
+			curIsDigit = true
+			cur = append(cur, r)
+		case unicode.IsLetter(r):
+			if curIsDigit {
+				flush()
+			}
+			curIsDigit = false
+			cur = append(cur, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// Compare call numbers in shelf order, like "I24" < "I242.4 L86" < "I25".
+func CompareCallNumbers(a, b string) int {
+	return slices.Compare(callNumberTokens(a), callNumberTokens(b))
+}
+
+// Sort books in shelf order, books without call numbers are put at the end.
+func SortByCallNumber(books []Book) {
+	slices.SortStableFunc(books, func(a, b Book) int {
+		if a.CallNumber == "" || b.CallNumber == "" {
+			return strings.Compare(b.CallNumber, a.CallNumber)
+		}
+		return CompareCallNumbers(a.CallNumber, b.CallNumber)
+	})
+}
+
+// Normalize a class number for browsing, "I242.4" gives "I2424".
+func classKey(class string) string {
+	return strings.ReplaceAll(strings.ToUpper(strings.TrimSpace(class)), ".", "")
+}
+
+type ClassNode struct {
+	Class string `json:"class"`           // Prefix of class numbers, dots dropped
+	Label string `json:"label,omitempty"` // Caption, only known for main classes
+	Books int    `json:"books"`           // Books in this class and its sub classes
+}
+
+type ClassBrowse struct {
+	Scheme   string      `json:"scheme"`
+	Class    string      `json:"class"`
+	Children []ClassNode `json:"children"`
+	Books    []Book      `json:"books"` // Books classed exactly here
+}
+
+// Browse the catalog by classification hierarchy, every level of the
+// hierarchy is one more char of the class number. Counting and filtering
+// are done by the database, only books classed exactly here are loaded.
+func BrowseClass(scheme string, prefix string) (ClassBrowse, error) {
+	res := ClassBrowse{Scheme: scheme, Class: classKey(prefix), Children: make([]ClassNode, 0), Books: make([]Book, 0)}
+	labels := ClcMainClasses
+	if scheme == "ddc" {
+		labels = DdcMainClasses
+	}
+	// The same as classKey, in SQL.
+	key := "REPLACE(UPPER(LTRIM(RTRIM(" + strings.ToUpper(scheme) + "))),'.','')"
+	db := DbOpen(DbConn)
+	rows, err := db.Query("SELECT CHILD,COUNT(*) FROM (SELECT LEFT("+key+",?) AS CHILD FROM BOOKS WHERE STATUS='active' AND "+key+" LIKE ? AND LEN("+key+")>?) AS C GROUP BY CHILD ORDER BY CHILD",
+		len(res.Class)+1, strings.TrimPrefix(LikePattern(res.Class), "%"), len(res.Class))
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var node ClassNode
+		if err = rows.Scan(&node.Class, &node.Books); err != nil {
+			return res, err
+		}
+		node.Label = labels[node.Class]
+		res.Children = append(res.Children, node)
+	}
+	if err = rows.Err(); err != nil {
+		return res, err
+	}
+	res.Books, err = QueryBooks("STATUS='active' AND "+key+"<>'' AND "+key+"=?", res.Class)
+	if err != nil {
+		return res, err
+	}
+	SortByCallNumber(res.Books)
+	return res, nil
+}
+
+func browseClassHandler(w http.ResponseWriter, r *http.Request) {
+	scheme := r.FormValue("scheme")
+	if scheme == "" {
+		scheme = "clc"
+	}
+	if scheme != "clc" && scheme != "ddc" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	res, err := BrowseClass(scheme, r.FormValue("class"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
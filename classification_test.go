@@ -0,0 +1,73 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-20 01:14:30
+ * @LastEditTime: 2026-10-20 01:14:30
+ * @LastEditors: FunctionSir
+ * @Description: Tests of cutter numbers and call numbers.
+ * @FilePath: /biblio-matrix/classification_test.go
+ */
+
+package main
+
+import "testing"
+
+func TestCutter(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  string
+	}{
+		{"", ""},
+		{"123", ""},
+		{"Lee", "L44"},
+		{"Adams", "A33"},
+		{"Smith", "S65"},
+		{"Schmidt", "S36"},
+		{"Quinn", "Q56"},
+		{"Qadir", "Q23"},
+		{"O'Brien", "O27"},
+		{"Eliot", "E45"},
+		{"luxun", "L89"},
+		{"X", "X"},
+	}
+	for _, tt := range tests {
+		if got := Cutter(tt.entry); got != tt.want {
+			t.Errorf("Cutter(%q) = %q, want %q", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestCompareCallNumbers(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"I24", "I24", 0},
+		{"i24", "I24", 0},
+		{"I24", "I242.4 L86", -1},
+		{"I242.4 L86", "I25", -1},
+		{"I25", "I242.4 L86", 1},
+		{"TP3", "TP31", -1},
+		{"TP311 A33", "TP311 B2", -1},
+		{"TP311 Z9", "TP311.1", -1},
+		{"TP311.1 L86", "TP311.1 L9", -1},
+		{"K825.6", "TP311", -1},
+		{"", "A1", -1},
+	}
+	for _, tt := range tests {
+		if got := CompareCallNumbers(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareCallNumbers(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSortByCallNumber(t *testing.T) {
+	books := []Book{{Id: "1", CallNumber: "I25"}, {Id: "2"}, {Id: "3", CallNumber: "I242.4 L86"}, {Id: "4", CallNumber: "I24"}}
+	SortByCallNumber(books)
+	want := []string{"4", "3", "1", "2"}
+	for i, b := range books {
+		if b.Id != want[i] {
+			t.Fatalf("SortByCallNumber gave %v at %d, want %s", b.Id, i, want[i])
+		}
+	}
+}
@@ -0,0 +1,288 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-20 00:16:30
+ * @LastEditTime: 2026-10-20 00:16:30
+ * @LastEditors: FunctionSir
+ * @Description: Cover images of books and their thumbnails.
+ * @FilePath: /biblio-matrix/covers.go
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Covers are kept in these sizes, as JPEG fitting in a square of the size
+// in pixels. Uploaded files are not kept, so that metadata like EXIF is gone.
+var CoverSizes = map[string]int{"small": 120, "medium": 320, "large": 1200}
+
+const DefaultCoverSize = "medium"
+
+const MaxCoverSize = 10 << 20
+
+// Larger images are refused before decoding them.
+const MaxCoverPixels = 40_000_000
+
+var CoverFormats = []string{"jpeg", "png", "gif", "webp"}
+
+// Covers are kept by the SHA-256 of the uploaded file, so that books can
+// share them, like after merging.
+func coverKey(hash string, size string) string {
+	return "covers/" + hash + "/" + size + ".jpg"
+}
+
+// URL of the cover of a book, versioned so that it can be cached for long.
+func CoverUrl(bookId string, hash string) string {
+	return "/covers/" + url.PathEscape(bookId) + "?v=" + hash[:16]
+}
+
+// Scale an image down to fit in a square of size pixels, on white, since
+// JPEG has no transparency. Smaller images are not enlarged.
+func scaleCover(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
+
+// Check and decode an uploaded cover, returns its hash.
+func decodeCover(data []byte) (image.Image, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || !slices.Contains(CoverFormats, format) {
+		return nil, "", errors.New("封面须为JPEG, PNG, GIF或WebP图片.")
+	}
+	if config.Width < 32 || config.Height < 32 || config.Width*config.Height > MaxCoverPixels {
+		return nil, "", errors.New("封面图片尺寸不合适.")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errors.New("封面图片已损坏.")
+	}
+	hash := sha256.Sum256(data)
+	return img, hex.EncodeToString(hash[:]), nil
+}
+
+func storeCover(img image.Image, hash string) error {
+	for size, pixels := range CoverSizes {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, scaleCover(img, pixels), &jpeg.Options{Quality: 85}); err != nil {
+			return err
+		}
+		if err := Attachments.Put(coverKey(hash, size), &buf, int64(buf.Len())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove files of a cover if no book uses it anymore.
+func removeCoverIfUnused(hash string) {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "SELECT COUNT(*) FROM BOOKS WHERE COVER=?")
+	var users int
+	if err := stmt.QueryRow(hash).Scan(&users); err != nil || users > 0 {
+		return
+	}
+	for size := range CoverSizes {
+		Attachments.Delete(coverKey(hash, size))
+	}
+}
+
+// Set the cover of a book, hash is empty to remove it. The change is
+// recorded in the history of the book.
+func SetCover(ctx context.Context, admin string, bookId string, hash string) string {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	row := tx.QueryRowContext(ctx, "SELECT VER,COVER FROM BOOKS WITH (UPDLOCK) WHERE ID=?", bookId)
+	var ver int
+	var old sql.NullString
+	err = row.Scan(&ver, &old)
+	if err == sql.ErrNoRows {
+		return "该书不存在."
+	}
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if old.String == hash {
+		return ""
+	}
+	now := time.Now().UTC()
+	_, err = tx.ExecContext(ctx, "UPDATE BOOKS SET COVER=?,VER=VER+1,MODIFIED=? WHERE ID=?", NullString(hash), now, bookId)
+	if err != nil {
+		return "无法更新封面, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO BOOK_HISTORY (ID,VER,CHANGED,CHANGED_BY,FIELD,OLD_VAL,NEW_VAL) VALUES (?,?,?,?,?,?,?)",
+		bookId, ver+1, now, admin, "cover", old.String, hash)
+	if err != nil {
+		return "无法记录修改历史, 请联系管理员."
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	if old.Valid {
+		removeCoverIfUnused(old.String)
+	}
+	return ""
+}
+
+// Upload the cover "file" of "book".
+func uploadCoverHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, MaxCoverSize+1<<20)
+	file, header, err := r.FormFile("file")
+	book := r.FormValue("book")
+	if err != nil || book == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > MaxCoverSize {
+		http.Error(w, "封面图片过大.", http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	img, hash, err := decodeCover(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = storeCover(img, hash); err != nil {
+		http.Error(w, "无法保存封面, 请联系管理员.", http.StatusConflict)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := SetCover(ctx, GetTokenUsername(tokenCookie.Value), book, hash)
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		removeCoverIfUnused(hash)
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(CoverUrl(book, hash)))
+}
+
+func delCoverHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	book := r.PostFormValue("book")
+	if book == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := SetCover(ctx, GetTokenUsername(tokenCookie.Value), book, "")
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+// Serve the cover of a book in "size", medium by default. Versioned URLs
+// (with "v" of the current cover) are cached for long, others revalidated
+// with the ETag.
+func coverHandler(w http.ResponseWriter, r *http.Request) {
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = DefaultCoverSize
+	}
+	if _, ok := CoverSizes[size]; !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "SELECT COVER,MODIFIED FROM BOOKS WHERE ID=?")
+	var hash sql.NullString
+	var modified time.Time
+	err := stmt.QueryRow(r.PathValue("id")).Scan(&hash, &modified)
+	if err == sql.ErrNoRows || (err == nil && !hash.Valid) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	etag := "\"" + hash.String[:16] + "-" + size + "\""
+	w.Header().Set("ETag", etag)
+	if v := r.URL.Query().Get("v"); len(v) >= 16 && strings.HasPrefix(hash.String, v) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if tag = strings.TrimSpace(tag); tag == etag || tag == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	file, err := Attachments.Get(coverKey(hash.String, size))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "image/jpeg")
+	if seeker, ok := file.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", modified, seeker)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, file)
+}
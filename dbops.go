@@ -2,7 +2,7 @@
  * @Author: FunctionSir
  * @License: AGPLv3
  * @Date: 2025-06-20 09:50:27
- * @LastEditTime: 2025-06-23 09:53:29
+ * @LastEditTime: 2026-10-20 02:33:00
  * @LastEditors: FunctionSir
  * @Description: -
  * @FilePath: /biblio-matrix/dbops.go
@@ -13,20 +13,209 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 
-	_ "github.com/microsoft/go-mssqldb"
+	mssql "github.com/microsoft/go-mssqldb"
 	"golang.org/x/crypto/bcrypt"
 )
 
+type Contributor struct {
+	Name string `json:"name"`
+	Role string `json:"role"` // One of ContributorRoles
+}
+
+var ContributorRoles = []string{"author", "editor", "translator"}
+
 type Book struct {
-	Id     string `json:"id"`
-	Name   string `json:"name"`
-	Author string `json:"author"`
-	Price  int    `json:"price"`
-	Count  int    `json:"count"`
+	Id           string        `json:"id"`
+	Name         string        `json:"name"`
+	Author       string        `json:"author"`
+	Price        int           `json:"price"`
+	Count        int           `json:"count"`
+	Publisher    string        `json:"publisher"`
+	Year         int           `json:"year"` // Publication year, 0 if unknown
+	Edition      string        `json:"edition"`
+	Language     string        `json:"language"`
+	Pages        int           `json:"pages"` // Page count, 0 if unknown
+	Subjects     []string      `json:"subjects"`
+	Summary      string        `json:"summary"`
+	Contributors []Contributor `json:"contributors"`
+	Version      int           `json:"version"` // Increased by one on every update
+	Status       string        `json:"status"`  // "active" or "withdrawn"
+	Withdrawn    *Withdrawal   `json:"withdrawn,omitempty"`
+	Clc          string        `json:"clc"`    // Chinese Library Classification number
+	Ddc          string        `json:"ddc"`    // Dewey Decimal Classification number
+	CallNumber   string        `json:"callno"` // Class number and author mark
+	Shelf        string        `json:"shelf"`  // Shelf location, like "3F-A-12"
+	Series       string        `json:"series"` // ID of the series or set, empty if none
+	Volume       int           `json:"volume"` // Volume number in the series, 0 if none
+	Isbn         string        `json:"isbn"`   // ISBN-13, empty if unknown
+	Rating       float64       `json:"rating"` // Average star rating of readers, 0 if none
+	Ratings      int           `json:"ratings"`
+	Tags         []string      `json:"tags"`     // Tags by readers, most used first
+	Modified     time.Time     `json:"modified"` // Last change of the record, not counting loans
+	Added        time.Time     `json:"added"`
+	Cover        string        `json:"cover"` // URL of the cover image, empty if none
+}
+
+type Withdrawal struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// Cols of BOOKS which are scanned by ScanBook, in order.
+const BookCols = "ID,\"NAME\",AUTHOR,PRICE,CNT,PUBLISHER,PUB_YEAR,EDITION,LANG,PAGES,SUMMARY,VER,STATUS,WITHDRAWN_REASON,WITHDRAWN_AT,CLC,DDC,CALL_NO,SHELF,SERIES_ID,VOLUME,ISBN,MODIFIED,ADDED,COVER"
+
+type RowScanner interface {
+	Scan(dest ...any) error
+}
+
+func ScanBook(row RowScanner) (Book, error) {
+	var b Book
+	var withdrawnReason sql.NullString
+	var withdrawnAt sql.NullTime
+	var series sql.NullString
+	var cover sql.NullString
+	err := row.Scan(&b.Id, &b.Name, &b.Author, &b.Price, &b.Count, &b.Publisher, &b.Year, &b.Edition, &b.Language, &b.Pages, &b.Summary, &b.Version,
+		&b.Status, &withdrawnReason, &withdrawnAt, &b.Clc, &b.Ddc, &b.CallNumber, &b.Shelf, &series, &b.Volume, &b.Isbn, &b.Modified, &b.Added, &cover)
+	b.Series = series.String
+	if cover.Valid {
+		b.Cover = CoverUrl(b.Id, cover.String)
+	}
+	if withdrawnAt.Valid {
+		b.Withdrawn = &Withdrawal{Reason: withdrawnReason.String, At: withdrawnAt.Time}
+	}
+	b.Subjects = make([]string, 0)
+	b.Contributors = make([]Contributor, 0)
+	b.Tags = make([]string, 0)
+	return b, err
+}
+
+// Books are queried by IDs in chunks of this size, since a statement can not
+// have more than 2100 parameters.
+const BooksChunkSize = 1000
+
+// Placeholders of n parameters, like "?,?,?".
+func Placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// Run query for IDs of books in chunks, and scan each row. The query must
+// have a "%s" for placeholders of IDs, like "WHERE ID IN (%s)".
+func queryBooksChunks(db *sql.DB, books []Book, query string, scan func(rows *sql.Rows) error) error {
+	for start := 0; start < len(books); start += BooksChunkSize {
+		chunk := books[start:min(start+BooksChunkSize, len(books))]
+		args := make([]any, len(chunk))
+		for i := range chunk {
+			args[i] = chunk[i].Id
+		}
+		rows, err := db.Query(fmt.Sprintf(query, Placeholders(len(chunk))), args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			if err = scan(rows); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load subjects and contributors of books from BOOK_SUBJECTS and BOOK_CONTRIBUTORS.
+func LoadBooksLists(db *sql.DB, books []Book) error {
+	idx := make(map[string]int)
+	for i := range books {
+		idx[books[i].Id] = i
+	}
+	err := queryBooksChunks(db, books, "SELECT ID,SUBJECT FROM BOOK_SUBJECTS WHERE ID IN (%s) ORDER BY ID,SEQ", func(rows *sql.Rows) error {
+		var id, subject string
+		if err := rows.Scan(&id, &subject); err != nil {
+			return err
+		}
+		books[idx[id]].Subjects = append(books[idx[id]].Subjects, subject)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = queryBooksChunks(db, books, "SELECT ID,\"NAME\",\"ROLE\" FROM BOOK_CONTRIBUTORS WHERE ID IN (%s) ORDER BY ID,SEQ", func(rows *sql.Rows) error {
+		var id string
+		var c Contributor
+		if err := rows.Scan(&id, &c.Name, &c.Role); err != nil {
+			return err
+		}
+		books[idx[id]].Contributors = append(books[idx[id]].Contributors, c)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return LoadBooksRatings(db, books, idx)
+}
+
+// Load average ratings and tags of books from REVIEWS and BOOK_TAGS. Only
+// approved reviews count, so a rating held back with its text is not shown.
+func LoadBooksRatings(db *sql.DB, books []Book, idx map[string]int) error {
+	err := queryBooksChunks(db, books, "SELECT ID,AVG(CAST(RATING AS FLOAT)),COUNT(*) FROM REVIEWS WHERE STATUS='approved' AND ID IN (%s) GROUP BY ID", func(rows *sql.Rows) error {
+		var id string
+		var rating float64
+		var ratings int
+		if err := rows.Scan(&id, &rating, &ratings); err != nil {
+			return err
+		}
+		books[idx[id]].Rating = math.Round(rating*10) / 10
+		books[idx[id]].Ratings = ratings
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return queryBooksChunks(db, books, "SELECT ID,TAG FROM BOOK_TAGS WHERE ID IN (%s) GROUP BY ID,TAG ORDER BY ID,COUNT(*) DESC,TAG", func(rows *sql.Rows) error {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return err
+		}
+		books[idx[id]].Tags = append(books[idx[id]].Tags, tag)
+		return nil
+	})
+}
+
+// Replace subjects and contributors of a book with those in b.
+func SaveBookLists(ctx context.Context, tx *sql.Tx, b Book) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM BOOK_SUBJECTS WHERE ID=?", b.Id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM BOOK_CONTRIBUTORS WHERE ID=?", b.Id)
+	if err != nil {
+		return err
+	}
+	for i, subject := range b.Subjects {
+		_, err = tx.ExecContext(ctx, "INSERT INTO BOOK_SUBJECTS VALUES (?,?,?)", b.Id, i, subject)
+		if err != nil {
+			return err
+		}
+	}
+	for i, c := range b.Contributors {
+		_, err = tx.ExecContext(ctx, "INSERT INTO BOOK_CONTRIBUTORS VALUES (?,?,?,?)", b.Id, i, c.Name, c.Role)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type Record struct {
@@ -44,6 +233,11 @@ func DbOpen(conn string) *sql.DB {
 	return db
 }
 
+// Empty strings are stored as NULL.
+func NullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
 func DbPrepare(db *sql.DB, query string) *sql.Stmt {
 	stmt, err := db.Prepare(query)
 	if err != nil {
@@ -52,6 +246,41 @@ func DbPrepare(db *sql.DB, query string) *sql.Stmt {
 	return stmt
 }
 
+// Set the password of a reader, or of an admin if isAdmin, hashed with
+// BCryptCost.
+func SetPasswd(username string, passwd string, isAdmin bool) error {
+	table := "READERS"
+	if isAdmin {
+		table = "ADMINS"
+	}
+	tmp, err := bcrypt.GenerateFromPassword([]byte(passwd), BCryptCost)
+	if err != nil {
+		return err
+	}
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "UPDATE "+table+" SET PASSWD=? WHERE USERNAME=?")
+	result, err := stmt.Exec(string(tmp), username)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return errors.New("该用户不存在.")
+	}
+	return nil
+}
+
+// Hash a password just checked again if BCryptCost has changed since it was
+// hashed.
+func rehashPasswd(username string, passwd string, hashedPasswd string, isAdmin bool) {
+	cost, err := bcrypt.Cost([]byte(hashedPasswd))
+	if err != nil || cost == BCryptCost {
+		return
+	}
+	if err = SetPasswd(username, passwd, isAdmin); err != nil {
+		log.Println("Failed to rehash password: " + err.Error())
+	}
+}
+
 func AuthReader(username string, passwd string) bool {
 	db := DbOpen(DbConn)
 	stmt := DbPrepare(db, "SELECT PASSWD FROM READERS WHERE USERNAME=?")
@@ -62,6 +291,7 @@ func AuthReader(username string, passwd string) bool {
 		return false
 	}
 	if bcrypt.CompareHashAndPassword([]byte(hashedPasswd), []byte(passwd)) == nil {
+		rehashPasswd(username, passwd, hashedPasswd, false)
 		return true
 	}
 	return false
@@ -77,6 +307,7 @@ func AuthAdmin(username string, passwd string) bool {
 		return false
 	}
 	if bcrypt.CompareHashAndPassword([]byte(hashedPasswd), []byte(passwd)) == nil {
+		rehashPasswd(username, passwd, hashedPasswd, true)
 		return true
 	}
 	return false
@@ -89,16 +320,29 @@ func Borrow(ctx context.Context, username string, bookId string, borrowedAt time
 		return "无法启动事务. 请联系管理员."
 	}
 	defer tx.Rollback() // If anything fail, rollback the transaction.
+	if result := BorrowTx(ctx, tx, username, bookId, borrowedAt, returnAt); result != "" {
+		return result
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+// Borrow a book in the transaction given, the caller should commit it.
+func BorrowTx(ctx context.Context, tx *sql.Tx, username string, bookId string, borrowedAt time.Time, returnAt time.Time) string {
 	row := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM RECORDS WHERE ID=? AND USERNAME=?", bookId, username)
 	var alreadyBorrowed int
-	err = row.Scan(&alreadyBorrowed)
+	err := row.Scan(&alreadyBorrowed)
 	if err != nil {
 		return "无法完成查询. 请联系管理员."
 	}
 	if alreadyBorrowed > 0 {
 		return "您已经借过该书了."
 	}
-	row = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM BOOKS WHERE ID=? AND CNT>=1", bookId)
+	// Copies kept for ready holds of others on the set of the book are not available.
+	row = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM BOOKS WHERE ID=? AND CNT-(SELECT COUNT(*) FROM SET_HOLDS H WHERE H.STATUS='ready' AND H.USERNAME<>? AND H.SERIES_ID=BOOKS.SERIES_ID)>=1 AND STATUS='active'",
+		bookId, username)
 	var bookEntryCnt int
 	err = row.Scan(&bookEntryCnt)
 	if err != nil {
@@ -119,9 +363,6 @@ func Borrow(ctx context.Context, username string, bookId string, borrowedAt time
 	if err != nil {
 		return "无法完成借书, 请联系管理员."
 	}
-	if err = tx.Commit(); err != nil {
-		return "无法成功提交事务. 请联系管理员."
-	}
 	return ""
 }
 
@@ -132,15 +373,31 @@ func Return(ctx context.Context, username string, bookId string) string {
 		return "无法启动事务. 请联系管理员."
 	}
 	defer tx.Rollback() // If anything fail, rollback the transaction.
+	if result := ReturnTx(ctx, tx, username, bookId); result != "" {
+		return result
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+// Return a book in the transaction given, the caller should commit it.
+func ReturnTx(ctx context.Context, tx *sql.Tx, username string, bookId string) string {
 	row := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM RECORDS WHERE ID=? AND USERNAME=?", bookId, username)
 	var alreadyBorrowed int
-	err = row.Scan(&alreadyBorrowed)
+	err := row.Scan(&alreadyBorrowed)
 	if err != nil {
 		return "无法完成查询. 请联系管理员."
 	}
 	if alreadyBorrowed <= 0 {
 		return "您还没有借过过该书."
 	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO LOAN_HISTORY (USERNAME,ID,BORROWED,RETURNED) SELECT USERNAME,ID,BORROWED,? FROM RECORDS WHERE ID=? AND USERNAME=?",
+		time.Now().UTC(), bookId, username)
+	if err != nil {
+		return "无法记录借阅历史, 请联系管理员."
+	}
 	_, err = tx.ExecContext(ctx, "DELETE FROM RECORDS WHERE ID=? AND USERNAME=?", bookId, username)
 	if err != nil {
 		return "无法完成还书, 请联系管理员."
@@ -153,26 +410,64 @@ func Return(ctx context.Context, username string, bookId string) string {
 	if err != nil {
 		return "无法完成还书, 请联系管理员."
 	}
-	if err = tx.Commit(); err != nil {
-		return "无法成功提交事务. 请联系管理员."
-	}
 	return ""
 }
 
-func ListBooks() []Book {
+// If err is of a duplicate key in a primary key or unique index.
+func IsDuplicateKey(err error) bool {
+	var dbErr mssql.Error
+	return errors.As(err, &dbErr) && (dbErr.Number == 2601 || dbErr.Number == 2627)
+}
+
+// Query books with the WHERE clause given, subjects and contributors included.
+func QueryBooks(where string, args ...any) ([]Book, error) {
 	books := make([]Book, 0)
 	db := DbOpen(DbConn)
-	stmt := DbPrepare(db, "SELECT ID,NAME,AUTHOR,PRICE,CNT FROM BOOKS")
-	rows, err := stmt.Query()
+	rows, err := db.Query("SELECT "+BookCols+" FROM BOOKS WHERE "+where, args...)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	var tmp Book
 	for rows.Next() {
-		rows.Scan(&tmp.Id, &tmp.Name, &tmp.Author, &tmp.Price, &tmp.Count)
+		tmp, err := ScanBook(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
 		books = append(books, tmp)
 	}
-	return books
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = LoadBooksLists(db, books)
+	if err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+// List books not withdrawn, if keyword is not empty, only books whose ID,
+// name or author matches it (by original chars, full pinyin, or pinyin
+// initials) are listed.
+func ListBooks(keyword string) ([]Book, error) {
+	if keyword == "" {
+		return QueryBooks("STATUS='active'")
+	}
+	cond, args := KeywordCond(keyword)
+	return QueryBooks("STATUS='active' AND "+cond, args...)
+}
+
+// The condition on BOOKS of matching a keyword, as ListBooks does.
+func KeywordCond(keyword string) (string, []any) {
+	raw := LikePattern(keyword)
+	normalized := LikePattern(NormalizeKeyword(keyword))
+	return "(ID LIKE ? OR \"NAME\" LIKE ? OR AUTHOR LIKE ? OR NAME_PY LIKE ? OR NAME_INITIALS LIKE ? OR AUTHOR_PY LIKE ? OR AUTHOR_INITIALS LIKE ?)",
+		[]any{raw, raw, raw, normalized, normalized, normalized, normalized}
+}
+
+func ListWithdrawnBooks() ([]Book, error) {
+	return QueryBooks("STATUS='withdrawn' ORDER BY WITHDRAWN_AT DESC")
 }
 
 func IsBookExists(id string) (bool, error) {
@@ -200,15 +495,66 @@ func AddCnt(id string, count int) {
 }
 
 func AddBook(b Book) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	db := DbOpen(DbConn)
-	stmt := DbPrepare(db, "INSERT INTO BOOKS VALUES (?,?,?,?,?)")
-	_, err := stmt.Exec(b.Id, b.Name, b.Author, b.Price, b.Count)
-	return err
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	err = AddBookTx(ctx, tx, b)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Insert a book with its subjects and contributors in the transaction given.
+func AddBookTx(ctx context.Context, tx *sql.Tx, b Book) error {
+	now := time.Now().UTC()
+	namePy, nameInitials := ToPinyin(b.Name)
+	authorPy, authorInitials := ToPinyin(b.Author)
+	_, err := tx.ExecContext(ctx, "INSERT INTO BOOKS ("+BookCols+",NAME_PY,NAME_INITIALS,AUTHOR_PY,AUTHOR_INITIALS) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+		b.Id, b.Name, b.Author, b.Price, b.Count, b.Publisher, b.Year, b.Edition, b.Language, b.Pages, b.Summary, 1, "active", nil, nil,
+		b.Clc, b.Ddc, b.CallNumber, b.Shelf, NullString(b.Series), b.Volume, b.Isbn, now, now, nil,
+		namePy, nameInitials, authorPy, authorInitials)
+	if err != nil {
+		return err
+	}
+	return SaveBookLists(ctx, tx, b)
+}
+
+// Fill pinyin index cols of books which do not have them yet,
+// such as books added before pinyin search was introduced.
+func FillBooksPinyin() error {
+	db := DbOpen(DbConn)
+	rows, err := db.Query("SELECT ID,\"NAME\",AUTHOR FROM BOOKS WHERE NAME_PY IS NULL OR AUTHOR_PY IS NULL")
+	if err != nil {
+		return err
+	}
+	books := make([]Book, 0)
+	var tmp Book
+	for rows.Next() {
+		rows.Scan(&tmp.Id, &tmp.Name, &tmp.Author)
+		books = append(books, tmp)
+	}
+	rows.Close()
+	stmt := DbPrepare(db, "UPDATE BOOKS SET NAME_PY=?,NAME_INITIALS=?,AUTHOR_PY=?,AUTHOR_INITIALS=? WHERE ID=?")
+	for _, b := range books {
+		namePy, nameInitials := ToPinyin(b.Name)
+		authorPy, authorInitials := ToPinyin(b.Author)
+		_, err = stmt.Exec(namePy, nameInitials, authorPy, authorInitials, b.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func AddReader(username, passwd, name string) error {
 	db := DbOpen(DbConn)
-	stmt := DbPrepare(db, "INSERT INTO READERS VALUES (?,?,?,?)")
+	stmt := DbPrepare(db, "INSERT INTO READERS (USERNAME,PASSWD,\"NAME\",CNT) VALUES (?,?,?,?)")
 	tmp, err := bcrypt.GenerateFromPassword([]byte(passwd), BCryptCost)
 	if err != nil {
 		return err
@@ -253,6 +599,14 @@ func ListRecords(username string) []Record {
 	return result
 }
 
+// List books which are borrowed by a reader, or by anyone if username is "*".
+func ListBorrowedBooks(username string) ([]Book, error) {
+	if username == "*" {
+		return QueryBooks("ID IN (SELECT ID FROM RECORDS) ORDER BY ID")
+	}
+	return QueryBooks("ID IN (SELECT ID FROM RECORDS WHERE USERNAME=?) ORDER BY ID", username)
+}
+
 func DelUser(username string) error {
 	db := DbOpen(DbConn)
 	stmt := DbPrepare(db, "EXEC REMOVE_USER ?")
@@ -263,14 +617,87 @@ func DelUser(username string) error {
 	return nil
 }
 
-func DelBook(bookId string) error {
+// Withdraw a book, it will be hidden from borrowing and searching, but its
+// history is kept and it can be restored later.
+func WithdrawBook(ctx context.Context, admin string, bookId string, reason string) string {
 	db := DbOpen(DbConn)
-	stmt := DbPrepare(db, "DELETE FROM BOOKS WHERE ID=?")
-	_, err := stmt.Exec(bookId)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return "无法启动事务. 请联系管理员."
 	}
-	return nil
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	row := tx.QueryRowContext(ctx, "SELECT STATUS,VER FROM BOOKS WITH (UPDLOCK) WHERE ID=?", bookId)
+	var status string
+	var version int
+	err = row.Scan(&status, &version)
+	if err == sql.ErrNoRows {
+		return "该书不存在."
+	}
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if status == "withdrawn" {
+		return "该书已被下架."
+	}
+	row = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM RECORDS WHERE ID=?", bookId)
+	var onLoan int
+	err = row.Scan(&onLoan)
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if onLoan > 0 {
+		return "该书尚有" + strconv.Itoa(onLoan) + "本未归还, 无法下架."
+	}
+	now := time.Now().UTC()
+	_, err = tx.ExecContext(ctx, "UPDATE BOOKS SET STATUS='withdrawn',WITHDRAWN_REASON=?,WITHDRAWN_AT=?,VER=VER+1,MODIFIED=? WHERE ID=?", reason, now, now, bookId)
+	if err != nil {
+		return "无法完成下架, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO BOOK_HISTORY (ID,VER,CHANGED,CHANGED_BY,FIELD,OLD_VAL,NEW_VAL) VALUES (?,?,?,?,?,?,?)",
+		bookId, version+1, now, admin, "status", status, "withdrawn: "+reason)
+	if err != nil {
+		return "无法记录修改历史, 请联系管理员."
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+func RestoreBook(ctx context.Context, admin string, bookId string) string {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	row := tx.QueryRowContext(ctx, "SELECT STATUS,VER FROM BOOKS WITH (UPDLOCK) WHERE ID=?", bookId)
+	var status string
+	var version int
+	err = row.Scan(&status, &version)
+	if err == sql.ErrNoRows {
+		return "该书不存在."
+	}
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if status != "withdrawn" {
+		return "该书未被下架."
+	}
+	now := time.Now().UTC()
+	_, err = tx.ExecContext(ctx, "UPDATE BOOKS SET STATUS='active',WITHDRAWN_REASON=NULL,WITHDRAWN_AT=NULL,VER=VER+1,MODIFIED=? WHERE ID=?", now, bookId)
+	if err != nil {
+		return "无法完成恢复, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO BOOK_HISTORY (ID,VER,CHANGED,CHANGED_BY,FIELD,OLD_VAL,NEW_VAL) VALUES (?,?,?,?,?,?,?)",
+		bookId, version+1, now, admin, "status", status, "active")
+	if err != nil {
+		return "无法记录修改历史, 请联系管理员."
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
 }
 
 type OverdueReader struct {
@@ -295,17 +722,18 @@ func ListOverdueReaders() ([]OverdueReader, error) {
 }
 
 type Reader struct {
-	Username string `json:"username"`
-	Name     string `json:"name"`
-	Borrowed int    `json:"borrowed"`
+	Username    string `json:"username"`
+	Name        string `json:"name"`
+	Borrowed    int    `json:"borrowed"`
+	NoRecommend bool   `json:"no_recommend"` // Opted out of recommendations
 }
 
 func GetReaderInfo(username string) (Reader, error) {
 	db := DbOpen(DbConn)
-	stmt := DbPrepare(db, "SELECT USERNAME,\"NAME\",CNT FROM READERS WHERE USERNAME=?")
+	stmt := DbPrepare(db, "SELECT USERNAME,\"NAME\",CNT,NO_RECOMMEND FROM READERS WHERE USERNAME=?")
 	row := stmt.QueryRow(username)
 	var res Reader
-	err := row.Scan(&res.Username, &res.Name, &res.Borrowed)
+	err := row.Scan(&res.Username, &res.Name, &res.Borrowed, &res.NoRecommend)
 	if err != nil {
 		return Reader{}, err
 	}
@@ -331,12 +759,154 @@ func GetAdminInfo(username string) (Admin, error) {
 
 func GetBookInfo(bookId string) (Book, error) {
 	db := DbOpen(DbConn)
-	stmt := DbPrepare(db, "SELECT * FROM BOOKS WHERE ID=?")
+	stmt := DbPrepare(db, "SELECT "+BookCols+" FROM BOOKS WHERE ID=?")
 	row := stmt.QueryRow(bookId)
-	var tmp Book
-	err := row.Scan(&tmp.Id, &tmp.Name, &tmp.Author, &tmp.Price, &tmp.Count)
+	tmp, err := ScanBook(row)
 	if err != nil {
 		return Book{}, err
 	}
-	return tmp, nil
+	books := []Book{tmp}
+	err = LoadBooksLists(db, books)
+	if err != nil {
+		return Book{}, err
+	}
+	return books[0], nil
+}
+
+type BookChange struct {
+	Id        string    `json:"id"`      // Which book was changed
+	Version   int       `json:"version"` // Version of the book after the change
+	ChangedAt time.Time `json:"changed"`
+	ChangedBy string    `json:"by"` // Username of the admin
+	Field     string    `json:"field"`
+	Old       string    `json:"old"`
+	New       string    `json:"new"`
+}
+
+func subjectsString(subjects []string) string {
+	return strings.Join(subjects, "; ")
+}
+
+func contributorsString(contributors []Contributor) string {
+	tmp := make([]string, 0, len(contributors))
+	for _, c := range contributors {
+		tmp = append(tmp, c.Name+" ("+c.Role+")")
+	}
+	return strings.Join(tmp, "; ")
+}
+
+// Compare two versions of a book, returns changed fields (except count and version).
+func DiffBook(oldBook, newBook Book) []BookChange {
+	changes := make([]BookChange, 0)
+	diff := func(field, oldVal, newVal string) {
+		if oldVal != newVal {
+			changes = append(changes, BookChange{Id: oldBook.Id, Field: field, Old: oldVal, New: newVal})
+		}
+	}
+	diff("name", oldBook.Name, newBook.Name)
+	diff("author", oldBook.Author, newBook.Author)
+	diff("price", strconv.Itoa(oldBook.Price), strconv.Itoa(newBook.Price))
+	diff("publisher", oldBook.Publisher, newBook.Publisher)
+	diff("year", strconv.Itoa(oldBook.Year), strconv.Itoa(newBook.Year))
+	diff("edition", oldBook.Edition, newBook.Edition)
+	diff("language", oldBook.Language, newBook.Language)
+	diff("pages", strconv.Itoa(oldBook.Pages), strconv.Itoa(newBook.Pages))
+	diff("summary", oldBook.Summary, newBook.Summary)
+	diff("clc", oldBook.Clc, newBook.Clc)
+	diff("ddc", oldBook.Ddc, newBook.Ddc)
+	diff("callno", oldBook.CallNumber, newBook.CallNumber)
+	diff("shelf", oldBook.Shelf, newBook.Shelf)
+	diff("series", oldBook.Series, newBook.Series)
+	diff("volume", strconv.Itoa(oldBook.Volume), strconv.Itoa(newBook.Volume))
+	diff("isbn", oldBook.Isbn, newBook.Isbn)
+	diff("subjects", subjectsString(oldBook.Subjects), subjectsString(newBook.Subjects))
+	diff("contributors", contributorsString(oldBook.Contributors), contributorsString(newBook.Contributors))
+	return changes
+}
+
+// Update fields (except count) of a book, b.Version must be the version the
+// admin was editing, or the update will be refused.
+func UpdateBook(ctx context.Context, admin string, b Book) string {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	row := tx.QueryRowContext(ctx, "SELECT "+BookCols+" FROM BOOKS WITH (UPDLOCK) WHERE ID=?", b.Id)
+	oldBook, err := ScanBook(row)
+	if err == sql.ErrNoRows {
+		return "该书不存在."
+	}
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT SUBJECT FROM BOOK_SUBJECTS WHERE ID=? ORDER BY SEQ", b.Id)
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	var subject string
+	for rows.Next() {
+		rows.Scan(&subject)
+		oldBook.Subjects = append(oldBook.Subjects, subject)
+	}
+	rows.Close()
+	rows, err = tx.QueryContext(ctx, "SELECT \"NAME\",\"ROLE\" FROM BOOK_CONTRIBUTORS WHERE ID=? ORDER BY SEQ", b.Id)
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	var c Contributor
+	for rows.Next() {
+		rows.Scan(&c.Name, &c.Role)
+		oldBook.Contributors = append(oldBook.Contributors, c)
+	}
+	rows.Close()
+	if oldBook.Version != b.Version {
+		return "该书已被他人修改, 请刷新后重试."
+	}
+	changes := DiffBook(oldBook, b)
+	if len(changes) == 0 {
+		return ""
+	}
+	now := time.Now().UTC()
+	namePy, nameInitials := ToPinyin(b.Name)
+	authorPy, authorInitials := ToPinyin(b.Author)
+	_, err = tx.ExecContext(ctx, "UPDATE BOOKS SET \"NAME\"=?,AUTHOR=?,PRICE=?,PUBLISHER=?,PUB_YEAR=?,EDITION=?,LANG=?,PAGES=?,SUMMARY=?,CLC=?,DDC=?,CALL_NO=?,SHELF=?,SERIES_ID=?,VOLUME=?,ISBN=?,NAME_PY=?,NAME_INITIALS=?,AUTHOR_PY=?,AUTHOR_INITIALS=?,VER=VER+1,MODIFIED=? WHERE ID=? AND VER=?",
+		b.Name, b.Author, b.Price, b.Publisher, b.Year, b.Edition, b.Language, b.Pages, b.Summary, b.Clc, b.Ddc, b.CallNumber, b.Shelf,
+		NullString(b.Series), b.Volume, b.Isbn,
+		namePy, nameInitials, authorPy, authorInitials, now, b.Id, b.Version)
+	if err != nil {
+		return "无法完成修改, 请联系管理员."
+	}
+	err = SaveBookLists(ctx, tx, b)
+	if err != nil {
+		return "无法完成修改, 请联系管理员."
+	}
+	for _, change := range changes {
+		_, err = tx.ExecContext(ctx, "INSERT INTO BOOK_HISTORY (ID,VER,CHANGED,CHANGED_BY,FIELD,OLD_VAL,NEW_VAL) VALUES (?,?,?,?,?,?,?)",
+			b.Id, b.Version+1, now, admin, change.Field, change.Old, change.New)
+		if err != nil {
+			return "无法记录修改历史, 请联系管理员."
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+func ListBookHistory(bookId string) ([]BookChange, error) {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "SELECT ID,VER,CHANGED,CHANGED_BY,FIELD,OLD_VAL,NEW_VAL FROM BOOK_HISTORY WHERE ID=? ORDER BY VER DESC,FIELD")
+	rows, err := stmt.Query(bookId)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]BookChange, 0)
+	var tmp BookChange
+	for rows.Next() {
+		rows.Scan(&tmp.Id, &tmp.Version, &tmp.ChangedAt, &tmp.ChangedBy, &tmp.Field, &tmp.Old, &tmp.New)
+		res = append(res, tmp)
+	}
+	return res, nil
 }
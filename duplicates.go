@@ -0,0 +1,327 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 17:26:40
+ * @LastEditTime: 2026-10-20 03:06:00
+ * @LastEditors: FunctionSir
+ * @Description: ISBN, duplicate records detection and merging.
+ * @FilePath: /biblio-matrix/duplicates.go
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Normalize an ISBN-10 or ISBN-13 to ISBN-13 without hyphens, check digit
+// is verified. An empty string is returned as-is.
+func NormalizeIsbn(isbn string) (string, error) {
+	digits := make([]byte, 0, 13)
+	for _, r := range strings.ToUpper(isbn) {
+		if r >= '0' && r <= '9' || r == 'X' {
+			digits = append(digits, byte(r))
+		}
+	}
+	if len(digits) == 0 {
+		return "", nil
+	}
+	if len(digits) == 10 {
+		sum := 0
+		for i, d := range digits {
+			v := int(d - '0')
+			if d == 'X' {
+				if i != 9 {
+					return "", errors.New("illegal ISBN: " + isbn)
+				}
+				v = 10
+			}
+			sum += (10 - i) * v
+		}
+		if sum%11 != 0 {
+			return "", errors.New("illegal ISBN: " + isbn)
+		}
+		digits = append([]byte("978"), digits[:9]...)
+		digits = append(digits, isbn13CheckDigit(digits))
+		return string(digits), nil
+	}
+	if len(digits) != 13 || slices.Contains(digits, 'X') || isbn13CheckDigit(digits[:12]) != digits[12] {
+		return "", errors.New("illegal ISBN: " + isbn)
+	}
+	return string(digits), nil
+}
+
+func isbn13CheckDigit(first12 []byte) byte {
+	sum := 0
+	for i, d := range first12[:12] {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += weight * int(d-'0')
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// Normalize a title or an author for fuzzy matching, only letters and
+// digits are kept, and Chinese chars are turned into pinyin.
+func fuzzyKey(s string) string {
+	full, _ := ToPinyin(s)
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, full)
+}
+
+// Similarity of two strings by Levenshtein distance, 1 means the same.
+func Similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return 1 - float64(prev[len(rb)])/float64(max(len(ra), len(rb)))
+}
+
+// Thresholds of title and author similarity for fuzzy duplicates.
+const DupTitleThreshold = 0.85
+const DupAuthorThreshold = 0.75
+
+type DuplicatePair struct {
+	Reason     string  `json:"reason"`     // "isbn" or "fuzzy"
+	Similarity float64 `json:"similarity"` // Title similarity, 1 for ISBN match
+	A          Book    `json:"a"`
+	B          Book    `json:"b"`
+}
+
+// Find pairs of books which are likely to be the same title, by the same
+// ISBN, or by similar titles and authors. Withdrawn books are ignored.
+func FindDuplicates() ([]DuplicatePair, error) {
+	books, err := QueryBooks("STATUS='active' ORDER BY ID")
+	if err != nil {
+		return nil, err
+	}
+	res := make([]DuplicatePair, 0)
+	titles := make([]string, len(books))
+	authors := make([]string, len(books))
+	for i, b := range books {
+		titles[i] = fuzzyKey(b.Name)
+		authors[i] = fuzzyKey(b.Author)
+	}
+	for i := range books {
+		for j := i + 1; j < len(books); j++ {
+			if books[i].Isbn != "" && books[i].Isbn == books[j].Isbn {
+				res = append(res, DuplicatePair{Reason: "isbn", Similarity: 1, A: books[i], B: books[j]})
+				continue
+			}
+			// Titles with very different lengths can not be similar enough.
+			la, lb := len(titles[i]), len(titles[j])
+			if float64(min(la, lb)) < DupTitleThreshold*float64(max(la, lb)) {
+				continue
+			}
+			titleSim := Similarity(titles[i], titles[j])
+			if titleSim < DupTitleThreshold || Similarity(authors[i], authors[j]) < DupAuthorThreshold {
+				continue
+			}
+			res = append(res, DuplicatePair{Reason: "fuzzy", Similarity: titleSim, A: books[i], B: books[j]})
+		}
+	}
+	return res, nil
+}
+
+// Merge book drop into book keep atomically, counts are added up, loans in
+// RECORDS, loan history, reviews, tags, change history, order lines, serial
+// issue items and attachments are moved to keep, as is the cover if keep has
+// none, subjects and contributors are united, and then drop is removed. Keep
+// must not be withdrawn, and copies of a withdrawn drop are not added.
+func MergeBooks(ctx context.Context, admin string, keep string, drop string) string {
+	if keep == drop {
+		return "不能将图书与其自身合并."
+	}
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	row := tx.QueryRowContext(ctx, "SELECT VER,STATUS FROM BOOKS WITH (UPDLOCK) WHERE ID=?", keep)
+	var keepVer int
+	var keepStatus string
+	err = row.Scan(&keepVer, &keepStatus)
+	if err == sql.ErrNoRows {
+		return "保留的图书不存在."
+	}
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if keepStatus == "withdrawn" {
+		return "保留的图书已下架, 请先恢复(/restore/book)再合并."
+	}
+	row = tx.QueryRowContext(ctx, "SELECT CNT,ISBN,STATUS FROM BOOKS WITH (UPDLOCK) WHERE ID=?", drop)
+	var dropCnt int
+	var dropIsbn, dropStatus string
+	err = row.Scan(&dropCnt, &dropIsbn, &dropStatus)
+	if err == sql.ErrNoRows {
+		return "被合并的图书不存在."
+	}
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	// Copies of a withdrawn book are off the shelves, they are not added.
+	if dropStatus == "withdrawn" {
+		dropCnt = 0
+	}
+	row = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM RECORDS A, RECORDS B WHERE A.USERNAME=B.USERNAME AND A.ID=? AND B.ID=?", keep, drop)
+	var bothBorrowed int
+	err = row.Scan(&bothBorrowed)
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if bothBorrowed > 0 {
+		return "有" + strconv.Itoa(bothBorrowed) + "位读者同时借阅了这两条记录, 请先还书再合并."
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE RECORDS SET ID=? WHERE ID=?", keep, drop)
+	if err != nil {
+		return "无法转移借阅记录, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE LOAN_HISTORY SET ID=? WHERE ID=?", keep, drop)
+	if err != nil {
+		return "无法转移借阅历史, 请联系管理员."
+	}
+	// A reader may have reviewed or tagged both, keep the ones on keep.
+	_, err = tx.ExecContext(ctx, "DELETE FROM REVIEWS WHERE ID=? AND USERNAME IN (SELECT USERNAME FROM REVIEWS WHERE ID=?)", drop, keep)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "UPDATE REVIEWS SET ID=? WHERE ID=?", keep, drop)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM BOOK_TAGS WHERE ID=? AND EXISTS (SELECT * FROM BOOK_TAGS T WHERE T.ID=? AND T.USERNAME=BOOK_TAGS.USERNAME AND T.TAG=BOOK_TAGS.TAG)", drop, keep)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "UPDATE BOOK_TAGS SET ID=? WHERE ID=?", keep, drop)
+	}
+	if err != nil {
+		return "无法转移评分和标签, 请联系管理员."
+	}
+	now := time.Now().UTC()
+	_, err = tx.ExecContext(ctx, "UPDATE BOOKS SET CNT=CNT+?,ISBN=CASE WHEN ISBN='' THEN ? ELSE ISBN END,VER=VER+1,MODIFIED=? WHERE ID=?", dropCnt, dropIsbn, now, keep)
+	if err != nil {
+		return "无法完成合并, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO BOOK_SUBJECTS (ID,SEQ,SUBJECT) SELECT ?,(SELECT COALESCE(MAX(SEQ),-1) FROM BOOK_SUBJECTS WHERE ID=?)+ROW_NUMBER() OVER (ORDER BY SEQ),SUBJECT FROM BOOK_SUBJECTS WHERE ID=? AND SUBJECT NOT IN (SELECT SUBJECT FROM BOOK_SUBJECTS WHERE ID=?)",
+		keep, keep, drop, keep)
+	if err != nil {
+		return "无法合并主题词, 请联系管理员."
+	}
+	// Contributors of drop would go with it by the cascade, so they are
+	// united too.
+	_, err = tx.ExecContext(ctx, "INSERT INTO BOOK_CONTRIBUTORS (ID,SEQ,\"NAME\",\"ROLE\") SELECT ?,(SELECT COALESCE(MAX(SEQ),-1) FROM BOOK_CONTRIBUTORS WHERE ID=?)+ROW_NUMBER() OVER (ORDER BY SEQ),\"NAME\",\"ROLE\" FROM BOOK_CONTRIBUTORS C WHERE ID=? AND NOT EXISTS (SELECT * FROM BOOK_CONTRIBUTORS K WHERE K.ID=? AND K.\"NAME\"=C.\"NAME\" AND K.\"ROLE\"=C.\"ROLE\")",
+		keep, keep, drop, keep)
+	if err != nil {
+		return "无法合并责任者, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE BOOK_HISTORY SET ID=? WHERE ID=?", keep, drop)
+	if err != nil {
+		return "无法转移修改历史, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE ORDER_LINES SET BOOK_ID=? WHERE BOOK_ID=?", keep, drop)
+	if err != nil {
+		return "无法转移订单明细, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE SERIAL_ISSUES SET ITEM_ID=? WHERE ITEM_ID=?", keep, drop)
+	if err != nil {
+		return "无法转移期刊单册, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE ATTACHMENTS SET ID=? WHERE ID=?", keep, drop)
+	if err != nil {
+		return "无法转移附件, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE BOOKS SET COVER=(SELECT COVER FROM BOOKS WHERE ID=?) WHERE ID=? AND COVER IS NULL", drop, keep)
+	if err != nil {
+		return "无法转移封面, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO BOOK_HISTORY (ID,VER,CHANGED,CHANGED_BY,FIELD,OLD_VAL,NEW_VAL) VALUES (?,?,?,?,?,?,?)",
+		keep, keepVer+1, now, admin, "merged", drop, keep)
+	if err != nil {
+		return "无法记录修改历史, 请联系管理员."
+	}
+	// Keep a tombstone, so that harvesters learn the book is gone.
+	_, err = tx.ExecContext(ctx, "DELETE FROM DELETED_BOOKS WHERE ID=?", drop)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "INSERT INTO DELETED_BOOKS (ID,DELETED,CLC,SERIES_ID,MERGED_INTO) SELECT ID,?,CLC,SERIES_ID,? FROM BOOKS WHERE ID=?", now, keep, drop)
+	}
+	if err != nil {
+		return "无法记录被合并的图书, 请联系管理员."
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM BOOKS WHERE ID=?", drop)
+	if err != nil {
+		return "无法移除被合并的图书, 请联系管理员."
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+func listDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	pairs, err := FindDuplicates()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func mergeBooksHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	keep := r.PostFormValue("keep")
+	drop := r.PostFormValue("drop")
+	if keep == "" || drop == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result := MergeBooks(ctx, GetTokenUsername(tokenCookie.Value), keep, drop)
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
@@ -2,7 +2,7 @@
  * @Author: FunctionSir
  * @License: AGPLv3
  * @Date: 2025-06-20 08:41:27
- * @LastEditTime: 2025-06-23 10:13:17
+ * @LastEditTime: 2026-10-20 03:15:00
  * @LastEditors: FunctionSir
  * @Description: -
  * @FilePath: /biblio-matrix/http.go
@@ -11,11 +11,15 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"math"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -28,29 +32,46 @@ func authHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.PostFormValue("username")
 	passwd := r.PostFormValue("passwd")
 	role := r.PostFormValue("role")
+	remember := r.PostFormValue("remember") == "true"
 	if role == "" || (role != "admin" && role != "reader") {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	var token string
-	var exp time.Time
-	if role == "admin" {
+	isAdmin := role == "admin"
+	if isAdmin {
 		if username == "" || passwd == "" || !AuthAdmin(username, passwd) {
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
-		token, exp = NewToken(username, true)
 	} else {
 		if username == "" || passwd == "" || !AuthReader(username, passwd) {
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
-		token, exp = NewToken(username, false)
 	}
-	http.SetCookie(w, &http.Cookie{Name: "token", Value: token, SameSite: http.SameSiteDefaultMode, Expires: exp})
+	if Signer != nil {
+		tokens, err := Signer.NewTokens(username, isAdmin, remember, time.Now())
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		setTokenCookie(w, tokens.Access, tokens.AccessExpires)
+		setRefreshCookies(w, tokens.Refresh, tokens.RefreshExpires, remember)
+	} else {
+		ip, agent := clientInfo(r)
+		token, exp, err := NewToken(username, isAdmin, remember, ip, agent)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !remember {
+			exp = time.Time{} // Only remembered sessions outlive the browser.
+		}
+		setTokenCookie(w, token, exp)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]any{"status": "success", "admin": ChkTokensIsAdmin(token)})
+	json.NewEncoder(w).Encode(map[string]any{"status": "success", "admin": isAdmin})
 }
 
 func deauthHandler(w http.ResponseWriter, r *http.Request) {
@@ -60,6 +81,11 @@ func deauthHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	DelToken(tokenCookie.Value)
+	if refreshCookie, err := r.Cookie("refresh"); Signer != nil && err == nil {
+		if claims, err := Signer.Verify(refreshCookie.Value, "refresh"); err == nil {
+			RevokeToken(claims.ID, claims.ExpiresAt.Time)
+		}
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(http.StatusText(http.StatusOK)))
 }
@@ -126,11 +152,14 @@ func returnHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func listBooksHandler(w http.ResponseWriter, r *http.Request) {
-	books := ListBooks()
-	if books == nil {
+	books, err := ListBooks(r.FormValue("q"))
+	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	if r.FormValue("sort") == "callno" {
+		SortByCallNumber(books)
+	}
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(books)
@@ -150,6 +179,20 @@ func listRecordsHandler(w http.ResponseWriter, r *http.Request) {
 	if username == "" {
 		username = "*"
 	}
+	format, ok := CitationFormat(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if format != "" {
+		books, err := ListBorrowedBooks(username)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		WriteCitations(w, format, books)
+		return
+	}
 	records := ListRecords(username)
 	if records == nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -160,6 +203,107 @@ func listRecordsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(records)
 }
 
+// Get a value from the form, ok is false if the field is absent.
+func postFormLookup(r *http.Request, key string) (string, bool) {
+	value := r.PostFormValue(key) // Make sure that the form is parsed.
+	_, ok := r.PostForm[key]
+	return value, ok
+}
+
+// Parse optional bibliographic metadata of a book from the form, fields
+// absent from the form are left untouched.
+// Subjects are given by repeated "subject" fields, contributors by repeated
+// "contributor" fields with "role" fields at the same positions.
+func parseBookMeta(r *http.Request, b *Book) error {
+	var err error
+	if publisher, ok := postFormLookup(r, "publisher"); ok {
+		b.Publisher = publisher
+	}
+	if edition, ok := postFormLookup(r, "edition"); ok {
+		b.Edition = edition
+	}
+	if language, ok := postFormLookup(r, "language"); ok {
+		b.Language = language
+	}
+	if summary, ok := postFormLookup(r, "summary"); ok {
+		b.Summary = summary
+	}
+	if clc, ok := postFormLookup(r, "clc"); ok {
+		b.Clc = strings.ToUpper(strings.TrimSpace(clc))
+	}
+	if ddc, ok := postFormLookup(r, "ddc"); ok {
+		b.Ddc = strings.TrimSpace(ddc)
+	}
+	if callNumber, ok := postFormLookup(r, "callno"); ok {
+		b.CallNumber = strings.TrimSpace(callNumber)
+	}
+	if shelf, ok := postFormLookup(r, "shelf"); ok {
+		b.Shelf = shelf
+	}
+	if isbn, ok := postFormLookup(r, "isbn"); ok {
+		b.Isbn, err = NormalizeIsbn(isbn)
+		if err != nil {
+			return err
+		}
+	}
+	if series, ok := postFormLookup(r, "series"); ok {
+		b.Series = series
+	}
+	if volume, ok := postFormLookup(r, "volume"); ok && volume != "" {
+		b.Volume, err = strconv.Atoi(volume)
+		if err != nil || b.Volume < 0 {
+			return errors.New("illegal volume number")
+		}
+	}
+	if b.CallNumber == "" {
+		b.CallNumber = GenCallNumber(*b)
+	}
+	if year, ok := postFormLookup(r, "year"); ok && year != "" {
+		b.Year, err = strconv.Atoi(year)
+		if err != nil || b.Year < 0 {
+			return errors.New("illegal publication year")
+		}
+	}
+	if pages, ok := postFormLookup(r, "pages"); ok && pages != "" {
+		b.Pages, err = strconv.Atoi(pages)
+		if err != nil || b.Pages < 0 {
+			return errors.New("illegal page count")
+		}
+	}
+	if b.Subjects == nil {
+		b.Subjects = make([]string, 0)
+	}
+	if _, ok := postFormLookup(r, "subject"); ok {
+		b.Subjects = make([]string, 0)
+		for _, subject := range r.PostForm["subject"] {
+			if subject != "" {
+				b.Subjects = append(b.Subjects, subject)
+			}
+		}
+	}
+	if b.Contributors == nil {
+		b.Contributors = make([]Contributor, 0)
+	}
+	if _, ok := postFormLookup(r, "contributor"); ok {
+		b.Contributors = make([]Contributor, 0)
+		roles := r.PostForm["role"]
+		for i, name := range r.PostForm["contributor"] {
+			if name == "" {
+				continue
+			}
+			role := "author"
+			if i < len(roles) && roles[i] != "" {
+				role = roles[i]
+			}
+			if !slices.Contains(ContributorRoles, role) {
+				return errors.New("illegal contributor role: " + role)
+			}
+			b.Contributors = append(b.Contributors, Contributor{Name: name, Role: role})
+		}
+	}
+	return nil
+}
+
 func addHandler(w http.ResponseWriter, r *http.Request) {
 	tokenCookie, err := r.Cookie("token")
 	if err != nil || tokenCookie.Valid() != nil {
@@ -209,7 +353,13 @@ func addHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	err = AddBook(Book{Id: book, Name: name, Author: author, Price: priceInt, Count: countInt})
+	newBook := Book{Id: book, Name: name, Author: author, Price: priceInt, Count: countInt}
+	err = parseBookMeta(r, &newBook)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = AddBook(newBook)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
@@ -218,6 +368,84 @@ func addHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(http.StatusText(http.StatusOK)))
 }
 
+// Update fields of an existing book, fields absent from the form are kept.
+// The form must carry the version of the book which the admin was editing.
+func updateBookHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	bookId := r.PostFormValue("book")
+	version, err := strconv.Atoi(r.PostFormValue("version"))
+	if bookId == "" || err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	book, err := GetBookInfo(bookId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "该书不存在.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "无法完成查询. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	book.Version = version
+	if name, ok := postFormLookup(r, "name"); ok {
+		book.Name = name
+	}
+	if author, ok := postFormLookup(r, "author"); ok {
+		book.Author = author
+	}
+	if priceStr, ok := postFormLookup(r, "price"); ok {
+		priceFloat64, err := strconv.ParseFloat(priceStr, 64)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		book.Price = int(math.Round(priceFloat64 * 100))
+	}
+	err = parseBookMeta(r, &book)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if book.Name == "" || book.Author == "" || book.Price < 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := UpdateBook(ctx, GetTokenUsername(tokenCookie.Value), book)
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func bookHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	bookId := r.PostFormValue("book")
+	if bookId == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	history, err := ListBookHistory(bookId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(history)
+}
+
 func newReaderHandler(w http.ResponseWriter, r *http.Request) {
 	tokenCookie, err := r.Cookie("token")
 	if err != nil || tokenCookie.Valid() != nil {
@@ -262,6 +490,79 @@ func newAdminHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(http.StatusText(http.StatusOK)))
 }
 
+// Change the password of the current user, "passwd" is the current one and
+// "new_passwd" the new one. Other sessions of the user are ended.
+func changePasswdHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	session, ok := Sessions.Get(tokenCookie.Value)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	passwd := r.PostFormValue("passwd")
+	newPasswd := r.PostFormValue("new_passwd")
+	if passwd == "" || newPasswd == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if (session.IsAdmin && !AuthAdmin(session.Username, passwd)) || (!session.IsAdmin && !AuthReader(session.Username, passwd)) {
+		http.Error(w, "当前密码错误.", http.StatusForbidden)
+		return
+	}
+	err = SetPasswd(session.Username, newPasswd, session.IsAdmin)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if Signer == nil {
+		DelOtherTokens(tokenCookie.Value)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(http.StatusText(http.StatusOK)))
+		return
+	}
+	// Signed tokens can not be told apart, so all of the user in this role
+	// are revoked, and this client gets new ones. Revoking up to the tick
+	// before this one leaves the new ones, issued from this tick on, valid.
+	// Those of an admin or reader of the same name are kept.
+	before := time.Now().Truncate(TokenTimePrecision).Add(-TokenTimePrecision)
+	if err = RevokeTokensBefore(TokenUser{session.Username, RoleName(session.IsAdmin)}, before); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	tokens, err := Signer.NewTokens(session.Username, session.IsAdmin, session.Remember, session.Created)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	setTokenCookie(w, tokens.Access, tokens.AccessExpires)
+	setRefreshCookies(w, tokens.Refresh, tokens.RefreshExpires, session.Remember)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+// Reset the password of the reader "username" to "passwd", all sessions of
+// the reader are ended, but not those of an admin of the same name.
+func resetPasswdHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.PostFormValue("username")
+	passwd := r.PostFormValue("passwd")
+	if username == "" || passwd == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	err := SetPasswd(username, passwd, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	Sessions.DeleteUser(username, false)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
 func delUserHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.PostFormValue("username")
 	if username == "" {
@@ -273,23 +574,73 @@ func delUserHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
+	Sessions.DeleteUser(username, false)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(http.StatusText(http.StatusOK)))
 }
 
+// Withdraw a book, the book is kept with its history, see restoreBookHandler.
 func delBookHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	book := r.PostFormValue("book")
+	if book == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := WithdrawBook(ctx, GetTokenUsername(tokenCookie.Value), book, r.PostFormValue("reason"))
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func restoreBookHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 	book := r.PostFormValue("book")
 	if book == "" {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	err := DelBook(book)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := RestoreBook(ctx, GetTokenUsername(tokenCookie.Value), book)
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func listWithdrawnBooksHandler(w http.ResponseWriter, r *http.Request) {
+	books, err := ListWithdrawnBooks()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
+	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(http.StatusText(http.StatusOK)))
+	json.NewEncoder(w).Encode(books)
 }
 
 func listOverdueReadersHandler(w http.ResponseWriter, r *http.Request) {
@@ -350,18 +701,146 @@ func bookInfoHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
+	format, ok := CitationFormat(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
 	book, err := GetBookInfo(bookId)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
+	if format != "" {
+		WriteCitations(w, format, []Book{book})
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(book)
+}
+
+// Serve /books/{id}, the same as /bookinfo.
+func bookHandler(w http.ResponseWriter, r *http.Request) {
+	book, err := GetBookInfo(r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to get book: " + err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(book)
 }
 
+// End all sessions of everyone, including the current one.
 func clearTokens(w http.ResponseWriter, r *http.Request) {
+	ClearTokens()
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+// List sessions of "username", readers can only list their own, and admins
+// list all sessions if username is empty. Signed tokens are not stored, so
+// they can not be listed.
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if Signer != nil {
+		http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+		return
+	}
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	username := r.PostFormValue("username")
+	isAdmin := ChkTokensIsAdmin(tokenCookie.Value)
+	if !isAdmin {
+		if username == "" {
+			username = GetTokenUsername(tokenCookie.Value)
+		}
+		if GetTokenUsername(tokenCookie.Value) != username {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	sessions := Sessions.List(username)
+	if sessions == nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		if isAdmin || !s.IsAdmin { // An admin may have the name of a reader.
+			infos = append(infos, s.Info(HashToken(tokenCookie.Value)))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(infos)
+}
+
+// Revoke the session "id", readers can only revoke their own. Not for signed
+// tokens, which can not be found by IDs.
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if Signer != nil {
+		http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+		return
+	}
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	id := r.PostFormValue("id")
+	if id == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	username := ""
+	isAdmin := ChkTokensIsAdmin(tokenCookie.Value)
+	if !isAdmin {
+		username = GetTokenUsername(tokenCookie.Value)
+	}
+	for _, s := range Sessions.List(username) {
+		if SessionId(s.TokenHash) == id && (isAdmin || !s.IsAdmin) {
+			Sessions.DeleteHash(s.TokenHash)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(http.StatusText(http.StatusOK)))
+			return
+		}
+	}
+	http.Error(w, "该会话不存在.", http.StatusNotFound)
+}
 
+// Revoke all sessions of "username" of "role" ("reader" by default), readers
+// can only revoke their own.
+func revokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	username := r.PostFormValue("username")
+	role := r.PostFormValue("role")
+	if role == "" {
+		role = "reader"
+	}
+	if username == "" || (role != "admin" && role != "reader") {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if !ChkTokensIsAdmin(tokenCookie.Value) && (GetTokenUsername(tokenCookie.Value) != username || role != "reader") {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	Sessions.DeleteUser(username, role == "admin")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
 }
 
 func serveHttp(addr string) {
@@ -376,14 +855,87 @@ func serveHttp(addr string) {
 	http.HandleFunc("/borrow", Chain(borrowHandler, ReaderLvlAuth, Logging))
 	http.HandleFunc("/return", Chain(returnHandler, ReaderLvlAuth, Logging))
 	http.HandleFunc("/list/books", Chain(listBooksHandler, Logging))
+	http.HandleFunc("/browse/class", Chain(browseClassHandler, Logging))
+	http.HandleFunc("/list/series", Chain(listSeriesHandler, Logging))
+	http.HandleFunc("/seriesinfo", Chain(seriesInfoHandler, Logging))
+	http.HandleFunc("/new/series", Chain(newSeriesHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/borrow/series", Chain(borrowSeriesHandler, ReaderLvlAuth, Logging))
+	http.HandleFunc("/hold/series", Chain(holdSeriesHandler, ReaderLvlAuth, Logging))
+	http.HandleFunc("/list/series/holds", Chain(listSetHoldsHandler, ReaderLvlAuth, Logging))
+	http.HandleFunc("/cancel/series/hold", Chain(cancelSetHoldHandler, ReaderLvlAuth, Logging))
+	http.HandleFunc("/review", Chain(reviewHandler, ReaderLvlAuth, Logging))
+	http.HandleFunc("/tag", Chain(tagHandler, ReaderLvlAuth, Logging))
+	http.HandleFunc("/list/reviews", Chain(listReviewsHandler, Logging))
+	http.HandleFunc("/list/reviews/pending", Chain(listPendingReviewsHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/moderate/review", Chain(moderateReviewHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/del/review", Chain(delReviewHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/del/tag", Chain(delTagHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/books/{id}", Chain(bookHandler, Logging))
+	http.HandleFunc("/books/{id}/related", Chain(relatedBooksHandler, Logging))
+	http.HandleFunc("/recommend", Chain(recommendHandler, ReaderLvlAuth, Logging))
+	http.HandleFunc("/recommend/optout", Chain(recommendOptOutHandler, ReaderLvlAuth, Logging))
+	http.HandleFunc("/new/vendor", Chain(newVendorHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/list/vendors", Chain(listVendorsHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/new/fund", Chain(newFundHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/list/funds", Chain(listFundsHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/new/order", Chain(newOrderHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/list/orders", Chain(listOrdersHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/orderinfo", Chain(orderInfoHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/receive", Chain(receiveHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/finish/order", Chain(finishOrderHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/new/subscription", Chain(newSubscriptionHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/list/subscriptions", Chain(listSubscriptionsHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/cancel/subscription", Chain(cancelSubscriptionHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/list/issues", Chain(listIssuesHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/checkin", Chain(checkInHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/claims", Chain(claimsHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/new/inventory", Chain(newInventoryHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/list/inventories", Chain(listInventoriesHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/inventory/scan", Chain(inventoryScanHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/inventory/report", Chain(inventoryReportHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/finish/inventory", Chain(finishInventoryHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/attach", Chain(attachHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/list/attachments", Chain(listAttachmentsHandler, Logging))
+	http.HandleFunc("/del/attachment", Chain(delAttachmentHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/attachment/link", Chain(attachmentLinkHandler, ReaderLvlAuth, Logging))
+	http.HandleFunc("/attachments/download", Chain(downloadAttachmentHandler, Logging))
+	http.HandleFunc("/upload/cover", Chain(uploadCoverHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/del/cover", Chain(delCoverHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/covers/{id}", Chain(coverHandler, Logging))
+	http.HandleFunc("/labels", Chain(labelsHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/refresh", Chain(refreshHandler, Logging))
+	http.HandleFunc("/list/sessions", Chain(listSessionsHandler, ReaderLvlAuth, Logging))
+	http.HandleFunc("/revoke/session", Chain(revokeSessionHandler, ReaderLvlAuth, Logging))
+	http.HandleFunc("/revoke/sessions", Chain(revokeSessionsHandler, ReaderLvlAuth, Logging))
+	http.HandleFunc("/change/passwd", Chain(changePasswdHandler, ReaderLvlAuth, Logging))
+	http.HandleFunc("/reset/passwd", Chain(resetPasswdHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/sru", Chain(sruHandler, Logging))
+	http.HandleFunc("/oai", Chain(oaiHandler, Logging))
+	for _, prefix := range []string{Opds1Prefix, Opds2Prefix} {
+		http.HandleFunc(prefix, Chain(opdsRootHandler, Logging))
+		http.HandleFunc(prefix+"/all", Chain(opdsAllHandler, Logging))
+		http.HandleFunc(prefix+"/new", Chain(opdsNewHandler, Logging))
+		http.HandleFunc(prefix+"/authors", Chain(opdsAuthorsHandler, Logging))
+		http.HandleFunc(prefix+"/author", Chain(opdsAuthorHandler, Logging))
+		http.HandleFunc(prefix+"/search", Chain(opdsSearchHandler, Logging))
+	}
+	http.HandleFunc(Opds1Prefix+"/opensearch.xml", Chain(opdsOpenSearchHandler, Logging))
 	http.HandleFunc("/list/records", Chain(listRecordsHandler, ReaderLvlAuth, Logging))
 	http.HandleFunc("/list/overdue", Chain(listOverdueReadersHandler, AdminLvlAuth, Logging))
 	http.HandleFunc("/add", Chain(addHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/update/book", Chain(updateBookHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/list/history", Chain(bookHistoryHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/import/books", Chain(importBooksHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/export/books", Chain(exportBooksHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/list/duplicates", Chain(listDuplicatesHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/merge/books", Chain(mergeBooksHandler, AdminLvlAuth, Logging))
 	http.HandleFunc("/new/reader", Chain(newReaderHandler, AdminLvlAuth, Logging))
 	http.HandleFunc("/new/admin", Chain(newAdminHandler, AdminLvlAuth, Logging))
 	http.HandleFunc("/clear/tokens", Chain(clearTokens, AdminLvlAuth, Logging))
 	http.HandleFunc("/del/user", Chain(delUserHandler, AdminLvlAuth, Logging))
 	http.HandleFunc("/del/book", Chain(delBookHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/restore/book", Chain(restoreBookHandler, AdminLvlAuth, Logging))
+	http.HandleFunc("/list/withdrawn", Chain(listWithdrawnBooksHandler, AdminLvlAuth, Logging))
 	http.HandleFunc("/readerinfo", Chain(readerInfoHandler, ReaderLvlAuth, Logging))
 	http.HandleFunc("/admininfo", Chain(adminInfoHandler, AdminLvlAuth, Logging))
 	http.HandleFunc("/bookinfo", Chain(bookInfoHandler, Logging))
@@ -0,0 +1,449 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 23:47:20
+ * @LastEditTime: 2026-10-19 23:47:20
+ * @LastEditors: FunctionSir
+ * @Description: Inventory (stocktake) sessions, scans and reports.
+ * @FilePath: /biblio-matrix/inventory.go
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type InventorySession struct {
+	Id        int        `json:"id"`
+	Name      string     `json:"name"`
+	Created   time.Time  `json:"created"`
+	CreatedBy string     `json:"created_by"`
+	Status    string     `json:"status"` // "open", "applied" or "closed"
+	Finished  *time.Time `json:"finished,omitempty"`
+}
+
+type InventoryItem struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`    // Empty if the ID is unknown
+	Shelf    string `json:"shelf"`   // Recorded shelf location
+	Section  string `json:"section"` // Where it was scanned, empty for missing books
+	Expected int    `json:"expected"`
+	OnLoan   int    `json:"on_loan"`
+	Scanned  int    `json:"scanned"`
+	Reason   string `json:"reason,omitempty"` // Of unexpected items: "unknown", "withdrawn", "on_loan" or "surplus"
+}
+
+type InventoryReport struct {
+	Session    InventorySession `json:"session"`
+	Sections   []string         `json:"sections"`
+	Scanned    int              `json:"scanned"`    // Copies scanned in total
+	Missing    []InventoryItem  `json:"missing"`    // Fewer copies found than expected on shelves of scanned sections
+	Unexpected []InventoryItem  `json:"unexpected"` // Copies found which should not be on shelves
+	Misplaced  []InventoryItem  `json:"misplaced"`  // Copies found in another section than their shelf
+}
+
+func NewInventory(admin string, name string) (int, error) {
+	db := DbOpen(DbConn)
+	row := db.QueryRow("INSERT INTO INVENTORY_SESSIONS (\"NAME\",CREATED,CREATED_BY,STATUS) OUTPUT INSERTED.IID VALUES (?,?,?,?)",
+		name, time.Now().UTC(), admin, "open")
+	var iid int
+	err := row.Scan(&iid)
+	return iid, err
+}
+
+func ListInventories() ([]InventorySession, error) {
+	db := DbOpen(DbConn)
+	rows, err := db.Query("SELECT IID,\"NAME\",CREATED,CREATED_BY,STATUS,FINISHED FROM INVENTORY_SESSIONS ORDER BY IID DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]InventorySession, 0)
+	for rows.Next() {
+		var tmp InventorySession
+		var finished sql.NullTime
+		rows.Scan(&tmp.Id, &tmp.Name, &tmp.Created, &tmp.CreatedBy, &tmp.Status, &finished)
+		if finished.Valid {
+			tmp.Finished = &finished.Time
+		}
+		res = append(res, tmp)
+	}
+	return res, nil
+}
+
+// Lock an open inventory session, returns an error message if it is not open.
+func lockOpenInventory(ctx context.Context, tx *sql.Tx, iid int) string {
+	row := tx.QueryRowContext(ctx, "SELECT STATUS FROM INVENTORY_SESSIONS WITH (UPDLOCK) WHERE IID=?", iid)
+	var status string
+	err := row.Scan(&status)
+	if err == sql.ErrNoRows {
+		return "该盘点不存在."
+	}
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if status != "open" {
+		return "该盘点已经结束."
+	}
+	return ""
+}
+
+// Record scanned IDs of a section, an ID scanned n times is n copies. If
+// replace is true, earlier scans of the section are discarded.
+func ScanInventory(ctx context.Context, iid int, section string, ids []string, replace bool) string {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	if result := lockOpenInventory(ctx, tx, iid); result != "" {
+		return result
+	}
+	if replace {
+		_, err = tx.ExecContext(ctx, "DELETE FROM INVENTORY_SCANS WHERE IID=? AND SECTION=?", iid, section)
+		if err != nil {
+			return "无法清除原有扫描记录, 请联系管理员."
+		}
+	}
+	counts := make(map[string]int)
+	for _, id := range ids {
+		counts[id]++
+	}
+	for id, n := range counts {
+		res, err := tx.ExecContext(ctx, "UPDATE INVENTORY_SCANS SET CNT=CNT+? WHERE IID=? AND SECTION=? AND ID=?", n, iid, section, id)
+		if err != nil {
+			return "无法记录扫描结果, 请联系管理员."
+		}
+		if affected, _ := res.RowsAffected(); affected > 0 {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO INVENTORY_SCANS (IID,SECTION,ID,CNT) VALUES (?,?,?,?)", iid, section, id, n)
+		if err != nil {
+			return "无法记录扫描结果, 请联系管理员."
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+type inventoryBook struct {
+	name   string
+	count  int
+	shelf  string
+	status string
+	onLoan int
+}
+
+// Compare scans of a session against the books. Copies on loan in RECORDS
+// are not in CNT, so CNT is what should be found on the shelf.
+func buildInventoryReport(ctx context.Context, tx *sql.Tx, iid int) (InventoryReport, error) {
+	var report InventoryReport
+	var finished sql.NullTime
+	row := tx.QueryRowContext(ctx, "SELECT IID,\"NAME\",CREATED,CREATED_BY,STATUS,FINISHED FROM INVENTORY_SESSIONS WHERE IID=?", iid)
+	err := row.Scan(&report.Session.Id, &report.Session.Name, &report.Session.Created, &report.Session.CreatedBy, &report.Session.Status, &finished)
+	if err != nil {
+		return report, err
+	}
+	if finished.Valid {
+		report.Session.Finished = &finished.Time
+	}
+	report.Sections = make([]string, 0)
+	report.Missing = make([]InventoryItem, 0)
+	report.Unexpected = make([]InventoryItem, 0)
+	report.Misplaced = make([]InventoryItem, 0)
+	type scan struct {
+		section string
+		id      string
+		count   int
+	}
+	scans := make([]scan, 0)
+	scanned := make(map[string]int)
+	rows, err := tx.QueryContext(ctx, "SELECT SECTION,ID,CNT FROM INVENTORY_SCANS WHERE IID=? ORDER BY SECTION,ID", iid)
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var tmp scan
+		rows.Scan(&tmp.section, &tmp.id, &tmp.count)
+		scans = append(scans, tmp)
+		scanned[tmp.id] += tmp.count
+		report.Scanned += tmp.count
+		if len(report.Sections) == 0 || report.Sections[len(report.Sections)-1] != tmp.section {
+			report.Sections = append(report.Sections, tmp.section)
+		}
+	}
+	rows.Close()
+	books := make(map[string]inventoryBook)
+	ids := make([]string, 0)
+	rows, err = tx.QueryContext(ctx, "SELECT B.ID,B.\"NAME\",B.CNT,B.SHELF,B.STATUS,(SELECT COUNT(*) FROM RECORDS R WHERE R.ID=B.ID) FROM BOOKS B ORDER BY B.SHELF,B.CALL_NO,B.ID")
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var id string
+		var tmp inventoryBook
+		rows.Scan(&id, &tmp.name, &tmp.count, &tmp.shelf, &tmp.status, &tmp.onLoan)
+		books[id] = tmp
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		b := books[id]
+		if b.status == "active" && slices.Contains(report.Sections, b.shelf) && scanned[id] < b.count {
+			report.Missing = append(report.Missing, InventoryItem{Id: id, Name: b.name, Shelf: b.shelf,
+				Expected: b.count, OnLoan: b.onLoan, Scanned: scanned[id]})
+		}
+	}
+	surplus := make(map[string]bool)
+	for _, s := range scans {
+		b, ok := books[s.id]
+		item := InventoryItem{Id: s.id, Name: b.name, Shelf: b.shelf, Section: s.section, Expected: b.count, OnLoan: b.onLoan, Scanned: s.count}
+		switch {
+		case !ok:
+			item.Reason = "unknown"
+			report.Unexpected = append(report.Unexpected, item)
+			continue
+		case b.status != "active":
+			item.Reason = "withdrawn"
+			report.Unexpected = append(report.Unexpected, item)
+			continue
+		}
+		if b.shelf != s.section {
+			report.Misplaced = append(report.Misplaced, item)
+		}
+		if scanned[s.id] > b.count && !surplus[s.id] {
+			surplus[s.id] = true
+			item.Section = ""
+			item.Scanned = scanned[s.id]
+			// Copies still on loan may have been returned without being checked in.
+			if scanned[s.id] <= b.count+b.onLoan {
+				item.Reason = "on_loan"
+			} else {
+				item.Reason = "surplus"
+			}
+			report.Unexpected = append(report.Unexpected, item)
+		}
+	}
+	return report, nil
+}
+
+func GetInventoryReport(ctx context.Context, iid int) (InventoryReport, error) {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return InventoryReport{}, err
+	}
+	defer tx.Rollback() // Nothing to commit.
+	return buildInventoryReport(ctx, tx, iid)
+}
+
+// Correct a field of a book found by inventory and record it in the change
+// history. Books changed meanwhile, like by a loan, are left as they are.
+func correctBook(ctx context.Context, tx *sql.Tx, admin string, id string, field string, oldVal any, newVal any, now time.Time) error {
+	col := "CNT"
+	if field == "shelf" {
+		col = "SHELF"
+	}
+	row := tx.QueryRowContext(ctx, "UPDATE BOOKS SET "+col+"=?,VER=VER+1,MODIFIED=? OUTPUT INSERTED.VER WHERE ID=? AND "+col+"=?", newVal, now, id, oldVal)
+	var ver int
+	err := row.Scan(&ver)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO BOOK_HISTORY (ID,VER,CHANGED,CHANGED_BY,FIELD,OLD_VAL,NEW_VAL) VALUES (?,?,?,?,?,?,?)",
+		id, ver, now, admin, field, fmt.Sprint(oldVal), fmt.Sprint(newVal))
+	return err
+}
+
+// Finish an inventory session. If apply is true, counts of missing and
+// surplus books are set to what was found (copies possibly on loan are left
+// to returning), and books found only in one other section are moved there.
+// Corrections are recorded in the change history of books.
+func FinishInventory(ctx context.Context, admin string, iid int, apply bool) string {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	if result := lockOpenInventory(ctx, tx, iid); result != "" {
+		return result
+	}
+	status := "closed"
+	now := time.Now().UTC()
+	if apply {
+		status = "applied"
+		report, err := buildInventoryReport(ctx, tx, iid)
+		if err != nil {
+			return "无法生成盘点报告, 请联系管理员."
+		}
+		for _, item := range report.Missing {
+			err = correctBook(ctx, tx, admin, item.Id, "count", item.Expected, item.Scanned, now)
+			if err != nil {
+				return "无法修正图书数量, 请联系管理员."
+			}
+		}
+		for _, item := range report.Unexpected {
+			if item.Reason != "surplus" {
+				continue
+			}
+			err = correctBook(ctx, tx, admin, item.Id, "count", item.Expected, item.Scanned, now)
+			if err != nil {
+				return "无法修正图书数量, 请联系管理员."
+			}
+		}
+		// Sections each book was found in, including its own shelf.
+		sections := make(map[string]int)
+		rows, err := tx.QueryContext(ctx, "SELECT ID,COUNT(*) FROM INVENTORY_SCANS WHERE IID=? GROUP BY ID", iid)
+		if err != nil {
+			return "无法完成查询. 请联系管理员."
+		}
+		for rows.Next() {
+			var id string
+			var n int
+			rows.Scan(&id, &n)
+			sections[id] = n
+		}
+		rows.Close()
+		for _, item := range report.Misplaced {
+			if sections[item.Id] != 1 {
+				continue // Found in several sections, which is right is unknown.
+			}
+			err = correctBook(ctx, tx, admin, item.Id, "shelf", item.Shelf, item.Section, now)
+			if err != nil {
+				return "无法修正图书位置, 请联系管理员."
+			}
+		}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE INVENTORY_SESSIONS SET STATUS=?,FINISHED=? WHERE IID=?", status, now, iid)
+	if err != nil {
+		return "无法结束盘点, 请联系管理员."
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+func newInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	name := r.PostFormValue("name")
+	if name == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	iid, err := NewInventory(GetTokenUsername(tokenCookie.Value), name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(strconv.Itoa(iid)))
+}
+
+func listInventoriesHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, err := ListInventories()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// Upload scanned IDs of a "section" (a shelf location) to inventory "session",
+// as "ids" separated by whitespace (one per scan, like from a barcode
+// scanner), or repeated "id" values. Set "replace" to "true" to scan a
+// section again from scratch.
+func inventoryScanHandler(w http.ResponseWriter, r *http.Request) {
+	iid, err := strconv.Atoi(r.PostFormValue("session"))
+	section := r.PostFormValue("section")
+	ids := append(strings.Fields(r.PostFormValue("ids")), r.PostForm["id"]...)
+	ids = slices.DeleteFunc(ids, func(id string) bool { return id == "" })
+	if err != nil || section == "" || len(ids) == 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result := ScanInventory(ctx, iid, section, ids, r.PostFormValue("replace") == "true")
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func inventoryReportHandler(w http.ResponseWriter, r *http.Request) {
+	iid, err := strconv.Atoi(r.PostFormValue("session"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	report, err := GetInventoryReport(ctx, iid)
+	if err == sql.ErrNoRows {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// Finish inventory "session", set "apply" to "true" to apply corrections.
+func finishInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	iid, err := strconv.Atoi(r.PostFormValue("session"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	result := FinishInventory(ctx, GetTokenUsername(tokenCookie.Value), iid, r.PostFormValue("apply") == "true")
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
@@ -0,0 +1,409 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 23:58:10
+ * @LastEditTime: 2026-10-20 03:11:00
+ * @LastEditors: FunctionSir
+ * @Description: Spine labels and barcode sheets in PDF and SVG.
+ * @FilePath: /biblio-matrix/labels.go
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/qr"
+	"github.com/go-pdf/fpdf"
+)
+
+// A label sheet, all lengths are in mm.
+type LabelLayout struct {
+	PageWidth   float64
+	PageHeight  float64
+	Columns     int
+	Rows        int
+	MarginLeft  float64 // Left edge of the page to the first column
+	MarginTop   float64 // Top edge of the page to the first row
+	LabelWidth  float64
+	LabelHeight float64
+	GapX        float64 // Between columns
+	GapY        float64 // Between rows
+}
+
+var LabelLayouts = map[string]LabelLayout{
+	"a4-3x8":      {210, 297, 3, 8, 0, 0.5, 70, 37, 0, 0},               // 24 per sheet, like Avery 3474
+	"a4-5x13":     {210, 297, 5, 13, 4.65, 10.7, 38.1, 21.2, 2.5, 0},    // 65 per sheet, like Avery L7651
+	"a4-spine":    {210, 297, 6, 10, 9, 13.5, 30, 25, 2, 2},             // 60 small spine labels per sheet
+	"letter-3x10": {215.9, 279.4, 3, 10, 4.8, 12.7, 66.7, 25.4, 3.2, 0}, // 30 per sheet, like Avery 5160
+}
+
+var LabelKinds = []string{"code128", "qr", "spine"}
+
+// TTF font for label text in PDF, needed for Chinese titles.
+var LabelFont string
+
+func (l LabelLayout) Valid() bool {
+	if l.Columns <= 0 || l.Rows <= 0 || l.LabelWidth <= 0 || l.LabelHeight <= 0 ||
+		l.MarginLeft < 0 || l.MarginTop < 0 || l.GapX < 0 || l.GapY < 0 {
+		return false
+	}
+	right := l.MarginLeft + float64(l.Columns)*l.LabelWidth + float64(l.Columns-1)*l.GapX
+	bottom := l.MarginTop + float64(l.Rows)*l.LabelHeight + float64(l.Rows-1)*l.GapY
+	return right <= l.PageWidth+0.01 && bottom <= l.PageHeight+0.01
+}
+
+// Top left corner of the nth label on a page.
+func (l LabelLayout) position(n int) (float64, float64) {
+	col, row := n%l.Columns, n/l.Columns
+	return l.MarginLeft + float64(col)*(l.LabelWidth+l.GapX), l.MarginTop + float64(row)*(l.LabelHeight+l.GapY)
+}
+
+// Something labels can be drawn on, lengths are in mm and (x, y) of text
+// is the left end of its baseline.
+type labelCanvas interface {
+	NewPage()
+	Rect(x, y, w, h float64)
+	Text(x, y, size float64, s string)
+	TextWidth(s string, size float64) float64
+}
+
+type pdfCanvas struct {
+	pdf     *fpdf.Fpdf
+	unicode bool
+}
+
+func newPdfCanvas(l LabelLayout) *pdfCanvas {
+	pdf := fpdf.NewCustom(&fpdf.InitType{UnitStr: "mm", Size: fpdf.SizeType{Wd: l.PageWidth, Ht: l.PageHeight}})
+	pdf.SetMargins(0, 0, 0)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.SetFillColor(0, 0, 0)
+	c := &pdfCanvas{pdf: pdf}
+	if LabelFont != "" {
+		pdf.AddUTF8Font("label", "", LabelFont)
+		pdf.SetFont("label", "", 10)
+		c.unicode = true
+	} else {
+		pdf.SetFont("Helvetica", "", 10)
+	}
+	return c
+}
+
+// Core fonts of PDF can not show non-ASCII characters.
+func (c *pdfCanvas) text(s string) string {
+	if c.unicode {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+func (c *pdfCanvas) NewPage() {
+	c.pdf.AddPage()
+}
+
+func (c *pdfCanvas) Rect(x, y, w, h float64) {
+	c.pdf.Rect(x, y, w, h, "F")
+}
+
+func (c *pdfCanvas) Text(x, y, size float64, s string) {
+	c.pdf.SetFontUnitSize(size)
+	c.pdf.Text(x, y, c.text(s))
+}
+
+func (c *pdfCanvas) TextWidth(s string, size float64) float64 {
+	c.pdf.SetFontUnitSize(size)
+	return c.pdf.GetStringWidth(c.text(s))
+}
+
+// Draws pages of SVG, only one page is written out.
+type svgCanvas struct {
+	layout LabelLayout
+	pages  []*bytes.Buffer
+}
+
+func (c *svgCanvas) NewPage() {
+	c.pages = append(c.pages, new(bytes.Buffer))
+}
+
+func (c *svgCanvas) Rect(x, y, w, h float64) {
+	fmt.Fprintf(c.pages[len(c.pages)-1], "<rect x=\"%.3f\" y=\"%.3f\" width=\"%.3f\" height=\"%.3f\"/>\n", x, y, w, h)
+}
+
+func (c *svgCanvas) Text(x, y, size float64, s string) {
+	fmt.Fprintf(c.pages[len(c.pages)-1], "<text x=\"%.3f\" y=\"%.3f\" font-size=\"%.3f\">%s</text>\n", x, y, size, html.EscapeString(s))
+}
+
+// Estimated, since fonts are up to the viewer. Wide characters like Chinese
+// take a full em, others about a half.
+func (c *svgCanvas) TextWidth(s string, size float64) float64 {
+	width := 0.0
+	for _, r := range s {
+		if unicode.Is(unicode.Han, r) || unicode.In(r, unicode.Hiragana, unicode.Katakana, unicode.Hangul) || (r >= 0xFF00 && r <= 0xFFEF) {
+			width += size
+		} else {
+			width += size * 0.55
+		}
+	}
+	return width
+}
+
+func (c *svgCanvas) WritePage(w io.Writer, page int) {
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%gmm\" height=\"%gmm\" viewBox=\"0 0 %g %g\">\n",
+		c.layout.PageWidth, c.layout.PageHeight, c.layout.PageWidth, c.layout.PageHeight)
+	fmt.Fprintf(w, "<g fill=\"#000\" font-family=\"sans-serif\" shape-rendering=\"crispEdges\">\n")
+	w.Write(c.pages[page].Bytes())
+	fmt.Fprintf(w, "</g>\n</svg>\n")
+}
+
+// Cut s so that it fits in width, marking the cut with an ellipsis.
+func fitText(c labelCanvas, s string, size float64, width float64) string {
+	if c.TextWidth(s, size) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		if cut := string(runes) + "..."; c.TextWidth(cut, size) <= width {
+			return cut
+		}
+	}
+	return ""
+}
+
+func centerText(c labelCanvas, cx, y, size float64, s string) {
+	c.Text(cx-c.TextWidth(s, size)/2, y, size, s)
+}
+
+// Draw dark modules of a barcode into a box, bars of 1D barcodes take the
+// whole height.
+func drawBarcode(c labelCanvas, bc barcode.Barcode, x, y, w, h float64) {
+	bounds := bc.Bounds()
+	mw := w / float64(bounds.Dx())
+	mh := h / float64(bounds.Dy())
+	for row := bounds.Min.Y; row < bounds.Max.Y; row++ {
+		for col := bounds.Min.X; col < bounds.Max.X; {
+			if r, _, _, _ := bc.At(col, row).RGBA(); r != 0 {
+				col++
+				continue
+			}
+			start := col
+			for col < bounds.Max.X {
+				if r, _, _, _ := bc.At(col, row).RGBA(); r != 0 {
+					break
+				}
+				col++
+			}
+			c.Rect(x+float64(start-bounds.Min.X)*mw, y+float64(row-bounds.Min.Y)*mh, float64(col-start)*mw, mh)
+		}
+	}
+}
+
+// Draw a label of a book, link is encoded in QR codes.
+func drawLabel(c labelCanvas, kind string, b Book, link string, x, y, w, h float64) error {
+	pad := min(2, h*0.08)
+	x, y, w, h = x+pad, y+pad, w-2*pad, h-2*pad
+	switch kind {
+	case "code128":
+		bc, err := code128.Encode(b.Id)
+		if err != nil {
+			return err
+		}
+		drawBarcode(c, bc, x, y, w, h*0.45)
+		size := min(3.5, h*0.55/3*0.8)
+		lines := []string{b.Id, b.CallNumber, b.Name}
+		for i, line := range lines {
+			centerText(c, x+w/2, y+h*0.45+size*(1.2*float64(i)+1.1), size, fitText(c, line, size, w))
+		}
+	case "qr":
+		bc, err := qr.Encode(link, qr.M, qr.Auto)
+		if err != nil {
+			return err
+		}
+		side := min(h, w/2)
+		drawBarcode(c, bc, x, y+(h-side)/2, side, side)
+		size := min(3.5, h/3*0.8)
+		tx, tw := x+side+pad, w-side-pad
+		lines := []string{b.Name, b.CallNumber, b.Id}
+		top := y + (h-size*1.2*float64(len(lines)))/2
+		for i, line := range lines {
+			c.Text(tx, top+size*(1.2*float64(i)+1), size, fitText(c, line, size, tw))
+		}
+	case "spine":
+		marks := strings.Fields(b.CallNumber)
+		small := min(2.5, h*0.12)
+		big := min(5, (h-small*2.8)/max(float64(len(marks)), 1)/1.2)
+		centerText(c, x+w/2, y+small, small, fitText(c, b.Name, small, w))
+		top := y + small*1.4 + (h-small*2.8-big*1.2*float64(len(marks)))/2
+		for i, mark := range marks {
+			centerText(c, x+w/2, top+big*(1.2*float64(i)+1), big, fitText(c, mark, big, w))
+		}
+		centerText(c, x+w/2, y+h, small, fitText(c, b.Id, small, w))
+	}
+	return nil
+}
+
+// Lay labels of books out on pages, skipping the first skip labels of the
+// first sheet, which may have been used.
+func drawLabels(c labelCanvas, l LabelLayout, kind string, books []Book, links []string, skip int) error {
+	perPage := l.Columns * l.Rows
+	for i, b := range books {
+		n := i + skip
+		if i == 0 || n%perPage == 0 {
+			c.NewPage()
+		}
+		x, y := l.position(n % perPage)
+		if err := drawLabel(c, kind, b, links[i], x, y, l.LabelWidth, l.LabelHeight); err != nil {
+			return errors.New("无法生成书号" + b.Id + "的条码")
+		}
+	}
+	return nil
+}
+
+// Get the layout named by "layout", or a custom one from "page_w", "page_h",
+// "cols", "rows", "margin_l", "margin_t", "label_w", "label_h", "gap_x" and
+// "gap_y" in mm if "layout" is "custom".
+func parseLabelLayout(r *http.Request) (LabelLayout, bool) {
+	name := r.FormValue("layout")
+	if name == "" {
+		name = "a4-3x8"
+	}
+	if name != "custom" {
+		l, ok := LabelLayouts[name]
+		return l, ok
+	}
+	var l LabelLayout
+	floats := map[string]*float64{"page_w": &l.PageWidth, "page_h": &l.PageHeight, "margin_l": &l.MarginLeft, "margin_t": &l.MarginTop,
+		"label_w": &l.LabelWidth, "label_h": &l.LabelHeight, "gap_x": &l.GapX, "gap_y": &l.GapY}
+	for key, ptr := range floats {
+		if value := r.FormValue(key); value != "" {
+			tmp, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return l, false
+			}
+			*ptr = tmp
+		}
+	}
+	var err error
+	if l.Columns, err = strconv.Atoi(r.FormValue("cols")); err != nil {
+		return l, false
+	}
+	if l.Rows, err = strconv.Atoi(r.FormValue("rows")); err != nil {
+		return l, false
+	}
+	return l, l.Valid()
+}
+
+// Render labels of books given as "ids" separated by whitespace, repeated
+// "id" values, or all books on "shelf", each "copies" times. "kind" is
+// "code128" (default), "qr" or "spine", "format" is "pdf" (default) or
+// "svg". SVG has one sheet per document, chosen by "page" from 1.
+func labelsHandler(w http.ResponseWriter, r *http.Request) {
+	layout, ok := parseLabelLayout(r)
+	kind := r.FormValue("kind")
+	if kind == "" {
+		kind = "code128"
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = "pdf"
+	}
+	if !ok || !slices.Contains(LabelKinds, kind) || (format != "pdf" && format != "svg") {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	parseInt := func(key string, def int, minimum int) (int, bool) {
+		value := r.FormValue(key)
+		if value == "" {
+			return def, true
+		}
+		tmp, err := strconv.Atoi(value)
+		return tmp, err == nil && tmp >= minimum
+	}
+	copies, ok1 := parseInt("copies", 1, 1)
+	skip, ok2 := parseInt("skip", 0, 0)
+	page, ok3 := parseInt("page", 1, 1)
+	if !ok1 || !ok2 || !ok3 || copies > 100 || skip >= layout.Columns*layout.Rows {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var selected []Book
+	if shelf := r.FormValue("shelf"); shelf != "" {
+		var err error
+		selected, err = QueryBooks("STATUS='active' AND SHELF=?", shelf)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		SortByCallNumber(selected)
+	}
+	for _, id := range append(strings.Fields(r.FormValue("ids")), r.Form["id"]...) {
+		if id == "" {
+			continue
+		}
+		b, err := GetBookInfo(id)
+		if err != nil {
+			http.Error(w, "书号"+id+"不存在.", http.StatusNotFound)
+			return
+		}
+		selected = append(selected, b)
+	}
+	if len(selected) == 0 || len(selected)*copies > 10000 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	books := make([]Book, 0, len(selected)*copies)
+	links := make([]string, 0, len(selected)*copies)
+	for _, b := range selected {
+		for range copies {
+			books = append(books, b)
+			links = append(links, hostUrl(r)+"/books/"+url.PathEscape(b.Id))
+		}
+	}
+	if format == "svg" {
+		c := &svgCanvas{layout: layout}
+		if err := drawLabels(c, layout, kind, books, links, skip); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if page > len(c.pages) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		w.Header().Add("Content-Type", "image/svg+xml")
+		w.Header().Add("X-Total-Pages", strconv.Itoa(len(c.pages)))
+		w.WriteHeader(http.StatusOK)
+		c.WritePage(w, page-1)
+		return
+	}
+	c := newPdfCanvas(layout)
+	if err := drawLabels(c, layout, kind, books, links, skip); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	var buf bytes.Buffer
+	if err := c.pdf.Output(&buf); err != nil {
+		http.Error(w, "无法生成PDF, 请检查标签字体配置.", http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/pdf")
+	w.Header().Add("Content-Disposition", "inline; filename=\"labels.pdf\"")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
@@ -2,7 +2,7 @@
  * @Author: FunctionSir
  * @License: AGPLv3
  * @Date: 2025-06-20 08:28:04
- * @LastEditTime: 2025-06-23 10:15:58
+ * @LastEditTime: 2026-10-20 02:18:00
  * @LastEditors: FunctionSir
  * @Description: -
  * @FilePath: /biblio-matrix/main.go
@@ -10,14 +10,15 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"strconv"
 	"time"
 
-	"github.com/FunctionSir/goset"
 	"github.com/FunctionSir/readini"
 	_ "github.com/microsoft/go-mssqldb"
 	"golang.org/x/crypto/bcrypt"
@@ -31,6 +32,13 @@ var FrontendDir string
 var BCryptCost int
 var TlsCert string
 var TlsKey string
+var CookieSecure bool
+var CookieHttpOnly bool
+var CookieSameSite http.SameSite
+var RecommendInterval time.Duration
+var SessionStoreKind string
+var SessionFile string
+var TokenMode string
 
 func getConf() {
 	if len(os.Args) < 2 {
@@ -53,7 +61,33 @@ func getConf() {
 		fmt.Println(string(hashed))
 		os.Exit(0)
 	}
-	confFile, err := readini.LoadFromFile(os.Args[1])
+	if os.Args[1] == "gen-token-key" {
+		if len(os.Args) < 3 {
+			panic("no key file specified")
+		}
+		key, err := GenTokenKey()
+		if err != nil {
+			panic(err)
+		}
+		err = os.WriteFile(os.Args[2], key, 0600)
+		if err != nil {
+			panic(err)
+		}
+		os.Exit(0)
+	}
+	switch os.Args[1] {
+	case "import-books":
+		importBooksCmd(os.Args[2:])
+		os.Exit(0)
+	case "export-books":
+		exportBooksCmd(os.Args[2:])
+		os.Exit(0)
+	}
+	loadConf(os.Args[1])
+}
+
+func loadConf(path string) {
+	confFile, err := readini.LoadFromFile(path)
 	if err != nil {
 		panic(err)
 	}
@@ -90,6 +124,176 @@ func getConf() {
 	if TlsCert == "" || TlsKey == "" {
 		log.Println("Warning: Incomplete TLS config, using HTTP instead of HTTPS!")
 	}
+	tls := TlsCert != "" && TlsKey != ""
+	if !confFile.HasKey("options", "CookieSecure") {
+		CookieSecure = tls
+	} else {
+		CookieSecure, err = strconv.ParseBool(confFile["options"]["CookieSecure"])
+		if err != nil {
+			panic("cookie secure found but illegal")
+		}
+	}
+	if !confFile.HasKey("options", "CookieHttpOnly") {
+		CookieHttpOnly = tls
+	} else {
+		CookieHttpOnly, err = strconv.ParseBool(confFile["options"]["CookieHttpOnly"])
+		if err != nil {
+			panic("cookie http only found but illegal")
+		}
+	}
+	if !confFile.HasKey("options", "CookieSameSite") {
+		if tls {
+			CookieSameSite = http.SameSiteStrictMode
+		} else {
+			CookieSameSite = http.SameSiteDefaultMode
+		}
+	} else {
+		switch confFile["options"]["CookieSameSite"] {
+		case "strict":
+			CookieSameSite = http.SameSiteStrictMode
+		case "lax":
+			CookieSameSite = http.SameSiteLaxMode
+		case "default":
+			CookieSameSite = http.SameSiteDefaultMode
+		default:
+			panic("cookie same site found but illegal")
+		}
+	}
+	if !confFile.HasKey("options", "SessionTTL") {
+		SessionTTL = 24 * time.Hour
+	} else {
+		tmp, err := strconv.Atoi(confFile["options"]["SessionTTL"])
+		if err != nil || tmp <= 0 {
+			panic("session ttl found but illegal")
+		}
+		SessionTTL = time.Duration(tmp) * time.Minute
+	}
+	if !confFile.HasKey("options", "SessionIdleTimeout") {
+		SessionIdleTimeout = 0
+	} else {
+		tmp, err := strconv.Atoi(confFile["options"]["SessionIdleTimeout"])
+		if err != nil || tmp < 0 {
+			panic("session idle timeout found but illegal")
+		}
+		SessionIdleTimeout = time.Duration(tmp) * time.Minute
+	}
+	if !confFile.HasKey("options", "RememberMeTTL") {
+		RememberMeTTL = 30 * 24 * time.Hour
+	} else {
+		tmp, err := strconv.Atoi(confFile["options"]["RememberMeTTL"])
+		if err != nil || tmp <= 0 {
+			panic("remember me ttl found but illegal")
+		}
+		RememberMeTTL = time.Duration(tmp) * time.Minute
+	}
+	if !confFile.HasKey("options", "RecommendInterval") {
+		RecommendInterval = 60 * time.Minute
+	} else {
+		tmp, err := strconv.Atoi(confFile["options"]["RecommendInterval"])
+		if err != nil || tmp <= 0 {
+			panic("recommend interval found but illegal")
+		}
+		RecommendInterval = time.Duration(tmp) * time.Minute
+	}
+	if !confFile.HasKey("options", "OaiName") {
+		OaiRepoName = "Biblio Matrix"
+	} else {
+		OaiRepoName = confFile["options"]["OaiName"]
+	}
+	if !confFile.HasKey("options", "OaiId") {
+		OaiRepoId = "localhost"
+	} else {
+		OaiRepoId = confFile["options"]["OaiId"]
+	}
+	if !confFile.HasKey("options", "OaiAdminEmail") {
+		OaiAdminEmail = "root@localhost"
+	} else {
+		OaiAdminEmail = confFile["options"]["OaiAdminEmail"]
+	}
+	if !confFile.HasKey("options", "LabelFont") {
+		LabelFont = ""
+	} else {
+		LabelFont = confFile["options"]["LabelFont"]
+	}
+	if !confFile.HasKey("options", "AttachmentStore") || confFile["options"]["AttachmentStore"] == "dir" {
+		if !confFile.HasKey("options", "AttachmentDir") {
+			Attachments = NewDirStore("./attachments")
+		} else {
+			Attachments = NewDirStore(confFile["options"]["AttachmentDir"])
+		}
+	} else if confFile["options"]["AttachmentStore"] == "s3" {
+		for _, key := range []string{"S3Endpoint", "S3Bucket", "S3AccessKey", "S3SecretKey"} {
+			if !confFile.HasKey("options", key) {
+				panic("attachment store is s3 but " + key + " not specified")
+			}
+		}
+		region := "us-east-1"
+		if confFile.HasKey("options", "S3Region") {
+			region = confFile["options"]["S3Region"]
+		}
+		Attachments = NewS3Store(confFile["options"]["S3Endpoint"], confFile["options"]["S3Bucket"], region,
+			confFile["options"]["S3AccessKey"], confFile["options"]["S3SecretKey"])
+	} else {
+		panic("unknown attachment store")
+	}
+	if !confFile.HasKey("options", "AttachmentSecret") {
+		AttachmentSecret = make([]byte, 32)
+		rand.Read(AttachmentSecret)
+		log.Println("Warning: No attachment secret, download links will not survive restarts!")
+	} else {
+		AttachmentSecret = []byte(confFile["options"]["AttachmentSecret"])
+		if len(AttachmentSecret) < MinAttachmentSecret {
+			panic("attachment secret shorter than " + strconv.Itoa(MinAttachmentSecret) + " bytes")
+		}
+	}
+	if !confFile.HasKey("options", "SessionStore") {
+		SessionStoreKind = "memory"
+	} else {
+		SessionStoreKind = confFile["options"]["SessionStore"]
+		if SessionStoreKind != "memory" && SessionStoreKind != "db" && SessionStoreKind != "file" {
+			panic("unknown session store")
+		}
+	}
+	if !confFile.HasKey("options", "SessionFile") {
+		SessionFile = "./sessions.json"
+	} else {
+		SessionFile = confFile["options"]["SessionFile"]
+	}
+	if !confFile.HasKey("options", "TokenMode") {
+		TokenMode = "session"
+	} else {
+		TokenMode = confFile["options"]["TokenMode"]
+		if TokenMode != "session" && TokenMode != "signed" {
+			panic("unknown token mode")
+		}
+	}
+	if TokenMode == "signed" {
+		if !confFile.HasKey("options", "TokenKeys") {
+			panic("token mode is signed but no token keys specified")
+		}
+		Signer, err = NewTokenSigner(confFile["options"]["TokenKeys"])
+		if err != nil {
+			panic(err)
+		}
+	}
+	if !confFile.HasKey("options", "AccessTokenTTL") {
+		AccessTokenTTL = 15 * time.Minute
+	} else {
+		tmp, err := strconv.Atoi(confFile["options"]["AccessTokenTTL"])
+		if err != nil || tmp <= 0 {
+			panic("access token ttl found but illegal")
+		}
+		AccessTokenTTL = time.Duration(tmp) * time.Minute
+	}
+	if !confFile.HasKey("options", "RefreshTokenTTL") {
+		RefreshTokenTTL = 7 * 24 * time.Hour
+	} else {
+		tmp, err := strconv.Atoi(confFile["options"]["RefreshTokenTTL"])
+		if err != nil || tmp <= 0 {
+			panic("refresh token ttl found but illegal")
+		}
+		RefreshTokenTTL = time.Duration(tmp) * time.Minute
+	}
 	DbConn = confFile["options"]["DB"]
 	HttpAddr = confFile["options"]["Addr"]
 }
@@ -108,11 +312,36 @@ func main() {
 		panic(err)
 	}
 	log.Println("MSSQL DB connection OK.")
+	log.Println("Filling pinyin index of books...")
+	err = FillBooksPinyin()
+	if err != nil {
+		panic(err)
+	}
+	log.Println("Pinyin index of books ready.")
 	log.Println("Init token storage...")
-	TokensSet = make(goset.Set[string])
-	TokensExp = make(map[string]time.Time)
-	TokensUser = make(map[string]string)
-	TokensIsAdmin = make(map[string]bool)
+	switch SessionStoreKind {
+	case "memory":
+		Sessions = NewMemorySessionStore()
+	case "db":
+		Sessions = NewDbSessionStore()
+	case "file":
+		Sessions, err = NewFileSessionStore(SessionFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if Signer != nil {
+		Sessions = signedSessionStore{}
+		err = LoadRevocations()
+		if err != nil {
+			panic(err)
+		}
+		go RunRevocationsReloader(RevocationsReloadInterval)
+	}
 	log.Println("Token storage ready.")
+	go RunRecommender(RecommendInterval)
+	go RunEloanExpiry(EloanExpiryInterval)
+	go RunSetHolds(SetHoldsInterval)
+	go RunSerialsRefresher(SerialsRefreshInterval)
 	serveHttp(HttpAddr)
 }
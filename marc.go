@@ -0,0 +1,192 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 20:31:50
+ * @LastEditTime: 2026-10-19 20:31:50
+ * @LastEditors: FunctionSir
+ * @Description: MARCXML and Dublin Core records of books.
+ * @FilePath: /biblio-matrix/marc.go
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MarcNs = "http://www.loc.gov/MARC21/slim"
+const DcNs = "http://purl.org/dc/elements/1.1/"
+
+type MarcRecord struct {
+	XMLName       xml.Name           `xml:"http://www.loc.gov/MARC21/slim record"`
+	Leader        string             `xml:"leader"`
+	ControlFields []MarcControlField `xml:"controlfield"`
+	DataFields    []MarcDataField    `xml:"datafield"`
+}
+
+type MarcControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type MarcDataField struct {
+	Tag       string         `xml:"tag,attr"`
+	Ind1      string         `xml:"ind1,attr"`
+	Ind2      string         `xml:"ind2,attr"`
+	Subfields []MarcSubfield `xml:"subfield"`
+}
+
+type MarcSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+// MARC language codes of some common ways to write languages.
+var MarcLanguages = map[string]string{
+	"zh": "chi", "zho": "chi", "chi": "chi", "chinese": "chi", "中文": "chi", "汉语": "chi",
+	"en": "eng", "eng": "eng", "english": "eng", "英文": "eng", "英语": "eng",
+	"ja": "jpn", "jpn": "jpn", "japanese": "jpn", "日文": "jpn", "日语": "jpn",
+	"fr": "fre", "fre": "fre", "fra": "fre", "french": "fre", "法文": "fre", "法语": "fre",
+	"de": "ger", "ger": "ger", "deu": "ger", "german": "ger", "德文": "ger", "德语": "ger",
+	"ru": "rus", "rus": "rus", "russian": "rus", "俄文": "rus", "俄语": "rus",
+}
+
+func marcLanguage(language string) string {
+	if code, ok := MarcLanguages[strings.ToLower(strings.TrimSpace(language))]; ok {
+		return code
+	}
+	return "und"
+}
+
+// Relator terms of contributor roles.
+var MarcRelators = map[string]string{"author": "author", "editor": "editor", "translator": "translator"}
+
+// Build a MARC 21 bibliographic record of a book.
+func BookToMarc(b Book) MarcRecord {
+	rec := MarcRecord{Leader: "00000nam a2200000 a 4500"}
+	control := func(tag, value string) {
+		rec.ControlFields = append(rec.ControlFields, MarcControlField{Tag: tag, Value: value})
+	}
+	data := func(tag, ind1, ind2 string, subfields ...string) {
+		field := MarcDataField{Tag: tag, Ind1: ind1, Ind2: ind2}
+		for i := 0; i+1 < len(subfields); i += 2 {
+			if subfields[i+1] != "" {
+				field.Subfields = append(field.Subfields, MarcSubfield{Code: subfields[i], Value: subfields[i+1]})
+			}
+		}
+		if len(field.Subfields) > 0 {
+			rec.DataFields = append(rec.DataFields, field)
+		}
+	}
+	control("001", b.Id)
+	date1 := "uuuu"
+	if b.Year > 0 {
+		date1 = fmt.Sprintf("%04d", b.Year)
+	}
+	// 008: entered, type of date, date 1, date 2, place, book specific, language, modified, source.
+	control("008", time.Now().UTC().Format("060102")+"s"+date1+"    "+"xx "+"           000 0 "+marcLanguage(b.Language)+" d")
+	data("020", " ", " ", "a", b.Isbn)
+	if b.Language != "" {
+		data("041", "0", " ", "a", marcLanguage(b.Language))
+	}
+	data("082", "0", "4", "a", b.Ddc)
+	if b.Clc != "" {
+		data("084", " ", " ", "a", b.Clc, "2", "clc")
+	}
+	authors := contributorNames(b, "author")
+	if len(authors) > 0 {
+		data("100", "1", " ", "a", authors[0], "e", "author")
+	}
+	statement := strings.Join(authors, ", ")
+	data("245", "1", "0", "a", b.Name, "c", statement)
+	data("250", " ", " ", "a", b.Edition)
+	year := ""
+	if b.Year > 0 {
+		year = strconv.Itoa(b.Year)
+	}
+	data("264", " ", "1", "b", b.Publisher, "c", year)
+	if b.Pages > 0 {
+		data("300", " ", " ", "a", strconv.Itoa(b.Pages)+" pages")
+	}
+	if b.Series != "" {
+		volume := ""
+		if b.Volume > 0 {
+			volume = strconv.Itoa(b.Volume)
+		}
+		data("490", "0", " ", "a", b.Series, "v", volume)
+	}
+	data("520", " ", " ", "a", b.Summary)
+	for _, subject := range b.Subjects {
+		data("650", " ", "4", "a", subject)
+	}
+	mainEntry := true
+	for _, c := range b.Contributors {
+		if mainEntry && c.Role == "author" {
+			mainEntry = false
+			continue // Already in 100.
+		}
+		data("700", "1", " ", "a", c.Name, "e", MarcRelators[c.Role])
+	}
+	data("852", " ", " ", "c", b.Shelf, "h", b.CallNumber)
+	return rec
+}
+
+func BookToMarcXML(b Book) string {
+	out, err := xml.Marshal(BookToMarc(b))
+	if err != nil {
+		return ""
+	}
+	return string(out)
+}
+
+// Build a Dublin Core record of a book, with the root element and its
+// namespace given, like "oai_dc:dc" of OAI-PMH or "srw_dc:dc" of SRU.
+func BookToDublinCore(b Book, root string, rootNs string) string {
+	var buf bytes.Buffer
+	prefix, _, _ := strings.Cut(root, ":")
+	fmt.Fprintf(&buf, "<%s xmlns:%s=\"%s\" xmlns:dc=\"%s\">", root, prefix, rootNs, DcNs)
+	element := func(name, value string) {
+		if value == "" {
+			return
+		}
+		buf.WriteString("<dc:" + name + ">")
+		xml.EscapeText(&buf, []byte(value))
+		buf.WriteString("</dc:" + name + ">")
+	}
+	element("title", b.Name)
+	for _, name := range contributorNames(b, "author") {
+		element("creator", name)
+	}
+	for _, c := range b.Contributors {
+		if c.Role != "author" {
+			element("contributor", c.Name)
+		}
+	}
+	for _, subject := range b.Subjects {
+		element("subject", subject)
+	}
+	element("subject", b.Clc)
+	element("subject", b.Ddc)
+	element("description", b.Summary)
+	element("publisher", b.Publisher)
+	if b.Year > 0 {
+		element("date", strconv.Itoa(b.Year))
+	}
+	element("type", "Text")
+	if b.Pages > 0 {
+		element("format", strconv.Itoa(b.Pages)+" pages")
+	}
+	element("identifier", b.Id)
+	if b.Isbn != "" {
+		element("identifier", "urn:isbn:"+b.Isbn)
+	}
+	element("language", b.Language)
+	element("relation", b.Series)
+	buf.WriteString("</" + root + ">")
+	return buf.String()
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"log"
+	"net"
 	"net/http"
-	"sync"
+	"strings"
 	"time"
 
-	"github.com/FunctionSir/goset"
 	"github.com/google/uuid"
 )
 
@@ -19,84 +19,87 @@ func Logging(next http.HandlerFunc) http.HandlerFunc {
 	return handler
 }
 
-var TokensSet goset.Set[string]
-var TokensExp map[string]time.Time
-var TokensUser map[string]string
-var TokensIsAdmin map[string]bool
-var TokenLock sync.Mutex
-
+// Check a token, ending its session if idle for too long, or renewing it
+// otherwise.
 func ChkToken(token string) bool {
-	TokenLock.Lock()
-	defer TokenLock.Unlock()
-	if !TokensSet.Has(token) {
+	s, ok := Sessions.Get(token)
+	if !ok {
 		return false
 	}
-	// Do NOT use DelToken here!
-	// Or a DEAD LOCK will occur!
-	if TokensExp[token].UnixNano() <= time.Now().UnixNano() {
-		TokensSet.Erase(token)
-		delete(TokensExp, token)
-		delete(TokensUser, token)
-		delete(TokensIsAdmin, token)
+	now := time.Now()
+	idle := now.Sub(s.LastSeen)
+	// Signed tokens are never touched, their idleness is checked on /refresh.
+	if Signer == nil && SessionIdleTimeout > 0 && !s.Remember && idle > SessionIdleTimeout {
+		Sessions.Delete(token)
 		return false
 	}
+	if idle > SessionTouchInterval {
+		Sessions.Touch(token, now)
+	}
 	return true
 }
 
 func ClearTokens() {
-	TokenLock.Lock()
-	defer TokenLock.Unlock()
-	// Do NOT use DelToken here!
-	// Or a DEAD LOCK will occur!
-	clear(TokensSet)
-	clear(TokensExp)
-	clear(TokensUser)
-	clear(TokensIsAdmin)
+	Sessions.Clear()
 }
 
 func ChkTokensIsAdmin(token string) bool {
-	TokenLock.Lock()
-	defer TokenLock.Unlock()
-	if !TokensSet.Has(token) {
-		return false
-	}
-	return TokensIsAdmin[token]
+	s, ok := Sessions.Get(token)
+	return ok && s.IsAdmin
 }
 
 func GetTokenUsername(token string) string {
-	TokenLock.Lock()
-	defer TokenLock.Unlock()
-	if !TokensSet.Has(token) {
-		return ""
-	}
-	return TokensUser[token]
+	s, _ := Sessions.Get(token)
+	return s.Username
 }
 
-func NewToken(username string, isAdmin bool) (string, time.Time) {
-	TokenLock.Lock()
-	defer TokenLock.Unlock()
+// Start a session, only for session tokens, signed ones are issued by Signer.
+func NewToken(username string, isAdmin bool, remember bool, ip string, agent string) (string, time.Time, error) {
+	now := time.Now()
 	token := uuid.NewString()
-	for TokensSet.Has(token) {
-		token = uuid.NewString()
+	s := Session{TokenHash: HashToken(token), Username: username, IsAdmin: isAdmin, Created: now, Expires: now.Add(SessionLifetime(remember)), LastSeen: now, Remember: remember,
+		Ip: ip, UserAgent: agent}
+	if err := Sessions.Put(s); err != nil {
+		return "", time.Time{}, err
 	}
-	exp := time.Now().Add(24 * time.Hour)
-	TokensSet.Insert(token)
-	TokensExp[token] = exp
-	TokensUser[token] = username
-	TokensIsAdmin[token] = isAdmin
-	return token, exp
+	return token, s.Expires, nil
 }
 
 func DelToken(token string) {
-	TokenLock.Lock()
-	defer TokenLock.Unlock()
-	if !TokensSet.Has(token) {
+	Sessions.Delete(token)
+}
+
+// End all other sessions of the user of token, of the same role.
+func DelOtherTokens(token string) {
+	current, ok := Sessions.Get(token)
+	if !ok {
 		return
 	}
-	TokensSet.Erase(token)
-	delete(TokensExp, token)
-	delete(TokensUser, token)
-	delete(TokensIsAdmin, token)
+	for _, s := range Sessions.List(current.Username) {
+		if s.TokenHash != current.TokenHash && s.IsAdmin == current.IsAdmin {
+			Sessions.DeleteHash(s.TokenHash)
+		}
+	}
+}
+
+// IP and user agent of the client, to tell sessions apart.
+func clientInfo(r *http.Request) (string, string) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	agent := r.UserAgent()
+	if len(agent) > MaxUserAgentLen {
+		agent = strings.ToValidUTF8(agent[:MaxUserAgentLen], "")
+	}
+	return ip, agent
+}
+
+// Set the token cookie, hardened as configured. A zero exp makes it last
+// until the browser is closed.
+func setTokenCookie(w http.ResponseWriter, token string, exp time.Time) {
+	http.SetCookie(w, &http.Cookie{Name: "token", Value: token, Path: "/", Expires: exp,
+		HttpOnly: CookieHttpOnly, Secure: CookieSecure, SameSite: CookieSameSite})
 }
 
 func ReaderLvlAuth(next http.HandlerFunc) http.HandlerFunc {
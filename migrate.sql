@@ -0,0 +1,431 @@
+-- 运行以将由旧版mkdb.sql建立的数据库升级到当前版本.
+-- 注意: DBMS应选用MS SQL Server.
+-- 可重复运行, 已经升级过的部分会被跳过.
+-- 运行前务必备份数据库!
+
+USE LIBMAN;
+GO
+
+-- 书名和作者的全拼与拼音首字母, 用于拼音搜索; 启动时会为已有的图书填充
+IF COL_LENGTH('BOOKS','NAME_PY') IS NULL
+	ALTER TABLE BOOKS ADD
+		NAME_PY VARCHAR(1024),
+		NAME_INITIALS VARCHAR(255),
+		AUTHOR_PY VARCHAR(1024),
+		AUTHOR_INITIALS VARCHAR(255);
+GO
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_BOOKS_NAME_PY')
+	CREATE INDEX INDEX_BOOKS_NAME_PY ON BOOKS(NAME_PY);
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_BOOKS_AUTHOR_PY')
+	CREATE INDEX INDEX_BOOKS_AUTHOR_PY ON BOOKS(AUTHOR_PY);
+GO
+
+-- 出版者, 出版年, 版次, 语种, 页数, 摘要, 主题词和责任者
+IF COL_LENGTH('BOOKS','PUBLISHER') IS NULL
+	ALTER TABLE BOOKS ADD
+		PUBLISHER VARCHAR(255) NOT NULL DEFAULT '',
+		PUB_YEAR INTEGER NOT NULL DEFAULT 0 CHECK(PUB_YEAR>=0),
+		EDITION VARCHAR(64) NOT NULL DEFAULT '',
+		LANG VARCHAR(32) NOT NULL DEFAULT '',
+		PAGES INTEGER NOT NULL DEFAULT 0 CHECK(PAGES>=0),
+		SUMMARY VARCHAR(4000) NOT NULL DEFAULT '';
+IF OBJECT_ID('BOOK_SUBJECTS') IS NULL
+	CREATE TABLE BOOK_SUBJECTS (
+		ID VARCHAR(36) NOT NULL,
+		SEQ INTEGER NOT NULL,
+		SUBJECT VARCHAR(255) NOT NULL,
+		PRIMARY KEY (ID,SEQ),
+		FOREIGN KEY (ID) REFERENCES BOOKS ON DELETE CASCADE
+	);
+IF OBJECT_ID('BOOK_CONTRIBUTORS') IS NULL
+	CREATE TABLE BOOK_CONTRIBUTORS (
+		ID VARCHAR(36) NOT NULL,
+		SEQ INTEGER NOT NULL,
+		"NAME" VARCHAR(255) NOT NULL,
+		"ROLE" VARCHAR(16) NOT NULL CHECK("ROLE" IN ('author','editor','translator')),
+		PRIMARY KEY (ID,SEQ),
+		FOREIGN KEY (ID) REFERENCES BOOKS ON DELETE CASCADE
+	);
+GO
+
+-- 图书版本号(乐观锁)和修改历史
+IF COL_LENGTH('BOOKS','VER') IS NULL
+	ALTER TABLE BOOKS ADD VER INTEGER NOT NULL DEFAULT 1;
+IF OBJECT_ID('BOOK_HISTORY') IS NULL
+	CREATE TABLE BOOK_HISTORY (
+		ID VARCHAR(36) NOT NULL,
+		VER INTEGER NOT NULL,
+		CHANGED DATETIME NOT NULL,
+		CHANGED_BY VARCHAR(64) NOT NULL,
+		FIELD VARCHAR(32) NOT NULL,
+		OLD_VAL VARCHAR(MAX) NOT NULL,
+		NEW_VAL VARCHAR(MAX) NOT NULL,
+		PRIMARY KEY (ID,VER,FIELD)
+	);
+GO
+
+-- 图书状态, 下架的图书保留历史
+IF COL_LENGTH('BOOKS','STATUS') IS NULL
+	ALTER TABLE BOOKS ADD
+		STATUS VARCHAR(16) NOT NULL DEFAULT 'active' CHECK(STATUS IN ('active','withdrawn')),
+		WITHDRAWN_REASON VARCHAR(255),
+		WITHDRAWN_AT DATETIME;
+GO
+
+-- 分类号, 索书号和排架位置
+IF COL_LENGTH('BOOKS','CLC') IS NULL
+	ALTER TABLE BOOKS ADD
+		CLC VARCHAR(32) NOT NULL DEFAULT '',
+		DDC VARCHAR(32) NOT NULL DEFAULT '',
+		CALL_NO VARCHAR(64) NOT NULL DEFAULT '',
+		SHELF VARCHAR(64) NOT NULL DEFAULT '';
+GO
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_BOOKS_CLC')
+	CREATE INDEX INDEX_BOOKS_CLC ON BOOKS(CLC);
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_BOOKS_DDC')
+	CREATE INDEX INDEX_BOOKS_DDC ON BOOKS(DDC);
+GO
+
+-- 丛书与多卷书, 以及多卷书整套预约
+IF OBJECT_ID('SERIES') IS NULL
+	CREATE TABLE SERIES (
+		ID VARCHAR(36) PRIMARY KEY,
+		"NAME" VARCHAR(255) NOT NULL,
+		IS_SET BIT NOT NULL DEFAULT 0,
+		NOTE VARCHAR(1024) NOT NULL DEFAULT ''
+	);
+GO
+IF COL_LENGTH('BOOKS','SERIES_ID') IS NULL
+	ALTER TABLE BOOKS ADD
+		SERIES_ID VARCHAR(36) REFERENCES SERIES,
+		VOLUME INTEGER NOT NULL DEFAULT 0 CHECK(VOLUME>=0);
+IF OBJECT_ID('SET_HOLDS') IS NULL
+	CREATE TABLE SET_HOLDS (
+		HID INTEGER IDENTITY PRIMARY KEY,
+		USERNAME VARCHAR(64) NOT NULL,
+		SERIES_ID VARCHAR(36) NOT NULL,
+		PLACED DATETIME NOT NULL,
+		STATUS VARCHAR(16) NOT NULL DEFAULT 'waiting' CHECK(STATUS IN ('waiting','ready','fulfilled','cancelled','expired')),
+		READY_AT DATETIME,
+		EXPIRES DATETIME,
+		FOREIGN KEY (USERNAME) REFERENCES READERS ON DELETE CASCADE,
+		FOREIGN KEY (SERIES_ID) REFERENCES SERIES
+	);
+GO
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_SET_HOLDS_SERIES_ID')
+	CREATE INDEX INDEX_SET_HOLDS_SERIES_ID ON SET_HOLDS(SERIES_ID);
+GO
+
+-- ISBN, 以及同一字段一次修改多次时也能记录的修改历史
+IF COL_LENGTH('BOOKS','ISBN') IS NULL
+	ALTER TABLE BOOKS ADD ISBN VARCHAR(13) NOT NULL DEFAULT '';
+GO
+IF COL_LENGTH('BOOK_HISTORY','HID') IS NULL BEGIN
+	DECLARE @PK SYSNAME = (SELECT "NAME" FROM SYS.KEY_CONSTRAINTS WHERE "TYPE"='PK' AND PARENT_OBJECT_ID=OBJECT_ID('BOOK_HISTORY'));
+	IF @PK IS NOT NULL
+		EXEC('ALTER TABLE BOOK_HISTORY DROP CONSTRAINT ' + QUOTENAME(@PK));
+	ALTER TABLE BOOK_HISTORY ADD HID INTEGER IDENTITY PRIMARY KEY;
+END;
+GO
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_BOOKS_ISBN')
+	CREATE INDEX INDEX_BOOKS_ISBN ON BOOKS(ISBN);
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_BOOK_HISTORY_ID')
+	CREATE INDEX INDEX_BOOK_HISTORY_ID ON BOOK_HISTORY(ID);
+GO
+
+-- 借阅历史, 读者评分与书评, 以及读者标签
+IF OBJECT_ID('LOAN_HISTORY') IS NULL
+	CREATE TABLE LOAN_HISTORY (
+		LID INTEGER IDENTITY PRIMARY KEY,
+		USERNAME VARCHAR(64) NOT NULL,
+		ID VARCHAR(36) NOT NULL,
+		BORROWED DATETIME NOT NULL,
+		RETURNED DATETIME NOT NULL
+	);
+IF OBJECT_ID('REVIEWS') IS NULL
+	CREATE TABLE REVIEWS (
+		USERNAME VARCHAR(64) NOT NULL,
+		ID VARCHAR(36) NOT NULL,
+		RATING INTEGER NOT NULL CHECK(RATING>=1 AND RATING<=5),
+		CONTENT VARCHAR(4000) NOT NULL DEFAULT '',
+		STATUS VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK(STATUS IN ('pending','approved','rejected')),
+		CREATED DATETIME NOT NULL,
+		UPDATED DATETIME NOT NULL,
+		PRIMARY KEY (USERNAME,ID),
+		FOREIGN KEY (USERNAME) REFERENCES READERS ON DELETE CASCADE,
+		FOREIGN KEY (ID) REFERENCES BOOKS ON DELETE CASCADE
+	);
+IF OBJECT_ID('BOOK_TAGS') IS NULL
+	CREATE TABLE BOOK_TAGS (
+		USERNAME VARCHAR(64) NOT NULL,
+		ID VARCHAR(36) NOT NULL,
+		TAG VARCHAR(96) NOT NULL,
+		PRIMARY KEY (USERNAME,ID,TAG),
+		FOREIGN KEY (USERNAME) REFERENCES READERS ON DELETE CASCADE,
+		FOREIGN KEY (ID) REFERENCES BOOKS ON DELETE CASCADE
+	);
+GO
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_LOAN_HISTORY_USERNAME')
+	CREATE INDEX INDEX_LOAN_HISTORY_USERNAME ON LOAN_HISTORY(USERNAME);
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_LOAN_HISTORY_ID')
+	CREATE INDEX INDEX_LOAN_HISTORY_ID ON LOAN_HISTORY(ID);
+GO
+
+-- 读者可以不参与推荐
+IF COL_LENGTH('READERS','NO_RECOMMEND') IS NULL
+	ALTER TABLE READERS ADD NO_RECOMMEND BIT NOT NULL DEFAULT 0;
+GO
+
+-- 书目修改时间, 以及被合并图书的记录, 用于 OAI-PMH 增量收割
+IF COL_LENGTH('BOOKS','MODIFIED') IS NULL
+	ALTER TABLE BOOKS ADD MODIFIED DATETIME NOT NULL DEFAULT GETUTCDATE();
+IF OBJECT_ID('DELETED_BOOKS') IS NULL
+	CREATE TABLE DELETED_BOOKS (
+		ID VARCHAR(36) PRIMARY KEY,
+		DELETED DATETIME NOT NULL,
+		CLC VARCHAR(32) NOT NULL DEFAULT '',
+		SERIES_ID VARCHAR(36),
+		MERGED_INTO VARCHAR(36)
+	);
+GO
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_BOOKS_MODIFIED')
+	CREATE INDEX INDEX_BOOKS_MODIFIED ON BOOKS(MODIFIED);
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_DELETED_BOOKS_DELETED')
+	CREATE INDEX INDEX_DELETED_BOOKS_DELETED ON DELETED_BOOKS(DELETED);
+GO
+
+-- 入藏时间, 用于新书通报; 已有图书记为升级的时间
+IF COL_LENGTH('BOOKS','ADDED') IS NULL
+	ALTER TABLE BOOKS ADD ADDED DATETIME NOT NULL DEFAULT GETUTCDATE();
+GO
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_BOOKS_ADDED')
+	CREATE INDEX INDEX_BOOKS_ADDED ON BOOKS(ADDED);
+GO
+
+-- 采访: 供应商, 经费, 订单和订单明细; 金额单位为分
+IF OBJECT_ID('VENDORS') IS NULL
+	CREATE TABLE VENDORS (
+		ID VARCHAR(36) PRIMARY KEY,
+		"NAME" VARCHAR(255) NOT NULL,
+		CONTACT VARCHAR(64) NOT NULL DEFAULT '',
+		PHONE VARCHAR(32) NOT NULL DEFAULT '',
+		EMAIL VARCHAR(255) NOT NULL DEFAULT '',
+		NOTE VARCHAR(1024) NOT NULL DEFAULT ''
+	);
+IF OBJECT_ID('FUNDS') IS NULL
+	CREATE TABLE FUNDS (
+		ID VARCHAR(36) PRIMARY KEY,
+		"NAME" VARCHAR(255) NOT NULL,
+		FISCAL_YEAR INTEGER NOT NULL,
+		BUDGET BIGINT NOT NULL CHECK(BUDGET>=0)
+	);
+GO
+IF OBJECT_ID('PURCHASE_ORDERS') IS NULL
+	CREATE TABLE PURCHASE_ORDERS (
+		OID INTEGER IDENTITY PRIMARY KEY,
+		VENDOR_ID VARCHAR(36) NOT NULL REFERENCES VENDORS,
+		FUND_ID VARCHAR(36) NOT NULL REFERENCES FUNDS,
+		STATUS VARCHAR(16) NOT NULL DEFAULT 'open' CHECK(STATUS IN ('open','closed','cancelled')),
+		CREATED DATETIME NOT NULL,
+		CREATED_BY VARCHAR(64) NOT NULL,
+		NOTE VARCHAR(1024) NOT NULL DEFAULT ''
+	);
+GO
+IF OBJECT_ID('ORDER_LINES') IS NULL
+	CREATE TABLE ORDER_LINES (
+		OID INTEGER NOT NULL REFERENCES PURCHASE_ORDERS ON DELETE CASCADE,
+		SEQ INTEGER NOT NULL,
+		BOOK_ID VARCHAR(36) NOT NULL,
+		"NAME" VARCHAR(255) NOT NULL,
+		AUTHOR VARCHAR(255) NOT NULL,
+		ISBN VARCHAR(13) NOT NULL DEFAULT '',
+		QTY INTEGER NOT NULL CHECK(QTY>0),
+		EST_PRICE BIGINT NOT NULL CHECK(EST_PRICE>=0),
+		RECEIVED INTEGER NOT NULL DEFAULT 0 CHECK(RECEIVED>=0),
+		SPENT BIGINT NOT NULL DEFAULT 0 CHECK(SPENT>=0),
+		PRIMARY KEY (OID,SEQ),
+		CHECK(RECEIVED<=QTY)
+	);
+GO
+-- 旧版的金额为INTEGER, 改为BIGINT前需先移除列上的约束, 之后再加回
+IF EXISTS (SELECT * FROM SYS.COLUMNS WHERE OBJECT_ID=OBJECT_ID('FUNDS') AND "NAME"='BUDGET' AND SYSTEM_TYPE_ID=TYPE_ID('INT')) BEGIN
+	DECLARE @SQL NVARCHAR(MAX) = N'';
+	SELECT @SQL += N'ALTER TABLE ' + QUOTENAME(OBJECT_NAME(C.PARENT_OBJECT_ID)) + N' DROP CONSTRAINT ' + QUOTENAME(C."NAME") + N';'
+		FROM (SELECT "NAME",PARENT_OBJECT_ID,PARENT_COLUMN_ID FROM SYS.CHECK_CONSTRAINTS
+			UNION ALL SELECT "NAME",PARENT_OBJECT_ID,PARENT_COLUMN_ID FROM SYS.DEFAULT_CONSTRAINTS) AS C
+		WHERE (C.PARENT_OBJECT_ID=OBJECT_ID('FUNDS') AND COL_NAME(C.PARENT_OBJECT_ID,C.PARENT_COLUMN_ID)='BUDGET')
+			OR (C.PARENT_OBJECT_ID=OBJECT_ID('ORDER_LINES') AND COL_NAME(C.PARENT_OBJECT_ID,C.PARENT_COLUMN_ID) IN ('EST_PRICE','SPENT'));
+	EXEC(@SQL);
+	ALTER TABLE FUNDS ALTER COLUMN BUDGET BIGINT NOT NULL;
+	ALTER TABLE ORDER_LINES ALTER COLUMN EST_PRICE BIGINT NOT NULL;
+	ALTER TABLE ORDER_LINES ALTER COLUMN SPENT BIGINT NOT NULL;
+	ALTER TABLE FUNDS ADD CHECK(BUDGET>=0);
+	ALTER TABLE ORDER_LINES ADD CHECK(EST_PRICE>=0), CHECK(SPENT>=0), DEFAULT 0 FOR SPENT;
+END;
+GO
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_ORDER_LINES_BOOK_ID')
+	CREATE INDEX INDEX_ORDER_LINES_BOOK_ID ON ORDER_LINES(BOOK_ID);
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_PURCHASE_ORDERS_FUND_ID')
+	CREATE INDEX INDEX_PURCHASE_ORDERS_FUND_ID ON PURCHASE_ORDERS(FUND_ID);
+GO
+
+-- 期刊: 订阅和各期
+IF OBJECT_ID('SUBSCRIPTIONS') IS NULL
+	CREATE TABLE SUBSCRIPTIONS (
+		SID VARCHAR(36) PRIMARY KEY,
+		TITLE VARCHAR(255) NOT NULL,
+		ISSN VARCHAR(9) NOT NULL DEFAULT '',
+		PUBLISHER VARCHAR(255) NOT NULL DEFAULT '',
+		VENDOR_ID VARCHAR(36) REFERENCES VENDORS,
+		FREQUENCY VARCHAR(16) NOT NULL CHECK(FREQUENCY IN ('weekly','monthly','quarterly')),
+		START_DATE DATE NOT NULL,
+		END_DATE DATE,
+		FIRST_NUMBER INTEGER NOT NULL DEFAULT 1 CHECK(FIRST_NUMBER>=0),
+		GRACE_DAYS INTEGER NOT NULL DEFAULT 14 CHECK(GRACE_DAYS>=0),
+		STATUS VARCHAR(16) NOT NULL DEFAULT 'active' CHECK(STATUS IN ('active','cancelled'))
+	);
+GO
+IF OBJECT_ID('SERIAL_ISSUES') IS NULL
+	CREATE TABLE SERIAL_ISSUES (
+		SID VARCHAR(36) NOT NULL REFERENCES SUBSCRIPTIONS ON DELETE CASCADE,
+		SEQ INTEGER NOT NULL,
+		"NUMBER" INTEGER NOT NULL,
+		EXPECTED DATE NOT NULL,
+		STATUS VARCHAR(16) NOT NULL DEFAULT 'expected' CHECK(STATUS IN ('expected','late','received','missing')),
+		RECEIVED DATETIME,
+		ITEM_ID VARCHAR(36),
+		CLAIMS INTEGER NOT NULL DEFAULT 0 CHECK(CLAIMS>=0),
+		LAST_CLAIMED DATETIME,
+		PRIMARY KEY (SID,SEQ)
+	);
+GO
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_SERIAL_ISSUES_STATUS')
+	CREATE INDEX INDEX_SERIAL_ISSUES_STATUS ON SERIAL_ISSUES(STATUS);
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_SERIAL_ISSUES_ITEM_ID')
+	CREATE INDEX INDEX_SERIAL_ISSUES_ITEM_ID ON SERIAL_ISSUES(ITEM_ID);
+GO
+
+-- 盘点: 盘点和扫描记录
+IF OBJECT_ID('INVENTORY_SESSIONS') IS NULL
+	CREATE TABLE INVENTORY_SESSIONS (
+		IID INTEGER IDENTITY PRIMARY KEY,
+		"NAME" VARCHAR(255) NOT NULL,
+		CREATED DATETIME NOT NULL,
+		CREATED_BY VARCHAR(64) NOT NULL,
+		STATUS VARCHAR(16) NOT NULL DEFAULT 'open' CHECK(STATUS IN ('open','applied','closed')),
+		FINISHED DATETIME
+	);
+GO
+IF OBJECT_ID('INVENTORY_SCANS') IS NULL
+	CREATE TABLE INVENTORY_SCANS (
+		IID INTEGER NOT NULL REFERENCES INVENTORY_SESSIONS ON DELETE CASCADE,
+		SECTION VARCHAR(64) NOT NULL,
+		ID VARCHAR(36) NOT NULL,
+		CNT INTEGER NOT NULL CHECK(CNT>0),
+		PRIMARY KEY (IID,SECTION,ID)
+	);
+GO
+
+-- 附件, 用于电子书
+IF OBJECT_ID('ATTACHMENTS') IS NULL
+	CREATE TABLE ATTACHMENTS (
+		AID INTEGER IDENTITY PRIMARY KEY,
+		ID VARCHAR(36) NOT NULL REFERENCES BOOKS,
+		FILENAME NVARCHAR(255) NOT NULL,
+		MIME VARCHAR(128) NOT NULL,
+		SIZE BIGINT NOT NULL CHECK(SIZE>=0),
+		SHA256 CHAR(64) NOT NULL,
+		STORE_KEY VARCHAR(512) NOT NULL UNIQUE,
+		ACCESS VARCHAR(16) NOT NULL DEFAULT 'loan' CHECK(ACCESS IN ('loan','public')),
+		UPLOADED DATETIME NOT NULL,
+		UPLOADED_BY VARCHAR(64) NOT NULL
+	);
+GO
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_ATTACHMENTS_ID')
+	CREATE INDEX INDEX_ATTACHMENTS_ID ON ATTACHMENTS(ID);
+GO
+
+-- 封面图片的SHA-256, 无封面时为NULL
+IF COL_LENGTH('BOOKS','COVER') IS NULL
+	ALTER TABLE BOOKS ADD COVER CHAR(64);
+GO
+
+-- 会话表, 以令牌的SHA-256为主键
+IF OBJECT_ID('SESSIONS') IS NULL
+	CREATE TABLE SESSIONS (
+		TOKEN_HASH CHAR(64) PRIMARY KEY,
+		USERNAME VARCHAR(64) NOT NULL,
+		IS_ADMIN BIT NOT NULL,
+		CREATED DATETIME NOT NULL,
+		EXPIRES DATETIME NOT NULL
+	);
+GO
+-- 旧版以明文令牌为主键, 换为其哈希, 已登录的会话仍然有效
+IF COL_LENGTH('SESSIONS','TOKEN') IS NOT NULL BEGIN
+	DECLARE @SQL NVARCHAR(MAX) = N'';
+	SELECT @SQL += N'ALTER TABLE SESSIONS DROP CONSTRAINT ' + QUOTENAME("NAME") + N';'
+		FROM SYS.KEY_CONSTRAINTS WHERE PARENT_OBJECT_ID=OBJECT_ID('SESSIONS') AND "TYPE"='PK';
+	EXEC(@SQL);
+	ALTER TABLE SESSIONS ADD TOKEN_HASH CHAR(64);
+END;
+GO
+IF COL_LENGTH('SESSIONS','TOKEN') IS NOT NULL BEGIN
+	EXEC(N'UPDATE SESSIONS SET TOKEN_HASH=LOWER(CONVERT(CHAR(64),HASHBYTES(''SHA2_256'',TOKEN),2))');
+	ALTER TABLE SESSIONS DROP COLUMN TOKEN;
+	ALTER TABLE SESSIONS ALTER COLUMN TOKEN_HASH CHAR(64) NOT NULL;
+END;
+GO
+IF NOT EXISTS (SELECT * FROM SYS.KEY_CONSTRAINTS WHERE PARENT_OBJECT_ID=OBJECT_ID('SESSIONS') AND "TYPE"='PK')
+	ALTER TABLE SESSIONS ADD PRIMARY KEY (TOKEN_HASH);
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_SESSIONS_USERNAME')
+	CREATE INDEX INDEX_SESSIONS_USERNAME ON SESSIONS(USERNAME);
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_SESSIONS_EXPIRES')
+	CREATE INDEX INDEX_SESSIONS_EXPIRES ON SESSIONS(EXPIRES);
+GO
+
+-- 签名令牌的吊销表; JTI唯一, 使刷新令牌只能使用一次
+IF OBJECT_ID('TOKEN_REVOCATIONS') IS NULL
+	CREATE TABLE TOKEN_REVOCATIONS (
+		RID INTEGER IDENTITY PRIMARY KEY,
+		JTI VARCHAR(64),
+		USERNAME VARCHAR(64),
+		ISSUED_BEFORE DATETIME,
+		EXPIRES DATETIME NOT NULL,
+		CHECK(JTI IS NOT NULL OR ISSUED_BEFORE IS NOT NULL)
+	);
+GO
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_TOKEN_REVOCATIONS_EXPIRES')
+	CREATE INDEX INDEX_TOKEN_REVOCATIONS_EXPIRES ON TOKEN_REVOCATIONS(EXPIRES);
+GO
+IF NOT EXISTS (SELECT * FROM SYS.INDEXES WHERE "NAME"='INDEX_TOKEN_REVOCATIONS_JTI') BEGIN
+	DELETE FROM TOKEN_REVOCATIONS WHERE JTI IS NOT NULL AND RID NOT IN (SELECT MIN(RID) FROM TOKEN_REVOCATIONS WHERE JTI IS NOT NULL GROUP BY JTI);
+	CREATE UNIQUE INDEX INDEX_TOKEN_REVOCATIONS_JTI ON TOKEN_REVOCATIONS(JTI) WHERE JTI IS NOT NULL;
+END;
+GO
+
+-- 会话的最近活动时间和"记住我", 用于空闲超时
+IF COL_LENGTH('SESSIONS','LAST_SEEN') IS NULL
+	ALTER TABLE SESSIONS ADD LAST_SEEN DATETIME NOT NULL DEFAULT GETUTCDATE();
+IF COL_LENGTH('SESSIONS','REMEMBER') IS NULL
+	ALTER TABLE SESSIONS ADD REMEMBER BIT NOT NULL DEFAULT 0;
+GO
+
+-- 会话的登录IP和用户代理; 吊销某用户的令牌时区分角色, 旧记录的ROLE为NULL, 对两种角色都有效
+IF COL_LENGTH('SESSIONS','IP') IS NULL
+	ALTER TABLE SESSIONS ADD IP VARCHAR(64);
+IF COL_LENGTH('SESSIONS','USER_AGENT') IS NULL
+	ALTER TABLE SESSIONS ADD USER_AGENT NVARCHAR(512);
+IF COL_LENGTH('TOKEN_REVOCATIONS','ROLE') IS NULL
+	ALTER TABLE TOKEN_REVOCATIONS ADD "ROLE" VARCHAR(16) CHECK("ROLE" IN ('admin','reader'));
+GO
+
+-- 吊销时间精确到毫秒, 以区分同一秒内签发的令牌; 改类型前需先移除引用该列的约束, 之后再加回
+IF EXISTS (SELECT * FROM SYS.COLUMNS WHERE OBJECT_ID=OBJECT_ID('TOKEN_REVOCATIONS') AND "NAME"='ISSUED_BEFORE' AND SYSTEM_TYPE_ID=TYPE_ID('DATETIME')) BEGIN
+	DECLARE @SQL NVARCHAR(MAX) = N'';
+	SELECT @SQL += N'ALTER TABLE TOKEN_REVOCATIONS DROP CONSTRAINT ' + QUOTENAME("NAME") + N';'
+		FROM SYS.CHECK_CONSTRAINTS WHERE PARENT_OBJECT_ID=OBJECT_ID('TOKEN_REVOCATIONS') AND "DEFINITION" LIKE '%ISSUED_BEFORE%';
+	EXEC(@SQL);
+	ALTER TABLE TOKEN_REVOCATIONS ALTER COLUMN ISSUED_BEFORE DATETIME2(3);
+	ALTER TABLE TOKEN_REVOCATIONS ADD CHECK(JTI IS NOT NULL OR ISSUED_BEFORE IS NOT NULL);
+END;
+GO
@@ -22,7 +22,18 @@ CREATE TABLE READERS (
 	USERNAME VARCHAR(64) PRIMARY KEY CHECK(LEN(USERNAME)>=3),
 	PASSWD VARCHAR(255) NOT NULL UNIQUE,
 	"NAME" VARCHAR(64),
-	CNT INTEGER NOT NULL CHECK(CNT>=0)
+	CNT INTEGER NOT NULL CHECK(CNT>=0),
+	-- 不参与"借过这本书的读者也借了"推荐, 也不接收个性化推荐
+	NO_RECOMMEND BIT NOT NULL DEFAULT 0
+);
+
+-- 丛书与多卷书表
+CREATE TABLE SERIES (
+	ID VARCHAR(36) PRIMARY KEY,
+	"NAME" VARCHAR(255) NOT NULL,
+	-- 是否为多卷书(整套书), 整套书可以一次借完
+	IS_SET BIT NOT NULL DEFAULT 0,
+	NOTE VARCHAR(1024) NOT NULL DEFAULT ''
 );
 
 -- 图书表
@@ -31,7 +42,81 @@ CREATE TABLE BOOKS (
 	"NAME" VARCHAR(255) NOT NULL,
 	AUTHOR VARCHAR(255) NOT NULL,
 	PRICE INTEGER NOT NULL,
-	CNT INTEGER NOT NULL CHECK(CNT>=0)
+	CNT INTEGER NOT NULL CHECK(CNT>=0),
+	PUBLISHER VARCHAR(255) NOT NULL DEFAULT '',
+	PUB_YEAR INTEGER NOT NULL DEFAULT 0 CHECK(PUB_YEAR>=0),
+	EDITION VARCHAR(64) NOT NULL DEFAULT '',
+	LANG VARCHAR(32) NOT NULL DEFAULT '',
+	PAGES INTEGER NOT NULL DEFAULT 0 CHECK(PAGES>=0),
+	SUMMARY VARCHAR(4000) NOT NULL DEFAULT '',
+	-- 版本号, 每次修改加一, 用于乐观锁
+	VER INTEGER NOT NULL DEFAULT 1,
+	-- 状态: 在架(active)或已下架(withdrawn), 下架的图书不可借阅和搜索, 但保留历史
+	STATUS VARCHAR(16) NOT NULL DEFAULT 'active' CHECK(STATUS IN ('active','withdrawn')),
+	WITHDRAWN_REASON VARCHAR(255),
+	WITHDRAWN_AT DATETIME,
+	-- 中图法分类号, 杜威十进分类号, 索书号, 以及排架位置
+	CLC VARCHAR(32) NOT NULL DEFAULT '',
+	DDC VARCHAR(32) NOT NULL DEFAULT '',
+	CALL_NO VARCHAR(64) NOT NULL DEFAULT '',
+	SHELF VARCHAR(64) NOT NULL DEFAULT '',
+	-- 所属丛书或多卷书, 以及卷次
+	SERIES_ID VARCHAR(36) REFERENCES SERIES,
+	VOLUME INTEGER NOT NULL DEFAULT 0 CHECK(VOLUME>=0),
+	-- ISBN-13, 未知时为空
+	ISBN VARCHAR(13) NOT NULL DEFAULT '',
+	-- 书目最后修改时间(UTC), 借还不计, 用于 OAI-PMH 增量收割
+	MODIFIED DATETIME NOT NULL DEFAULT GETUTCDATE(),
+	-- 入藏时间(UTC), 用于新书通报
+	ADDED DATETIME NOT NULL DEFAULT GETUTCDATE(),
+	-- 封面图片的SHA-256, 无封面时为NULL; 各尺寸的缩略图存放于附件存储中
+	COVER CHAR(64),
+	-- 书名和作者的全拼与拼音首字母, 用于拼音搜索
+	NAME_PY VARCHAR(1024),
+	NAME_INITIALS VARCHAR(255),
+	AUTHOR_PY VARCHAR(1024),
+	AUTHOR_INITIALS VARCHAR(255)
+);
+
+-- 图书主题词表
+CREATE TABLE BOOK_SUBJECTS (
+	ID VARCHAR(36) NOT NULL,
+	SEQ INTEGER NOT NULL,
+	SUBJECT VARCHAR(255) NOT NULL,
+	PRIMARY KEY (ID,SEQ),
+	FOREIGN KEY (ID) REFERENCES BOOKS ON DELETE CASCADE
+);
+
+-- 图书责任者(作者, 编者, 译者)表
+CREATE TABLE BOOK_CONTRIBUTORS (
+	ID VARCHAR(36) NOT NULL,
+	SEQ INTEGER NOT NULL,
+	"NAME" VARCHAR(255) NOT NULL,
+	"ROLE" VARCHAR(16) NOT NULL CHECK("ROLE" IN ('author','editor','translator')),
+	PRIMARY KEY (ID,SEQ),
+	FOREIGN KEY (ID) REFERENCES BOOKS ON DELETE CASCADE
+);
+
+-- 图书修改历史表
+CREATE TABLE BOOK_HISTORY (
+	HID INTEGER IDENTITY PRIMARY KEY,
+	ID VARCHAR(36) NOT NULL,
+	VER INTEGER NOT NULL,
+	CHANGED DATETIME NOT NULL,
+	CHANGED_BY VARCHAR(64) NOT NULL,
+	FIELD VARCHAR(32) NOT NULL,
+	OLD_VAL VARCHAR(MAX) NOT NULL,
+	NEW_VAL VARCHAR(MAX) NOT NULL
+);
+
+-- 已删除(被合并)图书表, 供 OAI-PMH 报告删除
+CREATE TABLE DELETED_BOOKS (
+	ID VARCHAR(36) PRIMARY KEY,
+	DELETED DATETIME NOT NULL,
+	CLC VARCHAR(32) NOT NULL DEFAULT '',
+	SERIES_ID VARCHAR(36),
+	-- 合并到的图书
+	MERGED_INTO VARCHAR(36)
 );
 
 -- 借书记录表
@@ -44,6 +129,183 @@ CREATE TABLE RECORDS (
 	FOREIGN KEY (USERNAME) REFERENCES READERS,
 	FOREIGN KEY (ID) REFERENCES BOOKS
 );
+
+-- 多卷书整套预约表, 各分卷都有空闲副本时预约就绪, 副本为预约者保留到过期
+CREATE TABLE SET_HOLDS (
+	HID INTEGER IDENTITY PRIMARY KEY,
+	USERNAME VARCHAR(64) NOT NULL,
+	SERIES_ID VARCHAR(36) NOT NULL,
+	PLACED DATETIME NOT NULL,
+	STATUS VARCHAR(16) NOT NULL DEFAULT 'waiting' CHECK(STATUS IN ('waiting','ready','fulfilled','cancelled','expired')),
+	READY_AT DATETIME,
+	EXPIRES DATETIME,
+	FOREIGN KEY (USERNAME) REFERENCES READERS ON DELETE CASCADE,
+	FOREIGN KEY (SERIES_ID) REFERENCES SERIES
+);
+
+-- 借阅历史表(已归还的借阅)
+CREATE TABLE LOAN_HISTORY (
+	LID INTEGER IDENTITY PRIMARY KEY,
+	USERNAME VARCHAR(64) NOT NULL,
+	ID VARCHAR(36) NOT NULL,
+	BORROWED DATETIME NOT NULL,
+	RETURNED DATETIME NOT NULL
+);
+
+-- 读者评分与书评表, 书评需经管理员审核后才公开
+CREATE TABLE REVIEWS (
+	USERNAME VARCHAR(64) NOT NULL,
+	ID VARCHAR(36) NOT NULL,
+	RATING INTEGER NOT NULL CHECK(RATING>=1 AND RATING<=5),
+	CONTENT VARCHAR(4000) NOT NULL DEFAULT '',
+	STATUS VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK(STATUS IN ('pending','approved','rejected')),
+	CREATED DATETIME NOT NULL,
+	UPDATED DATETIME NOT NULL,
+	PRIMARY KEY (USERNAME,ID),
+	FOREIGN KEY (USERNAME) REFERENCES READERS ON DELETE CASCADE,
+	FOREIGN KEY (ID) REFERENCES BOOKS ON DELETE CASCADE
+);
+
+-- 读者标签表
+CREATE TABLE BOOK_TAGS (
+	USERNAME VARCHAR(64) NOT NULL,
+	ID VARCHAR(36) NOT NULL,
+	TAG VARCHAR(96) NOT NULL,
+	PRIMARY KEY (USERNAME,ID,TAG),
+	FOREIGN KEY (USERNAME) REFERENCES READERS ON DELETE CASCADE,
+	FOREIGN KEY (ID) REFERENCES BOOKS ON DELETE CASCADE
+);
+
+-- 供应商表
+CREATE TABLE VENDORS (
+	ID VARCHAR(36) PRIMARY KEY,
+	"NAME" VARCHAR(255) NOT NULL,
+	CONTACT VARCHAR(64) NOT NULL DEFAULT '',
+	PHONE VARCHAR(32) NOT NULL DEFAULT '',
+	EMAIL VARCHAR(255) NOT NULL DEFAULT '',
+	NOTE VARCHAR(1024) NOT NULL DEFAULT ''
+);
+
+-- 经费表, 预算单位为分, 预留(encumbrance)和支出(expenditure)由订单明细计算
+CREATE TABLE FUNDS (
+	ID VARCHAR(36) PRIMARY KEY,
+	"NAME" VARCHAR(255) NOT NULL,
+	FISCAL_YEAR INTEGER NOT NULL,
+	BUDGET BIGINT NOT NULL CHECK(BUDGET>=0)
+);
+
+-- 订单表, 进行中(open)的订单预留经费, 完成(closed)或取消(cancelled)后释放未到货部分
+CREATE TABLE PURCHASE_ORDERS (
+	OID INTEGER IDENTITY PRIMARY KEY,
+	VENDOR_ID VARCHAR(36) NOT NULL REFERENCES VENDORS,
+	FUND_ID VARCHAR(36) NOT NULL REFERENCES FUNDS,
+	STATUS VARCHAR(16) NOT NULL DEFAULT 'open' CHECK(STATUS IN ('open','closed','cancelled')),
+	CREATED DATETIME NOT NULL,
+	CREATED_BY VARCHAR(64) NOT NULL,
+	NOTE VARCHAR(1024) NOT NULL DEFAULT ''
+);
+
+-- 订单明细表, 图书可能尚未入藏, 故不引用BOOKS; 预估单价和实付金额单位为分
+CREATE TABLE ORDER_LINES (
+	OID INTEGER NOT NULL REFERENCES PURCHASE_ORDERS ON DELETE CASCADE,
+	SEQ INTEGER NOT NULL,
+	BOOK_ID VARCHAR(36) NOT NULL,
+	"NAME" VARCHAR(255) NOT NULL,
+	AUTHOR VARCHAR(255) NOT NULL,
+	ISBN VARCHAR(13) NOT NULL DEFAULT '',
+	QTY INTEGER NOT NULL CHECK(QTY>0),
+	EST_PRICE BIGINT NOT NULL CHECK(EST_PRICE>=0),
+	RECEIVED INTEGER NOT NULL DEFAULT 0 CHECK(RECEIVED>=0),
+	SPENT BIGINT NOT NULL DEFAULT 0 CHECK(SPENT>=0),
+	PRIMARY KEY (OID,SEQ),
+	CHECK(RECEIVED<=QTY)
+);
+
+-- 期刊订阅表, 出版频率为weekly, monthly或quarterly; START_DATE为第一期的预计到刊日期
+CREATE TABLE SUBSCRIPTIONS (
+	SID VARCHAR(36) PRIMARY KEY,
+	TITLE VARCHAR(255) NOT NULL,
+	ISSN VARCHAR(9) NOT NULL DEFAULT '',
+	PUBLISHER VARCHAR(255) NOT NULL DEFAULT '',
+	VENDOR_ID VARCHAR(36) REFERENCES VENDORS,
+	FREQUENCY VARCHAR(16) NOT NULL CHECK(FREQUENCY IN ('weekly','monthly','quarterly')),
+	START_DATE DATE NOT NULL,
+	END_DATE DATE,
+	FIRST_NUMBER INTEGER NOT NULL DEFAULT 1 CHECK(FIRST_NUMBER>=0),
+	GRACE_DAYS INTEGER NOT NULL DEFAULT 14 CHECK(GRACE_DAYS>=0),
+	STATUS VARCHAR(16) NOT NULL DEFAULT 'active' CHECK(STATUS IN ('active','cancelled'))
+);
+
+-- 期刊各期表, 由出版频率预测生成; 到刊后可作为图书入藏以供借阅, ITEM_ID为其书号
+CREATE TABLE SERIAL_ISSUES (
+	SID VARCHAR(36) NOT NULL REFERENCES SUBSCRIPTIONS ON DELETE CASCADE,
+	SEQ INTEGER NOT NULL,
+	"NUMBER" INTEGER NOT NULL,
+	EXPECTED DATE NOT NULL,
+	STATUS VARCHAR(16) NOT NULL DEFAULT 'expected' CHECK(STATUS IN ('expected','late','received','missing')),
+	RECEIVED DATETIME,
+	ITEM_ID VARCHAR(36),
+	CLAIMS INTEGER NOT NULL DEFAULT 0 CHECK(CLAIMS>=0),
+	LAST_CLAIMED DATETIME,
+	PRIMARY KEY (SID,SEQ)
+);
+
+-- 附件表, 文件存放于本地目录或对象存储; ACCESS为loan时仅借阅期内的读者可下载, 有此类附件的书为电子书, 借阅到期自动归还
+CREATE TABLE ATTACHMENTS (
+	AID INTEGER IDENTITY PRIMARY KEY,
+	ID VARCHAR(36) NOT NULL REFERENCES BOOKS,
+	FILENAME NVARCHAR(255) NOT NULL,
+	MIME VARCHAR(128) NOT NULL,
+	SIZE BIGINT NOT NULL CHECK(SIZE>=0),
+	SHA256 CHAR(64) NOT NULL,
+	STORE_KEY VARCHAR(512) NOT NULL UNIQUE,
+	ACCESS VARCHAR(16) NOT NULL DEFAULT 'loan' CHECK(ACCESS IN ('loan','public')),
+	UPLOADED DATETIME NOT NULL,
+	UPLOADED_BY VARCHAR(64) NOT NULL
+);
+
+-- 会话表, 仅当会话存储(SessionStore)为db时使用, 可供多个服务实例共享; 只存令牌的SHA-256(小写十六进制), 不存令牌本身
+CREATE TABLE SESSIONS (
+	TOKEN_HASH CHAR(64) PRIMARY KEY,
+	USERNAME VARCHAR(64) NOT NULL,
+	IS_ADMIN BIT NOT NULL,
+	CREATED DATETIME NOT NULL,
+	EXPIRES DATETIME NOT NULL,
+	LAST_SEEN DATETIME NOT NULL,
+	REMEMBER BIT NOT NULL DEFAULT 0,
+	IP VARCHAR(64),
+	USER_AGENT NVARCHAR(512)
+);
+
+-- 令牌吊销表, 仅当令牌模式(TokenMode)为signed时使用; 吊销单个令牌(JTI), 或吊销某用户(USERNAME, 角色ROLE)或所有人在ISSUED_BEFORE前签发的令牌; 过期(EXPIRES)后可删除
+CREATE TABLE TOKEN_REVOCATIONS (
+	RID INTEGER IDENTITY PRIMARY KEY,
+	JTI VARCHAR(64),
+	USERNAME VARCHAR(64),
+	"ROLE" VARCHAR(16) CHECK("ROLE" IN ('admin','reader')),
+	ISSUED_BEFORE DATETIME2(3),
+	EXPIRES DATETIME NOT NULL,
+	CHECK(JTI IS NOT NULL OR ISSUED_BEFORE IS NOT NULL)
+);
+
+-- 盘点表, 状态为进行中(open), 已修正(applied)或已结束(closed)
+CREATE TABLE INVENTORY_SESSIONS (
+	IID INTEGER IDENTITY PRIMARY KEY,
+	"NAME" VARCHAR(255) NOT NULL,
+	CREATED DATETIME NOT NULL,
+	CREATED_BY VARCHAR(64) NOT NULL,
+	STATUS VARCHAR(16) NOT NULL DEFAULT 'open' CHECK(STATUS IN ('open','applied','closed')),
+	FINISHED DATETIME
+);
+
+-- 盘点扫描表, 各区域(书架位置)扫描到的书号及册数; 书号可能不存在, 故不引用BOOKS
+CREATE TABLE INVENTORY_SCANS (
+	IID INTEGER NOT NULL REFERENCES INVENTORY_SESSIONS ON DELETE CASCADE,
+	SECTION VARCHAR(64) NOT NULL,
+	ID VARCHAR(36) NOT NULL,
+	CNT INTEGER NOT NULL CHECK(CNT>0),
+	PRIMARY KEY (IID,SECTION,ID)
+);
 GO
 
 -- "逾期未还读者"视图
@@ -153,8 +415,29 @@ GO
 -- 为书名, 书作者, 读者姓名, 以及管理员姓名创建索引
 CREATE INDEX INDEX_BOOKS_NAME ON BOOKS("NAME")
 CREATE INDEX INDEX_BOOKS_AUTHOR ON BOOKS("AUTHOR")
+CREATE INDEX INDEX_BOOKS_NAME_PY ON BOOKS(NAME_PY)
+CREATE INDEX INDEX_BOOKS_AUTHOR_PY ON BOOKS(AUTHOR_PY)
+CREATE INDEX INDEX_BOOKS_CLC ON BOOKS(CLC)
+CREATE INDEX INDEX_BOOKS_DDC ON BOOKS(DDC)
+CREATE INDEX INDEX_BOOKS_ISBN ON BOOKS(ISBN)
+CREATE INDEX INDEX_BOOKS_MODIFIED ON BOOKS(MODIFIED)
+CREATE INDEX INDEX_DELETED_BOOKS_DELETED ON DELETED_BOOKS(DELETED)
+CREATE INDEX INDEX_BOOKS_ADDED ON BOOKS(ADDED)
+CREATE INDEX INDEX_BOOK_HISTORY_ID ON BOOK_HISTORY(ID)
+CREATE INDEX INDEX_SET_HOLDS_SERIES_ID ON SET_HOLDS(SERIES_ID)
+CREATE INDEX INDEX_LOAN_HISTORY_USERNAME ON LOAN_HISTORY(USERNAME)
+CREATE INDEX INDEX_LOAN_HISTORY_ID ON LOAN_HISTORY(ID)
+CREATE INDEX INDEX_ORDER_LINES_BOOK_ID ON ORDER_LINES(BOOK_ID)
+CREATE INDEX INDEX_PURCHASE_ORDERS_FUND_ID ON PURCHASE_ORDERS(FUND_ID)
+CREATE INDEX INDEX_SESSIONS_USERNAME ON SESSIONS(USERNAME)
+CREATE INDEX INDEX_SESSIONS_EXPIRES ON SESSIONS(EXPIRES)
+CREATE INDEX INDEX_ATTACHMENTS_ID ON ATTACHMENTS(ID)
+CREATE INDEX INDEX_SERIAL_ISSUES_STATUS ON SERIAL_ISSUES(STATUS)
+CREATE INDEX INDEX_SERIAL_ISSUES_ITEM_ID ON SERIAL_ISSUES(ITEM_ID)
 CREATE INDEX INDEX_READERS_NAME ON READERS("NAME")
 CREATE INDEX INDEX_ADMINS_NAME ON ADMINS("NAME")
+CREATE INDEX INDEX_TOKEN_REVOCATIONS_EXPIRES ON TOKEN_REVOCATIONS(EXPIRES)
+CREATE UNIQUE INDEX INDEX_TOKEN_REVOCATIONS_JTI ON TOKEN_REVOCATIONS(JTI) WHERE JTI IS NOT NULL
 GO
 
 -- 创建专用用户并给予数据库所有者角色
@@ -0,0 +1,591 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 21:12:40
+ * @LastEditTime: 2026-10-20 01:49:35
+ * @LastEditors: FunctionSir
+ * @Description: OAI-PMH 2.0 data provider of books.
+ * @FilePath: /biblio-matrix/oai.go
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const OaiNs = "http://www.openarchives.org/OAI/2.0/"
+const OaiDcNs = "http://www.openarchives.org/OAI/2.0/oai_dc/"
+
+// How many records or headers are in one response of a list.
+const OaiPageSize = 100
+
+const oaiDatestamp = "2006-01-02T15:04:05Z"
+const oaiDate = "2006-01-02"
+
+// Set by the conf, see loadConf.
+var OaiRepoName string
+var OaiRepoId string // Namespace of identifiers, like "library.example.edu"
+var OaiAdminEmail string
+
+type OaiFormat struct {
+	Prefix    string `xml:"metadataPrefix"`
+	Schema    string `xml:"schema"`
+	Namespace string `xml:"metadataNamespace"`
+}
+
+var OaiFormats = []OaiFormat{
+	{"oai_dc", "http://www.openarchives.org/OAI/2.0/oai_dc.xsd", OaiDcNs},
+	{"marc21", "http://www.loc.gov/standards/marcxml/schema/MARC21slim.xsd", MarcNs},
+}
+
+type OaiRequest struct {
+	Verb            string `xml:"verb,attr,omitempty"`
+	Identifier      string `xml:"identifier,attr,omitempty"`
+	MetadataPrefix  string `xml:"metadataPrefix,attr,omitempty"`
+	From            string `xml:"from,attr,omitempty"`
+	Until           string `xml:"until,attr,omitempty"`
+	Set             string `xml:"set,attr,omitempty"`
+	ResumptionToken string `xml:"resumptionToken,attr,omitempty"`
+	BaseUrl         string `xml:",chardata"`
+}
+
+type OaiError struct {
+	Code    string `xml:"code,attr"`
+	Message string `xml:",chardata"`
+}
+
+type OaiIdentify struct {
+	RepositoryName    string `xml:"repositoryName"`
+	BaseUrl           string `xml:"baseURL"`
+	ProtocolVersion   string `xml:"protocolVersion"`
+	AdminEmail        string `xml:"adminEmail"`
+	EarliestDatestamp string `xml:"earliestDatestamp"`
+	DeletedRecord     string `xml:"deletedRecord"`
+	Granularity       string `xml:"granularity"`
+}
+
+type OaiSet struct {
+	Spec string `xml:"setSpec"`
+	Name string `xml:"setName"`
+}
+
+type OaiHeader struct {
+	Status     string   `xml:"status,attr,omitempty"` // "deleted" for withdrawn and merged books
+	Identifier string   `xml:"identifier"`
+	Datestamp  string   `xml:"datestamp"`
+	SetSpecs   []string `xml:"setSpec"`
+}
+
+type OaiMetadata struct {
+	Xml string `xml:",innerxml"`
+}
+
+type OaiRecord struct {
+	Header   OaiHeader    `xml:"header"`
+	Metadata *OaiMetadata `xml:"metadata,omitempty"`
+}
+
+type OaiResumptionToken struct {
+	CompleteListSize int    `xml:"completeListSize,attr"`
+	Cursor           int    `xml:"cursor,attr"`
+	Value            string `xml:",chardata"`
+}
+
+// Body of ListIdentifiers and ListRecords.
+type OaiList struct {
+	Headers []OaiHeader         `xml:"header"`
+	Records []OaiRecord         `xml:"record"`
+	Token   *OaiResumptionToken `xml:"resumptionToken,omitempty"`
+}
+
+type OaiResponse struct {
+	XMLName             xml.Name     `xml:"http://www.openarchives.org/OAI/2.0/ OAI-PMH"`
+	Xsi                 string       `xml:"xmlns:xsi,attr"`
+	SchemaLocation      string       `xml:"xsi:schemaLocation,attr"`
+	ResponseDate        string       `xml:"responseDate"`
+	Request             OaiRequest   `xml:"request"`
+	Errors              []OaiError   `xml:"error"`
+	Identify            *OaiIdentify `xml:"Identify,omitempty"`
+	ListMetadataFormats *struct {
+		Formats []OaiFormat `xml:"metadataFormat"`
+	} `xml:"ListMetadataFormats,omitempty"`
+	ListSets *struct {
+		Sets []OaiSet `xml:"set"`
+	} `xml:"ListSets,omitempty"`
+	GetRecord *struct {
+		Record OaiRecord `xml:"record"`
+	} `xml:"GetRecord,omitempty"`
+	ListIdentifiers *OaiList `xml:"ListIdentifiers,omitempty"`
+	ListRecords     *OaiList `xml:"ListRecords,omitempty"`
+}
+
+func OaiIdentifier(bookId string) string {
+	return "oai:" + OaiRepoId + ":" + bookId
+}
+
+// Get the book ID of an OAI identifier, false if it is not of this repository.
+func oaiBookId(identifier string) (string, bool) {
+	return strings.CutPrefix(identifier, "oai:"+OaiRepoId+":")
+}
+
+// Sets a book is in, by the main class of CLC and by the series.
+func oaiSetSpecs(b Book) []string {
+	specs := make([]string, 0)
+	if b.Clc != "" {
+		if _, ok := ClcMainClasses[b.Clc[:1]]; ok {
+			specs = append(specs, "clc", "clc:"+b.Clc[:1])
+		}
+	}
+	if b.Series != "" {
+		specs = append(specs, "series", "series:"+b.Series)
+	}
+	return specs
+}
+
+func oaiHeader(b Book) OaiHeader {
+	header := OaiHeader{Identifier: OaiIdentifier(b.Id), Datestamp: b.Modified.UTC().Format(oaiDatestamp), SetSpecs: oaiSetSpecs(b)}
+	if b.Status != "active" {
+		header.Status = "deleted"
+	}
+	return header
+}
+
+func oaiRecord(b Book, prefix string) OaiRecord {
+	record := OaiRecord{Header: oaiHeader(b)}
+	if record.Header.Status == "deleted" {
+		return record
+	}
+	if prefix == "marc21" {
+		record.Metadata = &OaiMetadata{Xml: BookToMarcXML(b)}
+	} else {
+		record.Metadata = &OaiMetadata{Xml: BookToDublinCore(b, "oai_dc:dc", OaiDcNs)}
+	}
+	return record
+}
+
+func oaiSupportsFormat(prefix string) bool {
+	return slices.ContainsFunc(OaiFormats, func(f OaiFormat) bool { return f.Prefix == prefix })
+}
+
+// Parse a datestamp of day or seconds granularity, the bool is true for days.
+func parseOaiDatestamp(s string) (time.Time, bool, error) {
+	if t, err := time.Parse(oaiDate, s); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(oaiDatestamp, s)
+	return t, false, err
+}
+
+// Books and tombstones of books merged into others, which are not in BOOKS
+// anymore but still reported as deleted. A tombstone of an ID used again is
+// hidden by the new book.
+const oaiItems = "(SELECT ID,MODIFIED,CLC,SERIES_ID,0 AS GONE FROM BOOKS UNION ALL " +
+	"SELECT ID,DELETED,CLC,SERIES_ID,1 FROM DELETED_BOOKS D WHERE NOT EXISTS (SELECT * FROM BOOKS B WHERE B.ID=D.ID)) AS ITEMS"
+
+// A tombstone as a book of status "deleted", with only what headers need.
+func getDeletedBook(bookId string) (Book, error) {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "SELECT ID,DELETED,CLC,SERIES_ID FROM DELETED_BOOKS WHERE ID=?")
+	b := Book{Status: "deleted"}
+	var series sql.NullString
+	err := stmt.QueryRow(bookId).Scan(&b.Id, &b.Modified, &b.Clc, &series)
+	b.Series = series.String
+	return b, err
+}
+
+// Get a book or its tombstone, sql.ErrNoRows if neither exists.
+func getOaiBook(bookId string) (Book, error) {
+	book, err := GetBookInfo(bookId)
+	if err == sql.ErrNoRows {
+		return getDeletedBook(bookId)
+	}
+	return book, err
+}
+
+// Arguments of ListIdentifiers and ListRecords, which are kept in
+// resumption tokens, with the position of the last record sent.
+type oaiListArgs struct {
+	Prefix, From, Until, Set string
+	LastModified             time.Time
+	LastId                   string
+	Cursor                   int
+}
+
+func (a oaiListArgs) token() string {
+	fields := []string{a.Prefix, a.From, a.Until, a.Set, a.LastModified.Format(time.RFC3339Nano), a.LastId, strconv.Itoa(a.Cursor)}
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(fields, "\x00")))
+}
+
+func parseOaiToken(token string) (oaiListArgs, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return oaiListArgs{}, false
+	}
+	fields := strings.Split(string(raw), "\x00")
+	if len(fields) != 7 {
+		return oaiListArgs{}, false
+	}
+	args := oaiListArgs{Prefix: fields[0], From: fields[1], Until: fields[2], Set: fields[3], LastId: fields[5]}
+	args.LastModified, err = time.Parse(time.RFC3339Nano, fields[4])
+	if err != nil {
+		return oaiListArgs{}, false
+	}
+	args.Cursor, err = strconv.Atoi(fields[6])
+	if err != nil || args.Cursor < 0 || !oaiSupportsFormat(args.Prefix) {
+		return oaiListArgs{}, false
+	}
+	return args, true
+}
+
+// Make the WHERE clause of a list, without the position of the last record.
+func (a oaiListArgs) filter() (string, []any, *OaiError) {
+	where := "1=1"
+	args := make([]any, 0)
+	var fromDay, untilDay bool
+	if a.From != "" {
+		from, day, err := parseOaiDatestamp(a.From)
+		if err != nil {
+			return "", nil, &OaiError{"badArgument", "非法的 from 参数."}
+		}
+		fromDay = day
+		where += " AND MODIFIED>=CAST(? AS DATETIME)"
+		args = append(args, from)
+	}
+	if a.Until != "" {
+		until, day, err := parseOaiDatestamp(a.Until)
+		if err != nil {
+			return "", nil, &OaiError{"badArgument", "非法的 until 参数."}
+		}
+		if a.From != "" && (day != fromDay || a.From > a.Until) {
+			return "", nil, &OaiError{"badArgument", "from 与 until 的粒度不同或 from 晚于 until."}
+		}
+		untilDay = day
+		// Until is inclusive, to the end of the day or the second.
+		if untilDay {
+			until = until.Add(24 * time.Hour)
+		} else {
+			until = until.Add(time.Second)
+		}
+		where += " AND MODIFIED<CAST(? AS DATETIME)"
+		args = append(args, until)
+	}
+	if a.Set != "" {
+		top, spec, hasSpec := strings.Cut(a.Set, ":")
+		switch {
+		case top == "clc" && !hasSpec:
+			where += " AND CLC<>''"
+		case top == "clc" && len(spec) == 1:
+			where += " AND CLC LIKE ?"
+			args = append(args, spec+"%")
+		case top == "series" && !hasSpec:
+			where += " AND SERIES_ID IS NOT NULL"
+		case top == "series":
+			where += " AND SERIES_ID=?"
+			args = append(args, spec)
+		default:
+			where += " AND 1=0"
+		}
+	}
+	return where, args, nil
+}
+
+// List a page of books of a list, with the token of the next page, which is
+// empty if this is the last page. Errors of the DB are returned as error.
+func oaiListBooks(a oaiListArgs, resumed bool) ([]Book, *OaiResumptionToken, *OaiError, error) {
+	where, args, oaiErr := a.filter()
+	if oaiErr != nil {
+		return nil, nil, oaiErr, nil
+	}
+	db := DbOpen(DbConn)
+	row := db.QueryRow("SELECT COUNT(*) FROM "+oaiItems+" WHERE "+where, args...)
+	var total int
+	err := row.Scan(&total)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if resumed {
+		where += " AND (MODIFIED>CAST(? AS DATETIME) OR (MODIFIED=CAST(? AS DATETIME) AND ID>?))"
+		args = append(args, a.LastModified, a.LastModified, a.LastId)
+	}
+	rows, err := db.Query("SELECT ID,MODIFIED,CLC,SERIES_ID,GONE FROM "+oaiItems+" WHERE "+where+" ORDER BY MODIFIED,ID OFFSET 0 ROWS FETCH NEXT ? ROWS ONLY",
+		append(args, OaiPageSize)...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	books := make([]Book, 0)
+	for rows.Next() {
+		b := Book{Status: "deleted"}
+		var series sql.NullString
+		var gone bool
+		if err = rows.Scan(&b.Id, &b.Modified, &b.Clc, &series, &gone); err != nil {
+			rows.Close()
+			return nil, nil, nil, err
+		}
+		b.Series = series.String
+		if !gone {
+			b.Status = ""
+		}
+		books = append(books, b)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(books) == 0 {
+		if resumed {
+			return nil, nil, &OaiError{"badResumptionToken", "恢复令牌已失效."}, nil
+		}
+		return nil, nil, &OaiError{"noRecordsMatch", "没有符合条件的记录."}, nil
+	}
+	// Replace items of books in BOOKS with the whole books.
+	ids := make([]any, 0, len(books))
+	for _, b := range books {
+		if b.Status == "" {
+			ids = append(ids, b.Id)
+		}
+	}
+	if len(ids) > 0 {
+		found, err := QueryBooks("ID IN ("+Placeholders(len(ids))+")", ids...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		idx := make(map[string]Book, len(found))
+		for _, b := range found {
+			idx[b.Id] = b
+		}
+		for i := range books {
+			if b, ok := idx[books[i].Id]; ok && books[i].Status == "" {
+				books[i] = b
+			}
+		}
+	}
+	var token *OaiResumptionToken
+	if a.Cursor+len(books) < total {
+		last := books[len(books)-1]
+		next := a
+		next.LastModified, next.LastId, next.Cursor = last.Modified, last.Id, a.Cursor+len(books)
+		token = &OaiResumptionToken{CompleteListSize: total, Cursor: a.Cursor, Value: next.token()}
+	} else if resumed {
+		token = &OaiResumptionToken{CompleteListSize: total, Cursor: a.Cursor}
+	}
+	return books, token, nil, nil
+}
+
+func oaiEarliestDatestamp() string {
+	db := DbOpen(DbConn)
+	row := db.QueryRow("SELECT MIN(MODIFIED) FROM " + oaiItems)
+	var earliest *time.Time
+	if row.Scan(&earliest) != nil || earliest == nil {
+		return time.Now().UTC().Format(oaiDatestamp)
+	}
+	return earliest.UTC().Format(oaiDatestamp)
+}
+
+func oaiSets() ([]OaiSet, error) {
+	sets := []OaiSet{{"clc", "中国图书馆分类法"}}
+	classes := make([]string, 0, len(ClcMainClasses))
+	for class := range ClcMainClasses {
+		classes = append(classes, class)
+	}
+	slices.Sort(classes)
+	for _, class := range classes {
+		sets = append(sets, OaiSet{"clc:" + class, ClcMainClasses[class]})
+	}
+	series, err := ListSeries()
+	if err != nil {
+		return nil, err
+	}
+	sets = append(sets, OaiSet{"series", "丛书与多卷书"})
+	for _, s := range series {
+		sets = append(sets, OaiSet{"series:" + s.Id, s.Name})
+	}
+	return sets, nil
+}
+
+// Arguments allowed by every verb, true for required ones.
+var oaiVerbArgs = map[string]map[string]bool{
+	"Identify":            {},
+	"ListMetadataFormats": {"identifier": false},
+	"ListSets":            {"resumptionToken": false},
+	"GetRecord":           {"identifier": true, "metadataPrefix": true},
+	"ListIdentifiers":     {"metadataPrefix": true, "from": false, "until": false, "set": false, "resumptionToken": false},
+	"ListRecords":         {"metadataPrefix": true, "from": false, "until": false, "set": false, "resumptionToken": false},
+}
+
+// Check arguments of a request, a resumption token must be the only argument.
+func checkOaiArgs(form map[string][]string) *OaiError {
+	verb := form["verb"][0]
+	allowed := oaiVerbArgs[verb]
+	for key, values := range form {
+		if key == "verb" {
+			continue
+		}
+		if _, ok := allowed[key]; !ok {
+			return &OaiError{"badArgument", "非法参数: " + key}
+		}
+		if len(values) != 1 {
+			return &OaiError{"badArgument", "参数重复: " + key}
+		}
+	}
+	if _, ok := form["resumptionToken"]; ok {
+		if len(form) != 2 {
+			return &OaiError{"badArgument", "resumptionToken 必须是唯一的参数."}
+		}
+		return nil
+	}
+	for key, required := range allowed {
+		if _, ok := form[key]; required && !ok {
+			return &OaiError{"badArgument", "缺少参数: " + key}
+		}
+	}
+	return nil
+}
+
+func oaiBaseUrl(r *http.Request) string {
+	return hostUrl(r) + r.URL.Path
+}
+
+// Serve OAI-PMH requests by GET or POST.
+func oaiHandler(w http.ResponseWriter, r *http.Request) {
+	res := OaiResponse{Xsi: "http://www.w3.org/2001/XMLSchema-instance",
+		SchemaLocation: OaiNs + " http://www.openarchives.org/OAI/2.0/OAI-PMH.xsd",
+		ResponseDate:   time.Now().UTC().Format(oaiDatestamp), Request: OaiRequest{BaseUrl: oaiBaseUrl(r)}}
+	// Failures of the DB are not errors of the request, so they are not
+	// reported as OAI errors, which harvesters would take as final.
+	internalErr := false
+	defer func() {
+		if internalErr {
+			http.Error(w, "无法完成查询. 请联系管理员.", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "text/xml; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(xml.Header))
+		xml.NewEncoder(w).Encode(res)
+	}()
+	fail := func(code, message string) {
+		res.Errors = append(res.Errors, OaiError{code, message})
+	}
+	if r.ParseForm() != nil {
+		fail("badArgument", "无法解析请求.")
+		return
+	}
+	form := r.Form
+	verbs, ok := form["verb"]
+	if !ok || len(verbs) != 1 || oaiVerbArgs[verbs[0]] == nil {
+		fail("badVerb", "非法或缺少 verb 参数.")
+		return
+	}
+	if oaiErr := checkOaiArgs(form); oaiErr != nil {
+		res.Errors = append(res.Errors, *oaiErr)
+		return
+	}
+	res.Request = OaiRequest{Verb: verbs[0], Identifier: form.Get("identifier"), MetadataPrefix: form.Get("metadataPrefix"),
+		From: form.Get("from"), Until: form.Get("until"), Set: form.Get("set"), ResumptionToken: form.Get("resumptionToken"),
+		BaseUrl: res.Request.BaseUrl}
+	switch verbs[0] {
+	case "Identify":
+		res.Identify = &OaiIdentify{RepositoryName: OaiRepoName, BaseUrl: res.Request.BaseUrl, ProtocolVersion: "2.0",
+			AdminEmail: OaiAdminEmail, EarliestDatestamp: oaiEarliestDatestamp(), DeletedRecord: "persistent",
+			Granularity: "YYYY-MM-DDThh:mm:ssZ"}
+	case "ListMetadataFormats":
+		if identifier := form.Get("identifier"); identifier != "" {
+			bookId, ok := oaiBookId(identifier)
+			if ok {
+				_, err := getOaiBook(bookId)
+				if err != nil && err != sql.ErrNoRows {
+					internalErr = true
+					return
+				}
+				ok = err == nil
+			}
+			if !ok {
+				fail("idDoesNotExist", "记录不存在: "+identifier)
+				return
+			}
+		}
+		res.ListMetadataFormats = &struct {
+			Formats []OaiFormat `xml:"metadataFormat"`
+		}{OaiFormats}
+	case "ListSets":
+		if form.Get("resumptionToken") != "" {
+			fail("badResumptionToken", "集合列表不分页.")
+			return
+		}
+		sets, err := oaiSets()
+		if err != nil {
+			internalErr = true
+			return
+		}
+		res.ListSets = &struct {
+			Sets []OaiSet `xml:"set"`
+		}{sets}
+	case "GetRecord":
+		prefix := form.Get("metadataPrefix")
+		if !oaiSupportsFormat(prefix) {
+			fail("cannotDisseminateFormat", "不支持的元数据格式: "+prefix)
+			return
+		}
+		bookId, ok := oaiBookId(form.Get("identifier"))
+		var book Book
+		var err error
+		if ok {
+			book, err = getOaiBook(bookId)
+		}
+		if ok && err != nil && err != sql.ErrNoRows {
+			internalErr = true
+			return
+		}
+		if !ok || err != nil {
+			fail("idDoesNotExist", "记录不存在: "+form.Get("identifier"))
+			return
+		}
+		res.GetRecord = &struct {
+			Record OaiRecord `xml:"record"`
+		}{oaiRecord(book, prefix)}
+	case "ListIdentifiers", "ListRecords":
+		args := oaiListArgs{Prefix: form.Get("metadataPrefix"), From: form.Get("from"), Until: form.Get("until"), Set: form.Get("set")}
+		resumed := form.Get("resumptionToken") != ""
+		if resumed {
+			args, ok = parseOaiToken(form.Get("resumptionToken"))
+			if !ok {
+				fail("badResumptionToken", "非法的恢复令牌.")
+				return
+			}
+		} else if !oaiSupportsFormat(args.Prefix) {
+			fail("cannotDisseminateFormat", "不支持的元数据格式: "+args.Prefix)
+			return
+		}
+		books, token, oaiErr, err := oaiListBooks(args, resumed)
+		if err != nil {
+			internalErr = true
+			return
+		}
+		if oaiErr != nil {
+			res.Errors = append(res.Errors, *oaiErr)
+			return
+		}
+		list := &OaiList{Token: token}
+		for _, book := range books {
+			if verbs[0] == "ListIdentifiers" {
+				list.Headers = append(list.Headers, oaiHeader(book))
+			} else {
+				list.Records = append(list.Records, oaiRecord(book, args.Prefix))
+			}
+		}
+		if verbs[0] == "ListIdentifiers" {
+			res.ListIdentifiers = list
+		} else {
+			res.ListRecords = list
+		}
+	}
+}
@@ -0,0 +1,581 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 22:03:15
+ * @LastEditTime: 2026-10-20 02:21:00
+ * @LastEditors: FunctionSir
+ * @Description: OPDS 1.2 and 2.0 catalog feeds for e-reader apps.
+ * @FilePath: /biblio-matrix/opds.go
+ */
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How many books are in one page of an acquisition feed.
+const OpdsPageSize = 50
+
+// How many books are in the feed of newest additions.
+const OpdsNewest = 100
+
+// Media types of OPDS 1.2 feeds, and of OPDS 2.0.
+const OpdsNavigationType = "application/atom+xml;profile=opds-catalog;kind=navigation"
+const OpdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+const Opds2Type = "application/opds+json"
+
+// Path prefixes of OPDS 1.2 and 2.0 feeds.
+const Opds1Prefix = "/opds"
+const Opds2Prefix = "/opds2"
+
+type opdsLink struct {
+	Rel   string
+	Href  string
+	Type  string
+	Title string
+}
+
+// An entry of a navigation feed.
+type opdsNav struct {
+	Title       string
+	Href        string
+	Acquisition bool // Whether the target is an acquisition feed
+	Content     string
+}
+
+// A feed, rendered as Atom for OPDS 1.2 or as JSON for OPDS 2.0.
+type opdsFeed struct {
+	Id      string
+	Title   string
+	Updated time.Time
+	Links   []opdsLink
+	Nav     []opdsNav
+	Books   []Book
+	Total   int // Books of all pages
+	Page    int
+}
+
+// Whether a request is for OPDS 2.0.
+func isOpds2(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, Opds2Prefix)
+}
+
+func opdsPrefix(r *http.Request) string {
+	if isOpds2(r) {
+		return Opds2Prefix
+	}
+	return Opds1Prefix
+}
+
+func hostUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// Make a feed with self, start and search links.
+func newOpdsFeed(r *http.Request, title string, acquisition bool) *opdsFeed {
+	prefix := opdsPrefix(r)
+	feed := &opdsFeed{Id: hostUrl(r) + r.URL.RequestURI(), Title: title, Updated: time.Now().UTC(), Page: 1}
+	selfType := OpdsNavigationType
+	if acquisition {
+		selfType = OpdsAcquisitionType
+	}
+	if isOpds2(r) {
+		feed.Links = []opdsLink{{"self", r.URL.RequestURI(), Opds2Type, ""}, {"start", prefix, Opds2Type, ""},
+			{"search", prefix + "/search{?query}", Opds2Type, ""}}
+	} else {
+		feed.Links = []opdsLink{{"self", r.URL.RequestURI(), selfType, ""}, {"start", prefix, OpdsNavigationType, ""},
+			{"search", prefix + "/opensearch.xml", "application/opensearchdescription+xml", ""}}
+	}
+	return feed
+}
+
+// Parse "page" of a request, 1 if absent.
+func opdsPage(r *http.Request) (int, bool) {
+	pageStr := r.FormValue("page")
+	if pageStr == "" {
+		return 1, true
+	}
+	page, err := strconv.Atoi(pageStr)
+	if err != nil || page < 1 {
+		return 0, false
+	}
+	return page, true
+}
+
+// Query a page of books not withdrawn which satisfy cond, ordered by order,
+// counting at most limit books in all pages if limit is positive. Returns
+// the page and the number of books in all pages.
+func queryOpdsPage(page int, limit int, cond string, order string, args ...any) ([]Book, int, error) {
+	db := DbOpen(DbConn)
+	var total int
+	err := db.QueryRow("SELECT COUNT(*) FROM BOOKS WHERE STATUS='active' AND "+cond, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	if limit > 0 {
+		total = min(total, limit)
+	}
+	if page-1 >= (total+OpdsPageSize-1)/OpdsPageSize {
+		return make([]Book, 0), total, nil
+	}
+	start := (page - 1) * OpdsPageSize
+	books, err := QueryBooks("STATUS='active' AND "+cond+" ORDER BY "+order+" OFFSET ? ROWS FETCH NEXT ? ROWS ONLY",
+		append(args, start, min(OpdsPageSize, total-start))...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return books, total, nil
+}
+
+// Put a page of books into an acquisition feed, with links to the previous
+// and the next pages, total is the number of books in all pages.
+func (feed *opdsFeed) setPage(r *http.Request, page int, books []Book, total int) {
+	feed.Page, feed.Total, feed.Books = page, total, books
+	pageLink := func(rel string, page int) opdsLink {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(page))
+		linkType := OpdsAcquisitionType
+		if isOpds2(r) {
+			linkType = Opds2Type
+		}
+		return opdsLink{rel, r.URL.Path + "?" + query.Encode(), linkType, ""}
+	}
+	if page > 1 {
+		feed.Links = append(feed.Links, pageLink("previous", page-1))
+	}
+	if page < (total+OpdsPageSize-1)/OpdsPageSize {
+		feed.Links = append(feed.Links, pageLink("next", page+1))
+	}
+	if len(feed.Books) > 0 {
+		feed.Updated = feed.Books[0].Modified
+		for _, b := range feed.Books {
+			if b.Modified.After(feed.Updated) {
+				feed.Updated = b.Modified
+			}
+		}
+	}
+}
+
+type atomLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	Uri  string `xml:"uri,omitempty"`
+}
+
+type atomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	Id         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Authors    []atomPerson   `xml:"author"`
+	Language   string         `xml:"dc:language,omitempty"`
+	Publisher  string         `xml:"dc:publisher,omitempty"`
+	Issued     string         `xml:"dc:issued,omitempty"`
+	Identifier string         `xml:"dc:identifier,omitempty"`
+	Categories []atomCategory `xml:"category"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    *atomText      `xml:"content,omitempty"`
+	Links      []atomLink     `xml:"link"`
+}
+
+type atomFeed struct {
+	XMLName      xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	XmlnsDc      string      `xml:"xmlns:dc,attr"`
+	XmlnsOpds    string      `xml:"xmlns:opds,attr"`
+	XmlnsOs      string      `xml:"xmlns:opensearch,attr"`
+	Id           string      `xml:"id"`
+	Title        string      `xml:"title"`
+	Updated      string      `xml:"updated"`
+	Author       atomPerson  `xml:"author"`
+	TotalResults int         `xml:"opensearch:totalResults,omitempty"`
+	ItemsPerPage int         `xml:"opensearch:itemsPerPage,omitempty"`
+	StartIndex   int         `xml:"opensearch:startIndex,omitempty"`
+	Links        []atomLink  `xml:"link"`
+	Entries      []atomEntry `xml:"entry"`
+}
+
+func authorFeedPath(prefix string, author string) string {
+	return prefix + "/author?name=" + url.QueryEscape(author)
+}
+
+func (feed *opdsFeed) atom(prefix string) atomFeed {
+	res := atomFeed{XmlnsDc: DcNs, XmlnsOpds: "http://opds-spec.org/2010/catalog", XmlnsOs: "http://a9.com/-/spec/opensearch/1.1/",
+		Id: feed.Id, Title: feed.Title, Updated: feed.Updated.UTC().Format(time.RFC3339), Author: atomPerson{Name: OaiRepoName}}
+	for _, link := range feed.Links {
+		res.Links = append(res.Links, atomLink(link))
+	}
+	for _, nav := range feed.Nav {
+		linkType := OpdsNavigationType
+		if nav.Acquisition {
+			linkType = OpdsAcquisitionType
+		}
+		res.Entries = append(res.Entries, atomEntry{Title: nav.Title, Id: feed.Id + "#" + nav.Href, Updated: res.Updated,
+			Content: &atomText{Type: "text", Text: nav.Content}, Links: []atomLink{{"subsection", nav.Href, linkType, ""}}})
+	}
+	if feed.Total > 0 {
+		res.TotalResults, res.ItemsPerPage, res.StartIndex = feed.Total, OpdsPageSize, (feed.Page-1)*OpdsPageSize+1
+	}
+	for _, b := range feed.Books {
+		entry := atomEntry{Title: b.Name, Id: OaiIdentifier(b.Id), Updated: b.Modified.UTC().Format(time.RFC3339),
+			Language: b.Language, Publisher: b.Publisher}
+		if b.Year > 0 {
+			entry.Issued = strconv.Itoa(b.Year)
+		}
+		if b.Isbn != "" {
+			entry.Identifier = "urn:isbn:" + b.Isbn
+		}
+		for _, name := range contributorNames(b, "author") {
+			entry.Authors = append(entry.Authors, atomPerson{Name: name, Uri: authorFeedPath(prefix, name)})
+		}
+		for _, subject := range b.Subjects {
+			entry.Categories = append(entry.Categories, atomCategory{Term: subject, Label: subject})
+		}
+		if b.Summary != "" {
+			entry.Summary = &atomText{Type: "text", Text: b.Summary}
+		}
+		entry.Links = []atomLink{{"alternate", "/books/" + url.PathEscape(b.Id), "application/json", "图书详情"},
+			{"related", "/books/" + url.PathEscape(b.Id) + "/related", "application/json", "借阅此书的读者还借阅了"}}
+		if b.Cover != "" {
+			entry.Links = append(entry.Links, atomLink{"http://opds-spec.org/image", b.Cover + "&size=large", "image/jpeg", ""},
+				atomLink{"http://opds-spec.org/image/thumbnail", b.Cover + "&size=small", "image/jpeg", ""})
+		}
+		res.Entries = append(res.Entries, entry)
+	}
+	return res
+}
+
+func opds2Links(links []opdsLink) []map[string]any {
+	res := make([]map[string]any, 0, len(links))
+	for _, link := range links {
+		item := map[string]any{"rel": link.Rel, "href": link.Href, "type": link.Type}
+		if strings.Contains(link.Href, "{") {
+			item["templated"] = true
+		}
+		if link.Title != "" {
+			item["title"] = link.Title
+		}
+		res = append(res, item)
+	}
+	return res
+}
+
+func (feed *opdsFeed) opds2(prefix string) map[string]any {
+	metadata := map[string]any{"title": feed.Title, "modified": feed.Updated.UTC().Format(time.RFC3339)}
+	if feed.Total > 0 {
+		metadata["numberOfItems"], metadata["itemsPerPage"], metadata["currentPage"] = feed.Total, OpdsPageSize, feed.Page
+	}
+	res := map[string]any{"metadata": metadata, "links": opds2Links(feed.Links)}
+	if feed.Nav != nil {
+		nav := make([]map[string]any, 0, len(feed.Nav))
+		for _, item := range feed.Nav {
+			nav = append(nav, map[string]any{"href": item.Href, "title": item.Title, "type": Opds2Type, "rel": "subsection"})
+		}
+		res["navigation"] = nav
+	}
+	if feed.Books != nil {
+		publications := make([]map[string]any, 0, len(feed.Books))
+		for _, b := range feed.Books {
+			meta := map[string]any{"@type": "http://schema.org/Book", "title": b.Name, "identifier": OaiIdentifier(b.Id),
+				"modified": b.Modified.UTC().Format(time.RFC3339)}
+			authors := make([]map[string]any, 0)
+			for _, name := range contributorNames(b, "author") {
+				authors = append(authors, map[string]any{"name": name,
+					"links": []map[string]any{{"href": authorFeedPath(prefix, name), "type": Opds2Type}}})
+			}
+			meta["author"] = authors
+			if b.Isbn != "" {
+				meta["identifier"] = "urn:isbn:" + b.Isbn
+			}
+			if b.Language != "" {
+				meta["language"] = b.Language
+			}
+			if b.Publisher != "" {
+				meta["publisher"] = b.Publisher
+			}
+			if b.Year > 0 {
+				meta["published"] = strconv.Itoa(b.Year)
+			}
+			if b.Summary != "" {
+				meta["description"] = b.Summary
+			}
+			if len(b.Subjects) > 0 {
+				meta["subject"] = b.Subjects
+			}
+			if b.Pages > 0 {
+				meta["numberOfPages"] = b.Pages
+			}
+			publication := map[string]any{"metadata": meta, "links": opds2Links([]opdsLink{
+				{"alternate", "/books/" + url.PathEscape(b.Id), "application/json", "图书详情"},
+				{"related", "/books/" + url.PathEscape(b.Id) + "/related", "application/json", "借阅此书的读者还借阅了"}})}
+			if b.Cover != "" {
+				images := make([]map[string]any, 0, len(CoverSizes))
+				// Sizes only bound the longer side, so width and height are unknown.
+				for _, size := range []string{"small", "medium", "large"} {
+					images = append(images, map[string]any{"href": b.Cover + "&size=" + size, "type": "image/jpeg"})
+				}
+				publication["images"] = images
+			}
+			publications = append(publications, publication)
+		}
+		res["publications"] = publications
+	}
+	return res
+}
+
+func writeOpdsFeed(w http.ResponseWriter, r *http.Request, feed *opdsFeed, acquisition bool) {
+	if isOpds2(r) {
+		w.Header().Add("Content-Type", Opds2Type)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(feed.opds2(Opds2Prefix))
+		return
+	}
+	if acquisition {
+		w.Header().Add("Content-Type", OpdsAcquisitionType)
+	} else {
+		w.Header().Add("Content-Type", OpdsNavigationType)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(feed.atom(Opds1Prefix))
+}
+
+// Serve the root navigation feed.
+func opdsRootHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := opdsPrefix(r)
+	feed := newOpdsFeed(r, OaiRepoName, false)
+	feed.Nav = []opdsNav{
+		{"新书通报", prefix + "/new", true, "最近入藏的图书"},
+		{"按作者浏览", prefix + "/authors", false, "馆藏图书的全部作者"},
+		{"全部图书", prefix + "/all", true, "全部可借阅的图书"},
+	}
+	writeOpdsFeed(w, r, feed, false)
+}
+
+// A page of all books not withdrawn, ordered by call number. Call numbers
+// are sorted as SortByCallNumber does, so only IDs and call numbers of all
+// books are queried, and the books of the page then.
+func opdsAllBooks(page int) ([]Book, int, error) {
+	db := DbOpen(DbConn)
+	rows, err := db.Query("SELECT ID,CALL_NO FROM BOOKS WHERE STATUS='active' ORDER BY ID")
+	if err != nil {
+		return nil, 0, err
+	}
+	all := make([]Book, 0)
+	for rows.Next() {
+		var tmp Book
+		if err = rows.Scan(&tmp.Id, &tmp.CallNumber); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		all = append(all, tmp)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	total := len(all)
+	if page-1 >= (total+OpdsPageSize-1)/OpdsPageSize {
+		return make([]Book, 0), total, nil
+	}
+	SortByCallNumber(all)
+	start := (page - 1) * OpdsPageSize
+	all = all[start:min(start+OpdsPageSize, total)]
+	ids := make([]any, len(all))
+	for i := range all {
+		ids[i] = all[i].Id
+	}
+	books, err := QueryBooks("ID IN ("+Placeholders(len(ids))+")", ids...)
+	if err != nil {
+		return nil, 0, err
+	}
+	idx := make(map[string]int, len(all))
+	for i := range all {
+		idx[all[i].Id] = i
+	}
+	slices.SortFunc(books, func(a, b Book) int { return cmp.Compare(idx[a.Id], idx[b.Id]) })
+	return books, total, nil
+}
+
+func opdsAllHandler(w http.ResponseWriter, r *http.Request) {
+	page, ok := opdsPage(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	books, total, err := opdsAllBooks(page)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	feed := newOpdsFeed(r, "全部图书", true)
+	feed.setPage(r, page, books, total)
+	writeOpdsFeed(w, r, feed, true)
+}
+
+func opdsNewHandler(w http.ResponseWriter, r *http.Request) {
+	page, ok := opdsPage(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	books, total, err := queryOpdsPage(page, OpdsNewest, "1=1", "ADDED DESC,ID")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	feed := newOpdsFeed(r, "新书通报", true)
+	feed.Links = append(feed.Links, opdsLink{"http://opds-spec.org/sort/new", r.URL.Path, feed.Links[0].Type, "新书通报"})
+	feed.setPage(r, page, books, total)
+	writeOpdsFeed(w, r, feed, true)
+}
+
+// Names of authors of books not withdrawn, with how many books each has.
+// Authors of a book are its contributors of role "author", or its AUTHOR if
+// none, as contributorNames.
+func opdsAuthors() (map[string]int, error) {
+	db := DbOpen(DbConn)
+	rows, err := db.Query("SELECT \"NAME\",COUNT(*) FROM (" +
+		"SELECT C.\"NAME\",C.ID FROM BOOK_CONTRIBUTORS C,BOOKS B WHERE C.ID=B.ID AND B.STATUS='active' AND C.\"ROLE\"='author' UNION " +
+		"SELECT AUTHOR,ID FROM BOOKS WHERE STATUS='active' AND AUTHOR<>'' AND NOT EXISTS (SELECT * FROM BOOK_CONTRIBUTORS C WHERE C.ID=BOOKS.ID AND C.\"ROLE\"='author')" +
+		") AS A GROUP BY \"NAME\"")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var count int
+		if err = rows.Scan(&name, &count); err != nil {
+			return nil, err
+		}
+		counts[name] = count
+	}
+	return counts, rows.Err()
+}
+
+// Serve the navigation feed of all authors, ordered by pinyin.
+func opdsAuthorsHandler(w http.ResponseWriter, r *http.Request) {
+	counts, err := opdsAuthors()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	authors := make([]string, 0, len(counts))
+	keys := make(map[string]string, len(counts))
+	for name := range counts {
+		authors = append(authors, name)
+		keys[name], _ = ToPinyin(name)
+	}
+	slices.SortFunc(authors, func(a, b string) int {
+		if c := cmp.Compare(strings.ToLower(keys[a]), strings.ToLower(keys[b])); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	prefix := opdsPrefix(r)
+	feed := newOpdsFeed(r, "按作者浏览", false)
+	feed.Nav = make([]opdsNav, 0, len(authors))
+	for _, name := range authors {
+		feed.Nav = append(feed.Nav, opdsNav{name, authorFeedPath(prefix, name), true, strconv.Itoa(counts[name]) + " 种图书"})
+	}
+	writeOpdsFeed(w, r, feed, false)
+}
+
+func opdsAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	author := r.FormValue("name")
+	if author == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	page, ok := opdsPage(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	books, total, err := queryOpdsPage(page, 0, "(EXISTS (SELECT * FROM BOOK_CONTRIBUTORS C WHERE C.ID=BOOKS.ID AND C.\"ROLE\"='author' AND C.\"NAME\"=?) OR "+
+		"(AUTHOR=? AND NOT EXISTS (SELECT * FROM BOOK_CONTRIBUTORS C WHERE C.ID=BOOKS.ID AND C.\"ROLE\"='author')))", "PUB_YEAR DESC,ID", author, author)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	feed := newOpdsFeed(r, author, true)
+	feed.setPage(r, page, books, total)
+	writeOpdsFeed(w, r, feed, true)
+}
+
+// Search books like /list/books, by "q" of OPDS 1.2 or "query" of OPDS 2.0.
+func opdsSearchHandler(w http.ResponseWriter, r *http.Request) {
+	keyword := r.FormValue("q")
+	if keyword == "" {
+		keyword = r.FormValue("query")
+	}
+	page, ok := opdsPage(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	cond, args := "1=1", []any(nil)
+	if keyword != "" {
+		cond, args = KeywordCond(keyword)
+	}
+	books, total, err := queryOpdsPage(page, 0, cond, "ID", args...)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	feed := newOpdsFeed(r, "搜索: "+keyword, true)
+	feed.setPage(r, page, books, total)
+	writeOpdsFeed(w, r, feed, true)
+}
+
+type openSearchUrl struct {
+	Type     string `xml:"type,attr"`
+	Template string `xml:"template,attr"`
+}
+
+type openSearchDescription struct {
+	XMLName       xml.Name      `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName     string        `xml:"ShortName"`
+	Description   string        `xml:"Description"`
+	InputEncoding string        `xml:"InputEncoding"`
+	Url           openSearchUrl `xml:"Url"`
+}
+
+func opdsOpenSearchHandler(w http.ResponseWriter, r *http.Request) {
+	desc := openSearchDescription{ShortName: OaiRepoName, Description: "按书名, 作者或拼音搜索馆藏图书", InputEncoding: "UTF-8",
+		Url: openSearchUrl{Type: OpdsAcquisitionType, Template: hostUrl(r) + Opds1Prefix + "/search?q={searchTerms}"}}
+	w.Header().Add("Content-Type", "application/opensearchdescription+xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(desc)
+}
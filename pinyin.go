@@ -0,0 +1,55 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 09:12:40
+ * @LastEditTime: 2026-10-19 09:12:40
+ * @LastEditors: FunctionSir
+ * @Description: Pinyin helpers for searching Chinese titles and authors.
+ * @FilePath: /biblio-matrix/pinyin.go
+ */
+
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/mozillazg/go-pinyin"
+)
+
+// Build full pinyin (like "sanguoyanyi") and initials (like "sgyy") of s.
+// Chars without pinyin are kept as-is (lower case), spaces are dropped,
+// so "三国演义 2" gives "sanguoyanyi2" and "sgyy2".
+func ToPinyin(s string) (string, string) {
+	fullArgs := pinyin.NewArgs()
+	fullArgs.Fallback = func(r rune, a pinyin.Args) []string { return nil }
+	initialsArgs := pinyin.NewArgs()
+	initialsArgs.Style = pinyin.FirstLetter
+	initialsArgs.Fallback = fullArgs.Fallback
+	var full, initials strings.Builder
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		py := pinyin.SinglePinyin(r, fullArgs)
+		if len(py) == 0 {
+			full.WriteRune(unicode.ToLower(r))
+			initials.WriteRune(unicode.ToLower(r))
+			continue
+		}
+		full.WriteString(py[0])
+		initials.WriteString(pinyin.SinglePinyin(r, initialsArgs)[0])
+	}
+	return full.String(), initials.String()
+}
+
+// Normalize a search keyword the same way as ToPinyin does with non-Han chars.
+func NormalizeKeyword(keyword string) string {
+	return strings.ToLower(strings.Join(strings.Fields(keyword), ""))
+}
+
+// Make a LIKE pattern which matches keyword anywhere, with wildcards escaped.
+func LikePattern(keyword string) string {
+	replacer := strings.NewReplacer("[", "[[]", "%", "[%]", "_", "[_]")
+	return "%" + replacer.Replace(keyword) + "%"
+}
@@ -0,0 +1,275 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 19:25:13
+ * @LastEditTime: 2026-10-20 01:35:45
+ * @LastEditors: FunctionSir
+ * @Description: "Readers who borrowed this also borrowed" recommendations.
+ * @FilePath: /biblio-matrix/recommend.go
+ */
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many related books are kept for every book.
+const MaxRelated = 20
+
+// How many books are in a personalised feed by default.
+const DefaultFeedSize = 10
+
+type Related struct {
+	Id    string  `json:"id"`
+	Score float64 `json:"score"` // Cosine similarity of readers of the two books
+}
+
+type Recommendation struct {
+	Book  Book    `json:"book"`
+	Score float64 `json:"score"`
+}
+
+// Related books of every book, rebuilt by RunRecommender.
+var RelatedBooks map[string][]Related
+var RelatedLock sync.RWMutex
+
+// Build related books from loans in RECORDS and LOAN_HISTORY, loans of
+// readers who opted out are not used.
+func BuildRelated() (map[string][]Related, error) {
+	db := DbOpen(DbConn)
+	rows, err := db.Query("SELECT DISTINCT USERNAME,ID FROM (SELECT USERNAME,ID FROM RECORDS UNION SELECT USERNAME,ID FROM LOAN_HISTORY) L WHERE USERNAME NOT IN (SELECT USERNAME FROM READERS WHERE NO_RECOMMEND=1)")
+	if err != nil {
+		return nil, err
+	}
+	readersBooks := make(map[string][]string)
+	var username, bookId string
+	for rows.Next() {
+		rows.Scan(&username, &bookId)
+		readersBooks[username] = append(readersBooks[username], bookId)
+	}
+	rows.Close()
+	readersOf := make(map[string]int)
+	coBorrowed := make(map[string]map[string]int)
+	for _, books := range readersBooks {
+		for _, a := range books {
+			readersOf[a]++
+			for _, b := range books {
+				if a == b {
+					continue
+				}
+				if coBorrowed[a] == nil {
+					coBorrowed[a] = make(map[string]int)
+				}
+				coBorrowed[a][b]++
+			}
+		}
+	}
+	res := make(map[string][]Related)
+	for a, others := range coBorrowed {
+		related := make([]Related, 0, len(others))
+		for b, cnt := range others {
+			score := float64(cnt) / math.Sqrt(float64(readersOf[a]*readersOf[b]))
+			related = append(related, Related{Id: b, Score: math.Round(score*1000) / 1000})
+		}
+		sortRelated(related)
+		if len(related) > MaxRelated {
+			related = related[:MaxRelated]
+		}
+		res[a] = related
+	}
+	return res, nil
+}
+
+// Sort by score, highest first.
+func sortRelated(related []Related) {
+	slices.SortFunc(related, func(x, y Related) int {
+		if c := cmp.Compare(y.Score, x.Score); c != 0 {
+			return c
+		}
+		return strings.Compare(x.Id, y.Id)
+	})
+}
+
+// Rebuild related books now and then every interval, should run as a goroutine.
+func RunRecommender(interval time.Duration) {
+	for {
+		start := time.Now()
+		related, err := BuildRelated()
+		if err != nil {
+			log.Println("Failed to rebuild recommendations: " + err.Error())
+		} else {
+			RelatedLock.Lock()
+			RelatedBooks = related
+			RelatedLock.Unlock()
+			log.Printf("Recommendations of %d books rebuilt in %s.\n", len(related), time.Since(start))
+		}
+		time.Sleep(interval)
+	}
+}
+
+func GetRelated(bookId string) []Related {
+	RelatedLock.RLock()
+	defer RelatedLock.RUnlock()
+	return RelatedBooks[bookId]
+}
+
+// Turn scored IDs into recommendations, books not found or withdrawn are
+// skipped. Books are fetched in chunks, only as many as needed.
+func toRecommendations(scored []Related, limit int) ([]Recommendation, error) {
+	res := make([]Recommendation, 0, limit)
+	for start := 0; start < len(scored) && len(res) < limit; start += BooksChunkSize {
+		chunk := scored[start:min(start+BooksChunkSize, len(scored))]
+		args := make([]any, len(chunk))
+		for i := range chunk {
+			args[i] = chunk[i].Id
+		}
+		books, err := QueryBooks("STATUS='active' AND ID IN ("+Placeholders(len(chunk))+")", args...)
+		if err != nil {
+			return nil, err
+		}
+		found := make(map[string]Book, len(books))
+		for _, book := range books {
+			found[book.Id] = book
+		}
+		for _, item := range chunk {
+			if len(res) >= limit {
+				break
+			}
+			if book, ok := found[item.Id]; ok {
+				res = append(res, Recommendation{Book: book, Score: item.Score})
+			}
+		}
+	}
+	return res, nil
+}
+
+// Recommend books for a reader by books the reader borrowed, books already
+// borrowed are not recommended. Returns nil if the reader opted out.
+func RecommendFor(username string, limit int) ([]Recommendation, error) {
+	reader, err := GetReaderInfo(username)
+	if err != nil {
+		return nil, err
+	}
+	if reader.NoRecommend {
+		return nil, nil
+	}
+	db := DbOpen(DbConn)
+	rows, err := db.Query("SELECT ID FROM RECORDS WHERE USERNAME=? UNION SELECT ID FROM LOAN_HISTORY WHERE USERNAME=?", username, username)
+	if err != nil {
+		return nil, err
+	}
+	borrowed := make(map[string]bool)
+	var bookId string
+	for rows.Next() {
+		rows.Scan(&bookId)
+		borrowed[bookId] = true
+	}
+	rows.Close()
+	scores := make(map[string]float64)
+	for id := range borrowed {
+		for _, related := range GetRelated(id) {
+			if !borrowed[related.Id] {
+				scores[related.Id] += related.Score
+			}
+		}
+	}
+	scored := make([]Related, 0, len(scores))
+	for id, score := range scores {
+		scored = append(scored, Related{Id: id, Score: math.Round(score*1000) / 1000})
+	}
+	sortRelated(scored)
+	return toRecommendations(scored, limit)
+}
+
+func SetNoRecommend(username string, noRecommend bool) error {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "UPDATE READERS SET NO_RECOMMEND=? WHERE USERNAME=?")
+	_, err := stmt.Exec(noRecommend, username)
+	return err
+}
+
+// Parse "limit" of the form, DefaultFeedSize if absent.
+func feedLimit(r *http.Request) (int, bool) {
+	limitStr := r.FormValue("limit")
+	if limitStr == "" {
+		return DefaultFeedSize, true
+	}
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 || limit > MaxRelated {
+		return 0, false
+	}
+	return limit, true
+}
+
+// Serve /books/{id}/related.
+func relatedBooksHandler(w http.ResponseWriter, r *http.Request) {
+	limit, ok := feedLimit(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	res, err := toRecommendations(GetRelated(r.PathValue("id")), limit)
+	if err != nil {
+		http.Error(w, "无法完成查询. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+func recommendHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	limit, ok := feedLimit(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	res, err := RecommendFor(GetTokenUsername(tokenCookie.Value), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if res == nil {
+		http.Error(w, "您已关闭个性化推荐.", http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// Opt out of recommendations by "optout" of "1", or opt in again by "0".
+func recommendOptOutHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	optOut := r.PostFormValue("optout")
+	if optOut != "0" && optOut != "1" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	err = SetNoRecommend(GetTokenUsername(tokenCookie.Value), optOut == "1")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
@@ -0,0 +1,309 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 18:21:08
+ * @LastEditTime: 2026-10-19 18:21:08
+ * @LastEditors: FunctionSir
+ * @Description: Ratings, moderated reviews and tags of books by readers.
+ * @FilePath: /biblio-matrix/reviews.go
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type Review struct {
+	Username string    `json:"username"`
+	Id       string    `json:"id"` // Which book was reviewed
+	Rating   int       `json:"rating"`
+	Content  string    `json:"content"`
+	Status   string    `json:"status"` // "pending", "approved" or "rejected"
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Limits of reviews and tags.
+const MaxReviewLen = 4000 // In bytes, as the col is VARCHAR(4000)
+const MaxTagLen = 32      // In chars, the col is VARCHAR(96) for 3 bytes per char
+const MaxTagsPerBook = 10
+
+// Only readers who are borrowing or have borrowed a book can rate it.
+func HasBorrowed(ctx context.Context, username string, bookId string) (bool, error) {
+	db := DbOpen(DbConn)
+	row := db.QueryRowContext(ctx, "SELECT (SELECT COUNT(*) FROM RECORDS WHERE USERNAME=? AND ID=?)+(SELECT COUNT(*) FROM LOAN_HISTORY WHERE USERNAME=? AND ID=?)",
+		username, bookId, username, bookId)
+	var cnt int
+	err := row.Scan(&cnt)
+	if err != nil {
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+// Add or replace the review of a reader on a book. A review with text must
+// be approved again by an admin, a review with only a rating needs not.
+func SaveReview(ctx context.Context, username string, bookId string, rating int, content string) string {
+	borrowed, err := HasBorrowed(ctx, username, bookId)
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if !borrowed {
+		return "只有借阅过该书的读者才能评价."
+	}
+	status := "pending"
+	if content == "" {
+		status = "approved"
+	}
+	now := time.Now().UTC()
+	db := DbOpen(DbConn)
+	res, err := db.ExecContext(ctx, "UPDATE REVIEWS SET RATING=?,CONTENT=?,STATUS=?,UPDATED=? WHERE USERNAME=? AND ID=?",
+		rating, content, status, now, username, bookId)
+	if err != nil {
+		return "无法保存评价, 请联系管理员."
+	}
+	if affected, _ := res.RowsAffected(); affected > 0 {
+		return ""
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO REVIEWS (USERNAME,ID,RATING,CONTENT,STATUS,CREATED,UPDATED) VALUES (?,?,?,?,?,?,?)",
+		username, bookId, rating, content, status, now, now)
+	if err != nil {
+		return "无法保存评价, 请联系管理员."
+	}
+	return ""
+}
+
+// Replace tags of a reader on a book.
+func SaveTags(ctx context.Context, username string, bookId string, tags []string) string {
+	borrowed, err := HasBorrowed(ctx, username, bookId)
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if !borrowed {
+		return "只有借阅过该书的读者才能添加标签."
+	}
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	_, err = tx.ExecContext(ctx, "DELETE FROM BOOK_TAGS WHERE USERNAME=? AND ID=?", username, bookId)
+	if err != nil {
+		return "无法保存标签, 请联系管理员."
+	}
+	for _, tag := range tags {
+		_, err = tx.ExecContext(ctx, "INSERT INTO BOOK_TAGS (USERNAME,ID,TAG) VALUES (?,?,?)", username, bookId, tag)
+		if err != nil {
+			return "无法保存标签, 请联系管理员."
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+// List reviews of a book with the status given, or of all books if bookId
+// is empty.
+func ListReviews(bookId string, status string) ([]Review, error) {
+	db := DbOpen(DbConn)
+	query := "SELECT USERNAME,ID,RATING,CONTENT,STATUS,CREATED,UPDATED FROM REVIEWS WHERE STATUS=?"
+	args := []any{status}
+	if bookId != "" {
+		query += " AND ID=?"
+		args = append(args, bookId)
+	}
+	rows, err := db.Query(query+" ORDER BY UPDATED DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]Review, 0)
+	var tmp Review
+	for rows.Next() {
+		rows.Scan(&tmp.Username, &tmp.Id, &tmp.Rating, &tmp.Content, &tmp.Status, &tmp.Created, &tmp.Updated)
+		res = append(res, tmp)
+	}
+	return res, nil
+}
+
+func ModerateReview(username string, bookId string, status string) error {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "UPDATE REVIEWS SET STATUS=? WHERE USERNAME=? AND ID=?")
+	_, err := stmt.Exec(status, username, bookId)
+	return err
+}
+
+func DelReview(username string, bookId string) error {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "DELETE FROM REVIEWS WHERE USERNAME=? AND ID=?")
+	_, err := stmt.Exec(username, bookId)
+	return err
+}
+
+// Remove a tag from a book, no matter who added it.
+func DelTag(bookId string, tag string) error {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "DELETE FROM BOOK_TAGS WHERE ID=? AND TAG=?")
+	_, err := stmt.Exec(bookId, tag)
+	return err
+}
+
+func reviewHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	book := r.PostFormValue("book")
+	rating, err := strconv.Atoi(r.PostFormValue("rating"))
+	if book == "" || err != nil || rating < 1 || rating > 5 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	content := strings.TrimSpace(r.PostFormValue("content"))
+	if len(content) > MaxReviewLen || !utf8.ValidString(content) {
+		http.Error(w, "书评过长.", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := SaveReview(ctx, GetTokenUsername(tokenCookie.Value), book, rating, content)
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if content != "" {
+		w.Write([]byte("评价已提交, 书评将在管理员审核后公开."))
+		return
+	}
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+// Replace tags of the reader on a book by repeated "tag" fields.
+func tagHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	book := r.PostFormValue("book")
+	if book == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	tags := make([]string, 0)
+	for _, tag := range r.PostForm["tag"] {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || slices.Contains(tags, tag) {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > MaxTagLen || len(tag) > MaxTagLen*3 {
+			http.Error(w, "标签过长.", http.StatusBadRequest)
+			return
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) > MaxTagsPerBook {
+		http.Error(w, "标签过多.", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := SaveTags(ctx, GetTokenUsername(tokenCookie.Value), book, tags)
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+// List approved reviews of a book.
+func listReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	book := r.PostFormValue("book")
+	if book == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	reviews, err := ListReviews(book, "approved")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// List reviews waiting for moderation, of one book if "book" is given.
+func listPendingReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	reviews, err := ListReviews(r.PostFormValue("book"), "pending")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// Approve or reject a review, by "action" of "approve" or "reject".
+func moderateReviewHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.PostFormValue("username")
+	book := r.PostFormValue("book")
+	action := r.PostFormValue("action")
+	if username == "" || book == "" || (action != "approve" && action != "reject") {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	err := ModerateReview(username, book, action+"d")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func delReviewHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.PostFormValue("username")
+	book := r.PostFormValue("book")
+	if username == "" || book == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	err := DelReview(username, book)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func delTagHandler(w http.ResponseWriter, r *http.Request) {
+	book := r.PostFormValue("book")
+	tag := r.PostFormValue("tag")
+	if book == "" || tag == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	err := DelTag(book, tag)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
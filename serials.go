@@ -0,0 +1,514 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 23:41:05
+ * @LastEditTime: 2026-10-20 02:10:00
+ * @LastEditors: FunctionSir
+ * @Description: Serial subscriptions, issue prediction, check-in and claims.
+ * @FilePath: /biblio-matrix/serials.go
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+var SerialFrequencies = []string{"weekly", "monthly", "quarterly"}
+
+// Issues are predicted this far ahead.
+const PredictAhead = 365 * 24 * time.Hour
+
+// A late or missing issue is claimed again after this long.
+const ClaimInterval = 30 * 24 * time.Hour
+
+// How often issues are predicted and marked late, see RunSerialsRefresher.
+const SerialsRefreshInterval = time.Hour
+
+const serialDate = "2006-01-02"
+
+type Subscription struct {
+	Id          string    `json:"id"`
+	Title       string    `json:"title"`
+	Issn        string    `json:"issn"`
+	Publisher   string    `json:"publisher"`
+	Vendor      string    `json:"vendor"`    // Empty if ordered from the publisher directly
+	Frequency   string    `json:"frequency"` // One of SerialFrequencies
+	Start       time.Time `json:"start"`     // Expected date of the first issue
+	End         time.Time `json:"end"`       // Zero if not ending
+	FirstNumber int       `json:"first_number"`
+	GraceDays   int       `json:"grace_days"` // Days after the expected date before an issue is late
+	Status      string    `json:"status"`     // "active" or "cancelled"
+}
+
+type SerialIssue struct {
+	Subscription string     `json:"subscription"`
+	Seq          int        `json:"seq"` // 1 for the first issue of the subscription
+	Number       int        `json:"number"`
+	Expected     time.Time  `json:"expected"`
+	Status       string     `json:"status"` // "expected", "late", "received" or "missing"
+	Received     *time.Time `json:"received,omitempty"`
+	Item         string     `json:"item"` // ID of the book of the issue, empty if not borrowable
+	Claims       int        `json:"claims"`
+	LastClaimed  *time.Time `json:"last_claimed,omitempty"`
+}
+
+// A claim of a late or missing issue, to be sent to the vendor.
+type SerialClaim struct {
+	Vendor      string    `json:"vendor"`
+	VendorName  string    `json:"vendor_name"`
+	VendorEmail string    `json:"vendor_email"`
+	Title       string    `json:"title"`
+	Issn        string    `json:"issn"`
+	Number      int       `json:"number"`
+	Expected    time.Time `json:"expected"`
+	Status      string    `json:"status"`
+	Claims      int       `json:"claims"` // Times claimed, including this one
+}
+
+// Expected date of the nth issue after the first one.
+func issueDate(start time.Time, frequency string, n int) time.Time {
+	switch frequency {
+	case "weekly":
+		return start.AddDate(0, 0, 7*n)
+	case "monthly":
+		return addMonths(start, n)
+	default:
+		return addMonths(start, 3*n)
+	}
+}
+
+// Add months to a date, clamped to the last day of the month, so that
+// issues from Jan 31 are expected on Feb 28 (or 29), Mar 31, Apr 30 and so
+// on, instead of AddDate skipping to Mar 3.
+func addMonths(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	last := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(t.Day(), last)-1)
+}
+
+// Label of an issue, used as the name of its book.
+func issueLabel(title string, number int, expected time.Time) string {
+	return title + " 第" + strconv.Itoa(number) + "期 (" + expected.Format(serialDate) + ")"
+}
+
+func AddSubscription(ctx context.Context, s Subscription) string {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	var end *time.Time
+	if !s.End.IsZero() {
+		end = &s.End
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO SUBSCRIPTIONS (SID,TITLE,ISSN,PUBLISHER,VENDOR_ID,FREQUENCY,START_DATE,END_DATE,FIRST_NUMBER,GRACE_DAYS,STATUS) VALUES (?,?,?,?,?,?,?,?,?,?,?)",
+		s.Id, s.Title, s.Issn, s.Publisher, NullString(s.Vendor), s.Frequency, s.Start, end, s.FirstNumber, s.GraceDays, "active")
+	if err != nil {
+		return "无法创建订阅, 请检查订阅号是否重复及供应商是否存在."
+	}
+	if err = predictIssues(ctx, tx, s); err != nil {
+		return "无法预测期刊到刊, 请联系管理员."
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+// Add expected issues of a subscription up to PredictAhead from now.
+func predictIssues(ctx context.Context, tx *sql.Tx, s Subscription) error {
+	row := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(SEQ),0) FROM SERIAL_ISSUES WITH (UPDLOCK) WHERE SID=?", s.Id)
+	var predicted int
+	err := row.Scan(&predicted)
+	if err != nil {
+		return err
+	}
+	horizon := time.Now().UTC().Add(PredictAhead)
+	for n := predicted; ; n++ {
+		expected := issueDate(s.Start, s.Frequency, n)
+		if expected.After(horizon) || (!s.End.IsZero() && expected.After(s.End)) {
+			return nil
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO SERIAL_ISSUES (SID,SEQ,\"NUMBER\",EXPECTED,STATUS) VALUES (?,?,?,?,?)",
+			s.Id, n+1, s.FirstNumber+n, expected, "expected")
+		if err != nil {
+			return err
+		}
+	}
+}
+
+const subscriptionCols = "SID,TITLE,ISSN,PUBLISHER,VENDOR_ID,FREQUENCY,START_DATE,END_DATE,FIRST_NUMBER,GRACE_DAYS,STATUS"
+
+func scanSubscription(row RowScanner) (Subscription, error) {
+	var s Subscription
+	var vendor sql.NullString
+	var end sql.NullTime
+	err := row.Scan(&s.Id, &s.Title, &s.Issn, &s.Publisher, &vendor, &s.Frequency, &s.Start, &end, &s.FirstNumber, &s.GraceDays, &s.Status)
+	s.Vendor = vendor.String
+	if end.Valid {
+		s.End = end.Time
+	}
+	return s, err
+}
+
+func ListSubscriptions() ([]Subscription, error) {
+	db := DbOpen(DbConn)
+	rows, err := db.Query("SELECT " + subscriptionCols + " FROM SUBSCRIPTIONS ORDER BY TITLE")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]Subscription, 0)
+	for rows.Next() {
+		tmp, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, tmp)
+	}
+	return res, nil
+}
+
+// Predict issues of active subscriptions ahead, and mark expected issues
+// past their grace days as late.
+func RefreshSerials(ctx context.Context) error {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	rows, err := tx.QueryContext(ctx, "SELECT "+subscriptionCols+" FROM SUBSCRIPTIONS WHERE STATUS='active'")
+	if err != nil {
+		return err
+	}
+	subscriptions := make([]Subscription, 0)
+	for rows.Next() {
+		tmp, err := scanSubscription(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		subscriptions = append(subscriptions, tmp)
+	}
+	rows.Close()
+	for _, s := range subscriptions {
+		if err = predictIssues(ctx, tx, s); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE SERIAL_ISSUES SET STATUS='late' WHERE STATUS='expected' AND EXISTS (SELECT * FROM SUBSCRIPTIONS S WHERE S.SID=SERIAL_ISSUES.SID AND DATEADD(DAY,S.GRACE_DAYS,SERIAL_ISSUES.EXPECTED)<?)",
+		time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Refresh serials every interval, should run as a goroutine.
+func RunSerialsRefresher(interval time.Duration) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := RefreshSerials(ctx)
+		cancel()
+		if err != nil {
+			log.Println("Failed to refresh serials: " + err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Condition of an expected issue I of a subscription S being past its grace
+// days, before RefreshSerials marks it late.
+const issueOverdue = "I.STATUS='expected' AND DATEADD(DAY,S.GRACE_DAYS,I.EXPECTED)<?"
+
+// List issues of a subscription, newest first. Expected issues past their
+// grace days are listed as late, even if not marked yet.
+func ListIssues(sid string) ([]SerialIssue, error) {
+	db := DbOpen(DbConn)
+	rows, err := db.Query("SELECT I.SID,I.SEQ,I.\"NUMBER\",I.EXPECTED,CASE WHEN "+issueOverdue+" THEN 'late' ELSE I.STATUS END,I.RECEIVED,I.ITEM_ID,I.CLAIMS,I.LAST_CLAIMED FROM SERIAL_ISSUES I JOIN SUBSCRIPTIONS S ON I.SID=S.SID WHERE I.SID=? ORDER BY I.SEQ DESC",
+		time.Now().UTC(), sid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]SerialIssue, 0)
+	for rows.Next() {
+		var tmp SerialIssue
+		var received, lastClaimed sql.NullTime
+		var item sql.NullString
+		rows.Scan(&tmp.Subscription, &tmp.Seq, &tmp.Number, &tmp.Expected, &tmp.Status, &received, &item, &tmp.Claims, &lastClaimed)
+		if received.Valid {
+			tmp.Received = &received.Time
+		}
+		if lastClaimed.Valid {
+			tmp.LastClaimed = &lastClaimed.Time
+		}
+		tmp.Item = item.String
+		res = append(res, tmp)
+	}
+	return res, nil
+}
+
+// Check in an issue as received, late or missing. A received issue becomes
+// borrowable if item is not empty, as a new book of count copies with the
+// ID item.
+func CheckInIssue(ctx context.Context, sid string, seq int, status string, item string, count int, price int) string {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	row := tx.QueryRowContext(ctx, "SELECT S.TITLE,S.ISSN,S.PUBLISHER,I.\"NUMBER\",I.EXPECTED,I.STATUS FROM SERIAL_ISSUES I WITH (UPDLOCK) JOIN SUBSCRIPTIONS S ON I.SID=S.SID WHERE I.SID=? AND I.SEQ=?",
+		sid, seq)
+	var title, issn, publisher, oldStatus string
+	var number int
+	var expected time.Time
+	err = row.Scan(&title, &issn, &publisher, &number, &expected, &oldStatus)
+	if err == sql.ErrNoRows {
+		return "该期刊不存在."
+	}
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if oldStatus == "received" {
+		return "该期已经到刊."
+	}
+	if status != "received" {
+		_, err = tx.ExecContext(ctx, "UPDATE SERIAL_ISSUES SET STATUS=? WHERE SID=? AND SEQ=?", status, sid, seq)
+	} else {
+		if item != "" {
+			author := publisher
+			if author == "" {
+				author = title
+			}
+			book := Book{Id: item, Name: issueLabel(title, number, expected), Author: author, Price: price, Count: count,
+				Publisher: publisher, Year: expected.Year(), Subjects: []string{}, Contributors: []Contributor{}}
+			if err = AddBookTx(ctx, tx, book); err != nil {
+				return "无法添加期刊单册, 请检查书号是否重复."
+			}
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE SERIAL_ISSUES SET STATUS='received',RECEIVED=?,ITEM_ID=? WHERE SID=? AND SEQ=?",
+			time.Now().UTC(), NullString(item), sid, seq)
+	}
+	if err != nil {
+		return "无法更新期刊状态, 请联系管理员."
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+// Claim late and missing issues of active subscriptions which were never
+// claimed, or claimed longer than ClaimInterval ago. Claimed issues are
+// recorded and returned, grouped by vendor.
+func GenerateClaims(ctx context.Context) ([]SerialClaim, string) {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	now := time.Now().UTC()
+	rows, err := tx.QueryContext(ctx, "SELECT I.SID,I.SEQ,COALESCE(V.ID,''),COALESCE(V.\"NAME\",S.PUBLISHER),COALESCE(V.EMAIL,''),S.TITLE,S.ISSN,I.\"NUMBER\",I.EXPECTED,CASE WHEN "+issueOverdue+" THEN 'late' ELSE I.STATUS END,I.CLAIMS FROM SERIAL_ISSUES I WITH (UPDLOCK) JOIN SUBSCRIPTIONS S ON I.SID=S.SID LEFT JOIN VENDORS V ON S.VENDOR_ID=V.ID WHERE S.STATUS='active' AND (I.STATUS IN ('late','missing') OR "+issueOverdue+") AND (I.LAST_CLAIMED IS NULL OR I.LAST_CLAIMED<?) ORDER BY V.ID,S.TITLE,I.SEQ",
+		now, now, now.Add(-ClaimInterval))
+	if err != nil {
+		return nil, "无法完成查询. 请联系管理员."
+	}
+	type issueKey struct {
+		sid string
+		seq int
+	}
+	claims := make([]SerialClaim, 0)
+	keys := make([]issueKey, 0)
+	for rows.Next() {
+		var claim SerialClaim
+		var key issueKey
+		rows.Scan(&key.sid, &key.seq, &claim.Vendor, &claim.VendorName, &claim.VendorEmail, &claim.Title, &claim.Issn,
+			&claim.Number, &claim.Expected, &claim.Status, &claim.Claims)
+		claim.Claims++
+		claims = append(claims, claim)
+		keys = append(keys, key)
+	}
+	rows.Close()
+	for _, key := range keys {
+		// An issue claimed is late, though it may not be marked yet.
+		_, err = tx.ExecContext(ctx, "UPDATE SERIAL_ISSUES SET CLAIMS=CLAIMS+1,LAST_CLAIMED=?,STATUS=CASE WHEN STATUS='expected' THEN 'late' ELSE STATUS END WHERE SID=? AND SEQ=?",
+			now, key.sid, key.seq)
+		if err != nil {
+			return nil, "无法记录催缺, 请联系管理员."
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, "无法成功提交事务. 请联系管理员."
+	}
+	return claims, ""
+}
+
+func CancelSubscription(sid string) error {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "UPDATE SUBSCRIPTIONS SET STATUS='cancelled' WHERE SID=?")
+	_, err := stmt.Exec(sid)
+	return err
+}
+
+func newSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	s := Subscription{Id: r.PostFormValue("subscription"), Title: r.PostFormValue("title"), Issn: r.PostFormValue("issn"),
+		Publisher: r.PostFormValue("publisher"), Vendor: r.PostFormValue("vendor"), Frequency: r.PostFormValue("frequency")}
+	var err error
+	s.Start, err = time.Parse(serialDate, r.PostFormValue("start"))
+	if err != nil || s.Id == "" || s.Title == "" || !slices.Contains(SerialFrequencies, s.Frequency) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if end := r.PostFormValue("end"); end != "" {
+		s.End, err = time.Parse(serialDate, end)
+		if err != nil || s.End.Before(s.Start) {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	s.FirstNumber = 1
+	if first := r.PostFormValue("first"); first != "" {
+		s.FirstNumber, err = strconv.Atoi(first)
+		if err != nil || s.FirstNumber < 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	s.GraceDays = 14
+	if grace := r.PostFormValue("grace"); grace != "" {
+		s.GraceDays, err = strconv.Atoi(grace)
+		if err != nil || s.GraceDays < 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := AddSubscription(ctx, s)
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func listSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := ListSubscriptions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+func cancelSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	sid := r.PostFormValue("subscription")
+	if sid == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	err := CancelSubscription(sid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+// List issues of a subscription.
+func listIssuesHandler(w http.ResponseWriter, r *http.Request) {
+	sid := r.PostFormValue("subscription")
+	if sid == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	issues, err := ListIssues(sid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(issues)
+}
+
+// Check in an issue by "subscription", "seq" and "status" of "received",
+// "late" or "missing". For a received issue, "item" is the ID of its book
+// to make it borrowable, with "count" copies at "price" yuan each.
+func checkInHandler(w http.ResponseWriter, r *http.Request) {
+	sid := r.PostFormValue("subscription")
+	seq, err := strconv.Atoi(r.PostFormValue("seq"))
+	status := r.PostFormValue("status")
+	if sid == "" || err != nil || !slices.Contains([]string{"received", "late", "missing"}, status) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	item := r.PostFormValue("item")
+	count, price := 1, 0
+	if countStr := r.PostFormValue("count"); countStr != "" {
+		count, err = strconv.Atoi(countStr)
+		if err != nil || count <= 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	if priceStr := r.PostFormValue("price"); priceStr != "" {
+		price, err = parseYuan(priceStr)
+		if err != nil || price < 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := CheckInIssue(ctx, sid, seq, status, item, count, price)
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+// Generate claims of late and missing issues.
+func claimsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	claims, result := GenerateClaims(ctx)
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(claims)
+}
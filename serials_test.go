@@ -0,0 +1,44 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-20 02:10:00
+ * @LastEditTime: 2026-10-20 02:10:00
+ * @LastEditors: FunctionSir
+ * @Description: Tests of the prediction of serial issues.
+ * @FilePath: /biblio-matrix/serials_test.go
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIssueDate(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		start     time.Time
+		frequency string
+		n         int
+		want      time.Time
+	}{
+		{day(2026, 1, 31), "monthly", 0, day(2026, 1, 31)},
+		{day(2026, 1, 31), "monthly", 1, day(2026, 2, 28)},
+		{day(2026, 1, 31), "monthly", 2, day(2026, 3, 31)},
+		{day(2026, 1, 31), "monthly", 3, day(2026, 4, 30)},
+		{day(2028, 1, 30), "monthly", 1, day(2028, 2, 29)},
+		{day(2026, 1, 15), "monthly", 12, day(2027, 1, 15)},
+		{day(2026, 11, 30), "quarterly", 1, day(2027, 2, 28)},
+		{day(2026, 11, 30), "quarterly", 2, day(2027, 5, 30)},
+		{day(2026, 1, 31), "weekly", 1, day(2026, 2, 7)},
+	}
+	for _, tt := range tests {
+		if got := issueDate(tt.start, tt.frequency, tt.n); !got.Equal(tt.want) {
+			t.Errorf("issueDate(%s, %s, %d) = %s, want %s", tt.start.Format(time.DateOnly), tt.frequency, tt.n,
+				got.Format(time.DateOnly), tt.want.Format(time.DateOnly))
+		}
+	}
+}
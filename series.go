@@ -0,0 +1,456 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 16:31:27
+ * @LastEditTime: 2026-10-20 01:24:50
+ * @LastEditors: FunctionSir
+ * @Description: Book series and multi-volume sets.
+ * @FilePath: /biblio-matrix/series.go
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Days a set held for a reader is kept for them to borrow.
+const HoldPickupDays = 7
+
+// How often holds on sets are checked, should be short as a set may be
+// available for a while before its holds are checked.
+const SetHoldsInterval = 5 * time.Minute
+
+type Series struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	IsSet bool   `json:"set"` // A multi-volume set, which can be borrowed as a whole
+	Note  string `json:"note"`
+	Books []Book `json:"books,omitempty"` // Volumes, ordered by volume number
+}
+
+func AddSeries(s Series) error {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "INSERT INTO SERIES (ID,\"NAME\",IS_SET,NOTE) VALUES (?,?,?,?)")
+	_, err := stmt.Exec(s.Id, s.Name, s.IsSet, s.Note)
+	return err
+}
+
+func ListSeries() ([]Series, error) {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "SELECT ID,\"NAME\",IS_SET,NOTE FROM SERIES ORDER BY \"NAME\"")
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]Series, 0)
+	var tmp Series
+	for rows.Next() {
+		rows.Scan(&tmp.Id, &tmp.Name, &tmp.IsSet, &tmp.Note)
+		res = append(res, tmp)
+	}
+	return res, nil
+}
+
+// Get a series with its volumes which are not withdrawn.
+func GetSeriesInfo(seriesId string) (Series, error) {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "SELECT ID,\"NAME\",IS_SET,NOTE FROM SERIES WHERE ID=?")
+	row := stmt.QueryRow(seriesId)
+	var res Series
+	err := row.Scan(&res.Id, &res.Name, &res.IsSet, &res.Note)
+	if err != nil {
+		return Series{}, err
+	}
+	res.Books, err = QueryBooks("STATUS='active' AND SERIES_ID=? ORDER BY VOLUME,ID", seriesId)
+	if err != nil {
+		return Series{}, err
+	}
+	return res, nil
+}
+
+// Borrow every volume of a set in one transaction, either all volumes are
+// borrowed, or none of them.
+func BorrowSeries(ctx context.Context, username string, seriesId string, borrowedAt time.Time, returnAt time.Time) string {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	row := tx.QueryRowContext(ctx, "SELECT IS_SET FROM SERIES WHERE ID=?", seriesId)
+	var isSet bool
+	err = row.Scan(&isSet)
+	if err == sql.ErrNoRows {
+		return "该丛书不存在."
+	}
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if !isSet {
+		return "该丛书不是多卷书, 无法整套借阅."
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT ID,\"NAME\" FROM BOOKS WHERE SERIES_ID=? AND STATUS='active' ORDER BY VOLUME,ID", seriesId)
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	volumes := make([]Book, 0)
+	var tmp Book
+	for rows.Next() {
+		rows.Scan(&tmp.Id, &tmp.Name)
+		volumes = append(volumes, tmp)
+	}
+	rows.Close()
+	if len(volumes) == 0 {
+		return "该多卷书没有可借阅的分卷."
+	}
+	for _, volume := range volumes {
+		if result := BorrowTx(ctx, tx, username, volume.Id, borrowedAt, returnAt); result != "" {
+			return volume.Name + ": " + result
+		}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE SET_HOLDS SET STATUS='fulfilled' WHERE USERNAME=? AND SERIES_ID=? AND STATUS IN ('waiting','ready')", username, seriesId)
+	if err != nil {
+		return "无法完成借书, 请联系管理员."
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+// A hold on a whole set. A waiting hold becomes ready when every volume has a
+// copy not kept for other holds, then the copies are kept for the reader to
+// borrow until it expires.
+type SetHold struct {
+	Hid      int        `json:"hid"`
+	Username string     `json:"username"`
+	SeriesId string     `json:"series"`
+	Placed   time.Time  `json:"placed"`
+	Status   string     `json:"status"` // "waiting", "ready", "fulfilled", "cancelled" or "expired"
+	ReadyAt  *time.Time `json:"ready_at,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+func PlaceSetHold(ctx context.Context, username string, seriesId string) string {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "无法启动事务. 请联系管理员."
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	row := tx.QueryRowContext(ctx, "SELECT IS_SET FROM SERIES WHERE ID=?", seriesId)
+	var isSet bool
+	err = row.Scan(&isSet)
+	if err == sql.ErrNoRows {
+		return "该丛书不存在."
+	}
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if !isSet {
+		return "该丛书不是多卷书, 无法整套预约."
+	}
+	row = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM SET_HOLDS WITH (UPDLOCK) WHERE USERNAME=? AND SERIES_ID=? AND STATUS IN ('waiting','ready')", username, seriesId)
+	var holds int
+	err = row.Scan(&holds)
+	if err != nil {
+		return "无法完成查询. 请联系管理员."
+	}
+	if holds > 0 {
+		return "您已经预约过该多卷书了."
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO SET_HOLDS (USERNAME,SERIES_ID,PLACED,STATUS) VALUES (?,?,?,'waiting')", username, seriesId, time.Now().UTC())
+	if err != nil {
+		return "无法完成预约, 请联系管理员."
+	}
+	if err = tx.Commit(); err != nil {
+		return "无法成功提交事务. 请联系管理员."
+	}
+	return ""
+}
+
+// Cancel a waiting or ready hold, of the reader given, or of anyone if
+// username is empty.
+func CancelSetHold(ctx context.Context, hid int, username string) string {
+	db := DbOpen(DbConn)
+	res, err := db.ExecContext(ctx, "UPDATE SET_HOLDS SET STATUS='cancelled' WHERE HID=? AND STATUS IN ('waiting','ready') AND (?='' OR USERNAME=?)",
+		hid, username, username)
+	if err != nil {
+		return "无法取消预约, 请联系管理员."
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected != 1 {
+		return "该预约不存在或已结束."
+	}
+	return ""
+}
+
+// Holds of a reader, or of everyone if username is empty, newest first.
+func ListSetHolds(username string) ([]SetHold, error) {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "SELECT HID,USERNAME,SERIES_ID,PLACED,STATUS,READY_AT,EXPIRES FROM SET_HOLDS WHERE ?='' OR USERNAME=? ORDER BY PLACED DESC,HID DESC")
+	rows, err := stmt.Query(username, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]SetHold, 0)
+	for rows.Next() {
+		var tmp SetHold
+		var readyAt, expires sql.NullTime
+		err = rows.Scan(&tmp.Hid, &tmp.Username, &tmp.SeriesId, &tmp.Placed, &tmp.Status, &readyAt, &expires)
+		if err != nil {
+			return nil, err
+		}
+		if readyAt.Valid {
+			tmp.ReadyAt = &readyAt.Time
+		}
+		if expires.Valid {
+			tmp.Expires = &expires.Time
+		}
+		res = append(res, tmp)
+	}
+	return res, rows.Err()
+}
+
+// Expire ready holds not picked up in time, then make waiting holds ready in
+// the order they were placed, for sets with a copy of every volume which is
+// not kept for another hold. Returns the number of holds made ready.
+func ProcessSetHolds(ctx context.Context) (int, error) {
+	db := DbOpen(DbConn)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // If anything fail, rollback the transaction.
+	now := time.Now().UTC()
+	_, err = tx.ExecContext(ctx, "UPDATE SET_HOLDS SET STATUS='expired' WHERE STATUS='ready' AND EXPIRES<=?", now)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT HID,SERIES_ID FROM SET_HOLDS WITH (UPDLOCK) WHERE STATUS='waiting' ORDER BY PLACED,HID")
+	if err != nil {
+		return 0, err
+	}
+	waiting := make([]SetHold, 0)
+	for rows.Next() {
+		var tmp SetHold
+		if err = rows.Scan(&tmp.Hid, &tmp.SeriesId); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		waiting = append(waiting, tmp)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	readied := 0
+	for _, hold := range waiting {
+		var kept int
+		row := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM SET_HOLDS WHERE SERIES_ID=? AND STATUS='ready'", hold.SeriesId)
+		if err = row.Scan(&kept); err != nil {
+			return 0, err
+		}
+		var volumes, unavailable int
+		row = tx.QueryRowContext(ctx, "SELECT COUNT(*),COUNT(CASE WHEN CNT-?<1 THEN 1 END) FROM BOOKS WITH (UPDLOCK) WHERE SERIES_ID=? AND STATUS='active'",
+			kept, hold.SeriesId)
+		if err = row.Scan(&volumes, &unavailable); err != nil {
+			return 0, err
+		}
+		if volumes == 0 || unavailable > 0 {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE SET_HOLDS SET STATUS='ready',READY_AT=?,EXPIRES=? WHERE HID=?",
+			now, now.AddDate(0, 0, HoldPickupDays), hold.Hid)
+		if err != nil {
+			return 0, err
+		}
+		readied++
+	}
+	return readied, tx.Commit()
+}
+
+func processSetHolds() {
+	ctx, cancel := context.WithTimeout(context.Background(), SetHoldsInterval)
+	defer cancel()
+	readied, err := ProcessSetHolds(ctx)
+	if err != nil {
+		log.Println("Failed to process holds on sets: " + err.Error())
+	} else if readied > 0 {
+		log.Printf("%d holds on sets are ready.\n", readied)
+	}
+}
+
+// Process holds on sets every interval, should run as a goroutine.
+func RunSetHolds(interval time.Duration) {
+	for {
+		processSetHolds()
+		time.Sleep(interval)
+	}
+}
+
+func listSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	series, err := ListSeries()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(series)
+}
+
+func seriesInfoHandler(w http.ResponseWriter, r *http.Request) {
+	seriesId := r.PostFormValue("series")
+	if seriesId == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	series, err := GetSeriesInfo(seriesId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(series)
+}
+
+func newSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	series := Series{Id: r.PostFormValue("series"), Name: r.PostFormValue("name"),
+		IsSet: r.PostFormValue("set") == "1", Note: r.PostFormValue("note")}
+	if series.Id == "" || series.Name == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	err := AddSeries(series)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func borrowSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	seriesId := r.PostFormValue("series")
+	duration := r.PostFormValue("duration")
+	if seriesId == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if duration == "" {
+		duration = "30"
+	}
+	durationInt, err := strconv.Atoi(duration)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	result := BorrowSeries(ctx, GetTokenUsername(tokenCookie.Value), seriesId, time.Now().UTC(), time.Now().UTC().Add(time.Duration(durationInt*24)*time.Hour))
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("🎉 恭喜! 整套借书成功!"))
+}
+
+func holdSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	seriesId := r.PostFormValue("series")
+	if seriesId == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	result := PlaceSetHold(ctx, GetTokenUsername(tokenCookie.Value), seriesId)
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	processSetHolds() // The set may be available now.
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+// Readers see their own holds, admins those of "username", or everyone's.
+func listSetHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	username := r.PostFormValue("username")
+	if !ChkTokensIsAdmin(tokenCookie.Value) {
+		username = GetTokenUsername(tokenCookie.Value)
+	}
+	holds, err := ListSetHolds(username)
+	if err != nil {
+		http.Error(w, "无法完成查询. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(holds)
+}
+
+// Cancel the hold "hid", readers can only cancel their own.
+func cancelSetHoldHandler(w http.ResponseWriter, r *http.Request) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil || tokenCookie.Valid() != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	hid, err := strconv.Atoi(r.PostFormValue("hid"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	username := ""
+	if !ChkTokensIsAdmin(tokenCookie.Value) {
+		username = GetTokenUsername(tokenCookie.Value)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
+	defer cancel()
+	result := CancelSetHold(ctx, hid, username)
+	if ctx.Err() != nil {
+		http.Error(w, "操作超时. 请联系管理员.", http.StatusConflict)
+		return
+	}
+	if result != "" {
+		http.Error(w, result, http.StatusConflict)
+		return
+	}
+	processSetHolds() // The copies kept may go to the next hold.
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
@@ -0,0 +1,430 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-20 00:25:40
+ * @LastEditTime: 2026-10-20 02:52:00
+ * @LastEditors: FunctionSir
+ * @Description: Session stores, in memory, in the database or in a file.
+ * @FilePath: /biblio-matrix/sessions.go
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/FunctionSir/goset"
+)
+
+type Session struct {
+	// SHA-256 of the token, see HashToken. Tokens themselves are never kept,
+	// so a leaked store gives no way to use the sessions.
+	TokenHash string    `json:"token_hash"`
+	Username  string    `json:"username"`
+	IsAdmin   bool      `json:"is_admin"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	LastSeen  time.Time `json:"last_seen"`
+	Remember  bool      `json:"remember"`
+	// Where the session was logged in from.
+	Ip        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+}
+
+// A session as listed, the token is left out, so that listing sessions
+// gives no way to use them.
+type SessionInfo struct {
+	Id        string    `json:"id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	Expires   time.Time `json:"expires"`
+	Ip        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Current   bool      `json:"current"`
+}
+
+// User agents longer than this are cut.
+const MaxUserAgentLen = 512
+
+// Hash of a token, as sessions are keyed by.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// ID of a session, a prefix of the hash of its token, and safe to show.
+func SessionId(hash string) string {
+	return hash[:16]
+}
+
+// Info of a session, current is the hash of the token of the one asking.
+// "admin" or "reader".
+func RoleName(isAdmin bool) string {
+	if isAdmin {
+		return "admin"
+	}
+	return "reader"
+}
+
+func (s Session) Info(current string) SessionInfo {
+	return SessionInfo{Id: SessionId(s.TokenHash), Username: s.Username, Role: RoleName(s.IsAdmin), Created: s.Created, LastSeen: s.LastSeen,
+		Expires: s.Expires, Ip: s.Ip, UserAgent: s.UserAgent, Current: s.TokenHash == current}
+}
+
+// Where sessions are kept. Expired sessions are never returned, but idle
+// ones are, it is up to the caller to end them.
+type SessionStore interface {
+	Get(token string) (Session, bool)
+	Put(s Session) error
+	Touch(token string, seen time.Time)
+	// Sessions of username, or of everyone if username is empty.
+	List(username string) []Session
+	Delete(token string)
+	// End the session of the token of the hash given.
+	DeleteHash(hash string)
+	// End sessions of username of the role given, an admin and a reader may
+	// have the same name.
+	DeleteUser(username string, isAdmin bool)
+	Clear()
+}
+
+var Sessions SessionStore
+
+// Sessions end this long after login, or RememberMeTTL if asked to be
+// remembered.
+var SessionTTL time.Duration
+var RememberMeTTL time.Duration
+
+// Sessions not remembered end after being idle this long, 0 to never.
+var SessionIdleTimeout time.Duration
+
+// How long a session lasts after login.
+func SessionLifetime(remember bool) time.Duration {
+	if remember {
+		return RememberMeTTL
+	}
+	return SessionTTL
+}
+
+// Last seen times are written at most this often, to spare the stores.
+const SessionTouchInterval = time.Minute
+
+// Sessions in maps of this process keyed by token hashes, lost on restarts.
+type memorySessionStore struct {
+	lock     sync.Mutex
+	hashes   goset.Set[string]
+	sessions map[string]Session
+}
+
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{hashes: make(goset.Set[string]), sessions: make(map[string]Session)}
+}
+
+func (m *memorySessionStore) Get(token string) (Session, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	hash := HashToken(token)
+	if !m.hashes.Has(hash) {
+		return Session{}, false
+	}
+	s := m.sessions[hash]
+	if !s.Expires.After(time.Now()) {
+		m.hashes.Erase(hash)
+		delete(m.sessions, hash)
+		return Session{}, false
+	}
+	return s, true
+}
+
+func (m *memorySessionStore) Put(s Session) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.hashes.Insert(s.TokenHash)
+	m.sessions[s.TokenHash] = s
+	return nil
+}
+
+// The lock must be held, reports if the session is there.
+func (m *memorySessionStore) touch(hash string, seen time.Time) bool {
+	s, ok := m.sessions[hash]
+	if ok {
+		s.LastSeen = seen
+		m.sessions[hash] = s
+	}
+	return ok
+}
+
+func (m *memorySessionStore) Touch(token string, seen time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.touch(HashToken(token), seen)
+}
+
+func (m *memorySessionStore) List(username string) []Session {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	sessions := make([]Session, 0)
+	for _, s := range m.sessions {
+		if s.Expires.After(now) && (username == "" || s.Username == username) {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+func (m *memorySessionStore) Delete(token string) {
+	m.DeleteHash(HashToken(token))
+}
+
+func (m *memorySessionStore) DeleteHash(hash string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.hashes.Erase(hash)
+	delete(m.sessions, hash)
+}
+
+// The lock must be held.
+func (m *memorySessionStore) deleteUser(username string, isAdmin bool) {
+	for hash, s := range m.sessions {
+		if s.Username == username && s.IsAdmin == isAdmin {
+			m.hashes.Erase(hash)
+			delete(m.sessions, hash)
+		}
+	}
+}
+
+func (m *memorySessionStore) DeleteUser(username string, isAdmin bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.deleteUser(username, isAdmin)
+}
+
+func (m *memorySessionStore) Clear() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	clear(m.hashes)
+	clear(m.sessions)
+}
+
+// Sessions in the SESSIONS table keyed by token hashes, shared by all server
+// instances using the same database.
+type dbSessionStore struct{}
+
+const sessionCols = "TOKEN_HASH,USERNAME,IS_ADMIN,CREATED,EXPIRES,LAST_SEEN,REMEMBER,COALESCE(IP,''),COALESCE(USER_AGENT,'')"
+
+func scanSession(row interface{ Scan(...any) error }) (Session, error) {
+	var s Session
+	err := row.Scan(&s.TokenHash, &s.Username, &s.IsAdmin, &s.Created, &s.Expires, &s.LastSeen, &s.Remember, &s.Ip, &s.UserAgent)
+	return s, err
+}
+
+func NewDbSessionStore() SessionStore {
+	return dbSessionStore{}
+}
+
+func (dbSessionStore) Get(token string) (Session, bool) {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "SELECT "+sessionCols+" FROM SESSIONS WHERE TOKEN_HASH=? AND EXPIRES>?")
+	s, err := scanSession(stmt.QueryRow(HashToken(token), time.Now().UTC()))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("Failed to get session: " + err.Error())
+		}
+		return Session{}, false
+	}
+	return s, true
+}
+
+// Expired sessions are purged here, since sessions are put far less often
+// than got.
+func (dbSessionStore) Put(s Session) error {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "DELETE FROM SESSIONS WHERE EXPIRES<=?")
+	if _, err := stmt.Exec(time.Now().UTC()); err != nil {
+		return err
+	}
+	stmt = DbPrepare(db, "INSERT INTO SESSIONS (TOKEN_HASH,USERNAME,IS_ADMIN,CREATED,EXPIRES,LAST_SEEN,REMEMBER,IP,USER_AGENT) VALUES (?,?,?,?,?,?,?,?,?)")
+	_, err := stmt.Exec(s.TokenHash, s.Username, s.IsAdmin, s.Created.UTC(), s.Expires.UTC(), s.LastSeen.UTC(), s.Remember,
+		NullString(s.Ip), NullString(s.UserAgent))
+	return err
+}
+
+func (dbSessionStore) Touch(token string, seen time.Time) {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "UPDATE SESSIONS SET LAST_SEEN=? WHERE TOKEN_HASH=?")
+	if _, err := stmt.Exec(seen.UTC(), HashToken(token)); err != nil {
+		log.Println("Failed to touch session: " + err.Error())
+	}
+}
+
+func (dbSessionStore) List(username string) []Session {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "SELECT "+sessionCols+" FROM SESSIONS WHERE EXPIRES>? AND (?='' OR USERNAME=?) ORDER BY LAST_SEEN DESC")
+	rows, err := stmt.Query(time.Now().UTC(), username, username)
+	if err != nil {
+		log.Println("Failed to list sessions: " + err.Error())
+		return nil
+	}
+	defer rows.Close()
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			log.Println("Failed to list sessions: " + err.Error())
+			return nil
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func (d dbSessionStore) Delete(token string) {
+	d.DeleteHash(HashToken(token))
+}
+
+func (dbSessionStore) DeleteHash(hash string) {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "DELETE FROM SESSIONS WHERE TOKEN_HASH=?")
+	if _, err := stmt.Exec(hash); err != nil {
+		log.Println("Failed to delete session: " + err.Error())
+	}
+}
+
+func (dbSessionStore) DeleteUser(username string, isAdmin bool) {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "DELETE FROM SESSIONS WHERE USERNAME=? AND IS_ADMIN=?")
+	if _, err := stmt.Exec(username, isAdmin); err != nil {
+		log.Println("Failed to delete sessions: " + err.Error())
+	}
+}
+
+func (dbSessionStore) Clear() {
+	db := DbOpen(DbConn)
+	if _, err := db.Exec("DELETE FROM SESSIONS"); err != nil {
+		log.Println("Failed to clear sessions: " + err.Error())
+	}
+}
+
+// Sessions in memory, saved to a JSON file on every change and loaded on
+// start, with token hashes only. Only for a single server instance.
+type fileSessionStore struct {
+	memorySessionStore
+	path string
+}
+
+func NewFileSessionStore(path string) (SessionStore, error) {
+	f := &fileSessionStore{memorySessionStore: memorySessionStore{hashes: make(goset.Set[string]), sessions: make(map[string]Session)}, path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]Session, 0)
+	if err = json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, s := range sessions {
+		// Files of older versions keep tokens instead, those are dropped.
+		if s.TokenHash != "" && s.Expires.After(now) {
+			f.hashes.Insert(s.TokenHash)
+			f.sessions[s.TokenHash] = s
+		}
+	}
+	return f, nil
+}
+
+// Write sessions to a temporary file and rename it, the lock must be held.
+func (f *fileSessionStore) save() error {
+	sessions := make([]Session, 0, len(f.sessions))
+	now := time.Now()
+	for _, s := range f.sessions {
+		if s.Expires.After(now) {
+			sessions = append(sessions, s)
+		}
+	}
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".sessions-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (f *fileSessionStore) Put(s Session) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.hashes.Insert(s.TokenHash)
+	f.sessions[s.TokenHash] = s
+	return f.save()
+}
+
+func (f *fileSessionStore) Touch(token string, seen time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.touch(HashToken(token), seen) {
+		if err := f.save(); err != nil {
+			log.Println("Failed to save sessions: " + err.Error())
+		}
+	}
+}
+
+func (f *fileSessionStore) Delete(token string) {
+	f.DeleteHash(HashToken(token))
+}
+
+func (f *fileSessionStore) DeleteHash(hash string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.hashes.Erase(hash)
+	delete(f.sessions, hash)
+	if err := f.save(); err != nil {
+		log.Println("Failed to save sessions: " + err.Error())
+	}
+}
+
+func (f *fileSessionStore) DeleteUser(username string, isAdmin bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.deleteUser(username, isAdmin)
+	if err := f.save(); err != nil {
+		log.Println("Failed to save sessions: " + err.Error())
+	}
+}
+
+func (f *fileSessionStore) Clear() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	clear(f.hashes)
+	clear(f.sessions)
+	if err := f.save(); err != nil {
+		log.Println("Failed to save sessions: " + err.Error())
+	}
+}
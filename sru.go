@@ -0,0 +1,718 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-19 20:31:50
+ * @LastEditTime: 2026-10-20 01:42:05
+ * @LastEditors: FunctionSir
+ * @Description: SRU 1.2 server, searchRetrieve with CQL and explain.
+ * @FilePath: /biblio-matrix/sru.go
+ */
+
+package main
+
+import (
+	"encoding/xml"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const SruVersion = "1.2"
+const SruDiagPrefix = "info:srw/diagnostic/1/"
+
+// Records in a response by default and at most.
+const SruDefaultRecords = 10
+const SruMaxRecords = 100
+
+// Record schemas, by short name, and their identifiers.
+var SruSchemas = []struct {
+	Name, Id, Title string
+}{
+	{"marcxml", "info:srw/schema/1/marcxml-v1.1", "MARCXML"},
+	{"dc", "info:srw/schema/1/dc-v1.1", "Dublin Core"},
+}
+
+const SruDcNs = "info:srw/schema/1/dc-schema"
+
+// Context sets of CQL indexes.
+var CqlSets = map[string]string{
+	"cql":   "info:srw/cql-context-set/1/cql-v1.2",
+	"dc":    "info:srw/cql-context-set/1/dc-v1.1",
+	"bath":  "http://zing.z3950.org/cql/bath/2.0/",
+	"rec":   "info:srw/cql-context-set/2/rec-1.1",
+	"local": "info:srw/cql-context-set/local",
+}
+
+// Where values of an index are in the DB: an expression of BOOKS, or of a
+// table of lists of books like BOOK_SUBJECTS, named "L" and joined by ID.
+// Expressions must not be NULL, an empty value matches nothing.
+type CqlSource struct {
+	Expr  string
+	From  string // Table of the list, empty for BOOKS
+	Where string // Condition on rows of the list, if any
+}
+
+type CqlIndex struct {
+	Set     string
+	Name    string
+	Title   string
+	Sources []CqlSource
+}
+
+var (
+	cqlId          = CqlSource{Expr: "BOOKS.ID"}
+	cqlName        = CqlSource{Expr: "BOOKS.\"NAME\""}
+	cqlAuthor      = CqlSource{Expr: "BOOKS.AUTHOR"}
+	cqlPublisher   = CqlSource{Expr: "BOOKS.PUBLISHER"}
+	cqlYear        = CqlSource{Expr: "CASE WHEN BOOKS.PUB_YEAR>0 THEN CAST(BOOKS.PUB_YEAR AS VARCHAR(11)) ELSE '' END"}
+	cqlSummary     = CqlSource{Expr: "BOOKS.SUMMARY"}
+	cqlLanguage    = CqlSource{Expr: "BOOKS.LANG"}
+	cqlClc         = CqlSource{Expr: "BOOKS.CLC"}
+	cqlDdc         = CqlSource{Expr: "BOOKS.DDC"}
+	cqlCallNumber  = CqlSource{Expr: "BOOKS.CALL_NO"}
+	cqlSeries      = CqlSource{Expr: "ISNULL(BOOKS.SERIES_ID,'')"}
+	cqlIsbn        = CqlSource{Expr: "BOOKS.ISBN"}
+	cqlIsbnUrn     = CqlSource{Expr: "CASE WHEN BOOKS.ISBN<>'' THEN 'urn:isbn:'+BOOKS.ISBN ELSE '' END"}
+	cqlSubjects    = CqlSource{Expr: "L.SUBJECT", From: "BOOK_SUBJECTS"}
+	cqlContributor = CqlSource{Expr: "L.\"NAME\"", From: "BOOK_CONTRIBUTORS"}
+	cqlAuthors     = CqlSource{Expr: "L.\"NAME\"", From: "BOOK_CONTRIBUTORS", Where: "L.\"ROLE\"='author'"}
+	// The author of BOOKS is the author only if no contributor is, as contributorNames.
+	cqlOnlyAuthor = CqlSource{Expr: "CASE WHEN NOT EXISTS (SELECT * FROM BOOK_CONTRIBUTORS C WHERE C.ID=BOOKS.ID AND C.\"ROLE\"='author') THEN BOOKS.AUTHOR ELSE '' END"}
+	cqlMarcLang   = CqlSource{Expr: marcLanguageSql("BOOKS.LANG")}
+)
+
+// An SQL expression of marcLanguage.
+func marcLanguageSql(expr string) string {
+	languages := make([]string, 0, len(MarcLanguages))
+	for language := range MarcLanguages {
+		languages = append(languages, language)
+	}
+	slices.Sort(languages)
+	var res strings.Builder
+	res.WriteString("CASE LOWER(LTRIM(RTRIM(" + expr + ")))")
+	for _, language := range languages {
+		res.WriteString(" WHEN N'" + language + "' THEN '" + MarcLanguages[language] + "'")
+	}
+	res.WriteString(" ELSE 'und' END")
+	return res.String()
+}
+
+// Supported indexes, an index without a set prefix in a query is the first
+// one here with the name.
+var CqlIndexes = []CqlIndex{
+	{"cql", "serverChoice", "任意字段", []CqlSource{cqlId, cqlName, cqlPublisher, cqlIsbn, cqlSeries, cqlAuthor, cqlContributor, cqlSubjects}},
+	{"cql", "anywhere", "任意字段", []CqlSource{cqlId, cqlName, cqlPublisher, cqlIsbn, cqlSeries, cqlSummary, cqlClc, cqlDdc, cqlAuthor, cqlContributor, cqlSubjects}},
+	{"dc", "title", "书名", []CqlSource{cqlName, cqlSeries}},
+	{"dc", "creator", "作者", []CqlSource{cqlAuthors, cqlOnlyAuthor}},
+	{"dc", "contributor", "责任者", []CqlSource{cqlAuthor, cqlContributor}},
+	{"dc", "subject", "主题", []CqlSource{cqlClc, cqlDdc, cqlSubjects}},
+	{"dc", "publisher", "出版社", []CqlSource{cqlPublisher}},
+	{"dc", "date", "出版年", []CqlSource{cqlYear}},
+	{"dc", "description", "简介", []CqlSource{cqlSummary}},
+	{"dc", "identifier", "标识符", []CqlSource{cqlId, cqlIsbn, cqlIsbnUrn}},
+	{"dc", "language", "语言", []CqlSource{cqlLanguage, cqlMarcLang}},
+	{"bath", "isbn", "ISBN", []CqlSource{cqlIsbn}},
+	{"rec", "identifier", "图书ID", []CqlSource{cqlId}},
+	{"local", "clc", "中图法分类号", []CqlSource{cqlClc}},
+	{"local", "ddc", "杜威分类号", []CqlSource{cqlDdc}},
+	{"local", "callnumber", "索书号", []CqlSource{cqlCallNumber}},
+}
+
+// Common names of indexes which are not in any set.
+var CqlAliases = map[string]string{
+	"author": "dc.creator", "year": "dc.date", "id": "rec.identifier", "callno": "local.callnumber",
+}
+
+func findCqlIndex(name string) *CqlIndex {
+	if alias, ok := CqlAliases[strings.ToLower(name)]; ok {
+		name = alias
+	}
+	set, base, prefixed := strings.Cut(name, ".")
+	if !prefixed {
+		set, base = "", name
+	}
+	for i := range CqlIndexes {
+		index := &CqlIndexes[i]
+		if (set == "" || strings.EqualFold(set, index.Set)) && strings.EqualFold(base, index.Name) {
+			return index
+		}
+	}
+	return nil
+}
+
+// A diagnostic of SRU, also used as the error of CQL parsing.
+type SruDiagnostic struct {
+	XMLName xml.Name `xml:"http://www.loc.gov/zing/srw/diagnostic/ diagnostic"`
+	Uri     string   `xml:"uri"`
+	Details string   `xml:"details,omitempty"`
+	Message string   `xml:"message,omitempty"`
+}
+
+func (d *SruDiagnostic) Error() string {
+	return d.Message + ": " + d.Details
+}
+
+func sruDiag(code int, details string, message string) *SruDiagnostic {
+	return &SruDiagnostic{Uri: SruDiagPrefix + strconv.Itoa(code), Details: details, Message: message}
+}
+
+type cqlToken struct {
+	Text   string
+	Quoted bool
+}
+
+func (t *cqlToken) is(texts ...string) bool {
+	if t == nil || t.Quoted {
+		return false
+	}
+	for _, text := range texts {
+		if strings.EqualFold(t.Text, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenizeCql(query string) ([]cqlToken, error) {
+	tokens := make([]cqlToken, 0)
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\r' || r == '\n':
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, cqlToken{Text: string(r)})
+			i++
+		case r == '/':
+			return nil, sruDiag(20, "/", "Unsupported relation modifier")
+		case r == '<' || r == '>' || r == '=':
+			text := string(r)
+			if i+1 < len(runes) && (runes[i+1] == '=' || r == '<' && runes[i+1] == '>') {
+				text += string(runes[i+1])
+			}
+			tokens = append(tokens, cqlToken{Text: text})
+			i += len(text)
+		case r == '"':
+			var text strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+					// Escaped wildcards are kept escaped, for matching.
+					if runes[i] == '*' || runes[i] == '?' {
+						text.WriteRune('\\')
+					}
+				}
+				text.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, sruDiag(10, query, "Query syntax error")
+			}
+			tokens = append(tokens, cqlToken{Text: text.String(), Quoted: true})
+			i++
+		default:
+			start := i
+			for i < len(runes) && !strings.ContainsRune(" \t\r\n()/<>=\"", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, cqlToken{Text: string(runes[start:i])})
+		}
+	}
+	return tokens, nil
+}
+
+// A node of a parsed CQL query.
+type CqlNode interface {
+	// The SQL condition on BOOKS, with its parameters appended to args.
+	Sql(args *[]any) string
+}
+
+type cqlBoolean struct {
+	Op          string // "and", "or" or "not"
+	Left, Right CqlNode
+}
+
+func (n *cqlBoolean) Sql(args *[]any) string {
+	left := n.Left.Sql(args)
+	right := n.Right.Sql(args)
+	switch n.Op {
+	case "and":
+		return "(" + left + " AND " + right + ")"
+	case "or":
+		return "(" + left + " OR " + right + ")"
+	default:
+		return "(" + left + " AND NOT " + right + ")"
+	}
+}
+
+type cqlClause struct {
+	Index    *CqlIndex
+	Relation string
+	Words    []string // LIKE patterns of words of the term, or of the whole term for "=", "==" and "<>"
+	Term     string
+}
+
+// Turn a term with CQL wildcards into a LIKE pattern (escaped by "\"), which
+// matches anywhere in a value, or the whole value if anchored.
+func cqlLikePattern(term string, anchored bool) string {
+	var pattern strings.Builder
+	if !anchored {
+		pattern.WriteString("%")
+	}
+	runes := []rune(term)
+	for i := 0; i < len(runes); i++ {
+		switch {
+		case runes[i] == '\\' && i+1 < len(runes):
+			i++
+			if strings.ContainsRune("%_[\\", runes[i]) {
+				pattern.WriteRune('\\')
+			}
+			pattern.WriteRune(runes[i])
+		case runes[i] == '*':
+			pattern.WriteString("%")
+		case runes[i] == '?':
+			pattern.WriteString("_")
+		case strings.ContainsRune("%_[\\", runes[i]):
+			pattern.WriteRune('\\')
+			pattern.WriteRune(runes[i])
+		default:
+			pattern.WriteRune(runes[i])
+		}
+	}
+	if !anchored {
+		pattern.WriteString("%")
+	}
+	return pattern.String()
+}
+
+func newCqlClause(indexName string, relation string, term string) (*cqlClause, error) {
+	index := findCqlIndex(indexName)
+	if index == nil {
+		return nil, sruDiag(16, indexName, "Unsupported index")
+	}
+	relation = strings.ToLower(relation)
+	if index.Name == "isbn" {
+		if isbn, err := NormalizeIsbn(term); err == nil && isbn != "" {
+			term = isbn
+		}
+	}
+	clause := &cqlClause{Index: index, Relation: relation, Term: term}
+	switch relation {
+	case "=", "adj", "<>":
+		clause.Words = []string{cqlLikePattern(strings.Join(strings.Fields(term), " "), false)}
+	case "==", "exact":
+		clause.Words = []string{cqlLikePattern(term, true)}
+	case "any", "all":
+		for _, word := range strings.Fields(term) {
+			clause.Words = append(clause.Words, cqlLikePattern(word, false))
+		}
+	case "<", ">", "<=", ">=":
+	default:
+		return nil, sruDiag(19, relation, "Unsupported relation")
+	}
+	return clause, nil
+}
+
+// The condition that any value of the index is not empty and satisfies cond,
+// which turns an expression into a condition and appends its parameters.
+func (c *cqlClause) anyValue(args *[]any, cond func(expr string, args *[]any) string) string {
+	conds := make([]string, 0, len(c.Index.Sources))
+	for _, source := range c.Index.Sources {
+		valueCond := source.Expr + "<>'' AND " + cond(source.Expr, args)
+		if source.From == "" {
+			conds = append(conds, "("+valueCond+")")
+			continue
+		}
+		where := "L.ID=BOOKS.ID"
+		if source.Where != "" {
+			where += " AND " + source.Where
+		}
+		conds = append(conds, "EXISTS (SELECT * FROM "+source.From+" L WHERE "+where+" AND "+valueCond+")")
+	}
+	return "(" + strings.Join(conds, " OR ") + ")"
+}
+
+func (c *cqlClause) like(pattern string, args *[]any) string {
+	return c.anyValue(args, func(expr string, args *[]any) string {
+		*args = append(*args, pattern)
+		return expr + " LIKE ? ESCAPE '\\'"
+	})
+}
+
+// Values are compared numerically if the term is a number, or else as
+// strings, by the collation of the DB.
+func (c *cqlClause) compare(args *[]any) string {
+	return c.anyValue(args, func(expr string, args *[]any) string {
+		if n, err := strconv.ParseInt(c.Term, 10, 64); err == nil {
+			*args = append(*args, n)
+			return "TRY_CAST(" + expr + " AS BIGINT)" + c.Relation + "?"
+		}
+		*args = append(*args, c.Term)
+		return expr + c.Relation + "?"
+	})
+}
+
+func (c *cqlClause) Sql(args *[]any) string {
+	switch c.Relation {
+	case "<>":
+		return "NOT " + c.like(c.Words[0], args)
+	case "<", ">", "<=", ">=":
+		return c.compare(args)
+	}
+	if len(c.Words) == 0 {
+		return "1=0"
+	}
+	op := " OR "
+	if c.Relation == "all" {
+		op = " AND "
+	}
+	conds := make([]string, len(c.Words))
+	for i, word := range c.Words {
+		conds[i] = c.like(word, args)
+	}
+	if len(conds) == 1 {
+		return conds[0]
+	}
+	return "(" + strings.Join(conds, op) + ")"
+}
+
+var cqlRelations = []string{"=", "==", "<>", "<", ">", "<=", ">=", "any", "all", "adj", "exact", "within", "encloses"}
+
+type cqlParser struct {
+	tokens []cqlToken
+	pos    int
+}
+
+func (p *cqlParser) peek() *cqlToken {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *cqlParser) next() *cqlToken {
+	t := p.peek()
+	if t != nil {
+		p.pos++
+	}
+	return t
+}
+
+// Parse a query, clauses joined by booleans, left to right.
+func (p *cqlParser) query() (CqlNode, error) {
+	left, err := p.clause()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.is("prox") {
+			return nil, sruDiag(37, t.Text, "Unsupported boolean operator")
+		}
+		if !t.is("and", "or", "not") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.clause()
+		if err != nil {
+			return nil, err
+		}
+		left = &cqlBoolean{Op: strings.ToLower(t.Text), Left: left, Right: right}
+	}
+}
+
+func (p *cqlParser) clause() (CqlNode, error) {
+	t := p.next()
+	if t == nil || t.is(")", "=", "==", "<>", "<", ">", "<=", ">=") {
+		return nil, sruDiag(10, "", "Query syntax error")
+	}
+	if t.is("(") {
+		node, err := p.query()
+		if err != nil {
+			return nil, err
+		}
+		if !p.next().is(")") {
+			return nil, sruDiag(13, ")", "Invalid or unsupported use of parentheses")
+		}
+		return node, nil
+	}
+	if relation := p.peek(); relation.is(cqlRelations...) {
+		p.next()
+		term := p.next()
+		if term == nil || term.is("(", ")", "=", "==", "<>", "<", ">", "<=", ">=") {
+			return nil, sruDiag(10, t.Text+" "+relation.Text, "Query syntax error")
+		}
+		return newCqlClause(t.Text, relation.Text, term.Text)
+	}
+	return newCqlClause("cql.serverChoice", "=", t.Text)
+}
+
+// Parse a CQL query, errors are *SruDiagnostic.
+func ParseCql(query string) (CqlNode, error) {
+	tokens, err := tokenizeCql(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &cqlParser{tokens: tokens}
+	node, err := p.query()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t != nil {
+		return nil, sruDiag(10, t.Text, "Query syntax error")
+	}
+	return node, nil
+}
+
+// Search books not withdrawn by a CQL query, ordered by ID. Returns at most
+// limit books after the first offset ones, and the number of books found.
+func SearchCql(query string, offset int, limit int) ([]Book, int, error) {
+	node, err := ParseCql(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	args := make([]any, 0)
+	where := "STATUS='active' AND " + node.Sql(&args)
+	db := DbOpen(DbConn)
+	var total int
+	err = db.QueryRow("SELECT COUNT(*) FROM BOOKS WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	if limit <= 0 || offset >= total {
+		return make([]Book, 0), total, nil
+	}
+	books, err := QueryBooks(where+" ORDER BY ID OFFSET ? ROWS FETCH NEXT ? ROWS ONLY", append(args, offset, limit)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return books, total, nil
+}
+
+type SruRecordData struct {
+	Xml  string `xml:",innerxml"`
+	Text string `xml:",chardata"`
+}
+
+type SruRecord struct {
+	Schema   string        `xml:"recordSchema"`
+	Packing  string        `xml:"recordPacking"`
+	Data     SruRecordData `xml:"recordData"`
+	Position int           `xml:"recordPosition"`
+}
+
+type SruSearchResponse struct {
+	XMLName            xml.Name        `xml:"http://www.loc.gov/zing/srw/ searchRetrieveResponse"`
+	Version            string          `xml:"version"`
+	NumberOfRecords    int             `xml:"numberOfRecords"`
+	Records            []SruRecord     `xml:"records>record"`
+	NextRecordPosition int             `xml:"nextRecordPosition,omitempty"`
+	Diagnostics        []SruDiagnostic `xml:"diagnostics>diagnostic"`
+}
+
+type SruExplainResponse struct {
+	XMLName     xml.Name        `xml:"http://www.loc.gov/zing/srw/ explainResponse"`
+	Version     string          `xml:"version"`
+	Record      *SruRecord      `xml:"record,omitempty"`
+	Diagnostics []SruDiagnostic `xml:"diagnostics>diagnostic"`
+}
+
+// The ZeeRex record of explain.
+type zeerexExplain struct {
+	XMLName    xml.Name `xml:"http://explain.z3950.org/dtd/2.0/ explain"`
+	ServerInfo struct {
+		Protocol string `xml:"protocol,attr"`
+		Version  string `xml:"version,attr"`
+		Host     string `xml:"host"`
+		Port     string `xml:"port"`
+		Database string `xml:"database"`
+	} `xml:"serverInfo"`
+	DatabaseInfo struct {
+		Title string `xml:"title"`
+	} `xml:"databaseInfo"`
+	Sets    []zeerexSet    `xml:"indexInfo>set"`
+	Indexes []zeerexIndex  `xml:"indexInfo>index"`
+	Schemas []zeerexSchema `xml:"schemaInfo>schema"`
+	Configs []zeerexConfig `xml:"configInfo>default"`
+}
+
+type zeerexSet struct {
+	Name       string `xml:"name,attr"`
+	Identifier string `xml:"identifier,attr"`
+}
+
+type zeerexIndex struct {
+	Title string     `xml:"title"`
+	Name  zeerexName `xml:"map>name"`
+}
+
+type zeerexName struct {
+	Set  string `xml:"set,attr"`
+	Name string `xml:",chardata"`
+}
+
+type zeerexSchema struct {
+	Identifier string `xml:"identifier,attr"`
+	Name       string `xml:"name,attr"`
+	Title      string `xml:"title"`
+}
+
+type zeerexConfig struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+func sruExplainRecord(r *http.Request) string {
+	var explain zeerexExplain
+	explain.ServerInfo.Protocol = "SRU"
+	explain.ServerInfo.Version = SruVersion
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, "80"
+		if r.TLS != nil {
+			port = "443"
+		}
+	}
+	explain.ServerInfo.Host = host
+	explain.ServerInfo.Port = port
+	explain.ServerInfo.Database = strings.TrimPrefix(r.URL.Path, "/")
+	explain.DatabaseInfo.Title = "Biblio Matrix"
+	for _, name := range []string{"cql", "dc", "bath", "rec", "local"} {
+		explain.Sets = append(explain.Sets, zeerexSet{Name: name, Identifier: CqlSets[name]})
+	}
+	for _, index := range CqlIndexes {
+		explain.Indexes = append(explain.Indexes, zeerexIndex{Title: index.Title, Name: zeerexName{Set: index.Set, Name: index.Name}})
+	}
+	for _, schema := range SruSchemas {
+		explain.Schemas = append(explain.Schemas, zeerexSchema{Identifier: schema.Id, Name: schema.Name, Title: schema.Title})
+	}
+	explain.Configs = []zeerexConfig{
+		{Type: "numberOfRecords", Value: strconv.Itoa(SruDefaultRecords)},
+		{Type: "maximumRecords", Value: strconv.Itoa(SruMaxRecords)},
+	}
+	out, err := xml.Marshal(explain)
+	if err != nil {
+		return ""
+	}
+	return string(out)
+}
+
+// Find the identifier of a record schema by its name or identifier, MARCXML
+// if absent.
+func sruSchema(schema string) (string, bool) {
+	if schema == "" {
+		return SruSchemas[0].Id, true
+	}
+	for _, s := range SruSchemas {
+		if strings.EqualFold(schema, s.Name) || schema == s.Id {
+			return s.Id, true
+		}
+	}
+	return "", false
+}
+
+func sruRecordData(b Book, schema string, packing string) SruRecordData {
+	var record string
+	if schema == SruSchemas[1].Id {
+		record = BookToDublinCore(b, "srw_dc:dc", SruDcNs)
+	} else {
+		record = BookToMarcXML(b)
+	}
+	if packing == "string" {
+		return SruRecordData{Text: record}
+	}
+	return SruRecordData{Xml: record}
+}
+
+// Parse a positive integer parameter, def if absent.
+func sruIntParam(r *http.Request, name string, def int) (int, *SruDiagnostic) {
+	value := r.FormValue(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, sruDiag(6, name, "Unsupported parameter value")
+	}
+	return n, nil
+}
+
+func sruSearchRetrieve(r *http.Request) SruSearchResponse {
+	res := SruSearchResponse{Version: SruVersion}
+	fail := func(diag *SruDiagnostic) SruSearchResponse {
+		res.Diagnostics = []SruDiagnostic{*diag}
+		return res
+	}
+	query := r.FormValue("query")
+	if query == "" {
+		return fail(sruDiag(7, "query", "Mandatory parameter not supplied"))
+	}
+	start, diag := sruIntParam(r, "startRecord", 1)
+	if diag != nil {
+		return fail(diag)
+	}
+	if start < 1 {
+		return fail(sruDiag(6, "startRecord", "Unsupported parameter value"))
+	}
+	maximum, diag := sruIntParam(r, "maximumRecords", SruDefaultRecords)
+	if diag != nil {
+		return fail(diag)
+	}
+	maximum = min(maximum, SruMaxRecords)
+	schema, ok := sruSchema(r.FormValue("recordSchema"))
+	if !ok {
+		return fail(sruDiag(66, r.FormValue("recordSchema"), "Unknown schema for retrieval"))
+	}
+	packing := r.FormValue("recordPacking")
+	if packing == "" {
+		packing = "xml"
+	}
+	if packing != "xml" && packing != "string" {
+		return fail(sruDiag(71, packing, "Unsupported record packing"))
+	}
+	books, total, err := SearchCql(query, start-1, maximum)
+	if diag, ok := err.(*SruDiagnostic); ok {
+		return fail(diag)
+	}
+	if err != nil {
+		return fail(sruDiag(1, err.Error(), "General system error"))
+	}
+	res.NumberOfRecords = total
+	if total > 0 && start > total {
+		return fail(sruDiag(61, strconv.Itoa(start), "First record position out of range"))
+	}
+	for i := range books {
+		res.Records = append(res.Records, SruRecord{Schema: schema, Packing: packing,
+			Data: sruRecordData(books[i], schema, packing), Position: start + i})
+	}
+	if next := start + maximum; next <= total {
+		res.NextRecordPosition = next
+	}
+	return res
+}
+
+// Serve SRU requests by GET or POST, "operation" is "searchRetrieve" or
+// "explain", explain if absent. Errors are reported as diagnostics.
+func sruHandler(w http.ResponseWriter, r *http.Request) {
+	var res any
+	version := r.FormValue("version")
+	operation := r.FormValue("operation")
+	switch {
+	case version != "" && version != SruVersion && version != "1.1":
+		res = SruExplainResponse{Version: SruVersion, Diagnostics: []SruDiagnostic{*sruDiag(5, SruVersion, "Unsupported version")}}
+	case operation == "searchRetrieve":
+		res = sruSearchRetrieve(r)
+	case operation == "explain" || operation == "":
+		res = SruExplainResponse{Version: SruVersion, Record: &SruRecord{Schema: "http://explain.z3950.org/dtd/2.0/",
+			Packing: "xml", Data: SruRecordData{Xml: sruExplainRecord(r)}, Position: 1}}
+	default:
+		res = SruExplainResponse{Version: SruVersion, Diagnostics: []SruDiagnostic{*sruDiag(4, operation, "Unsupported operation")}}
+	}
+	w.Header().Add("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,134 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-20 01:42:05
+ * @LastEditTime: 2026-10-20 01:42:05
+ * @LastEditors: FunctionSir
+ * @Description: Tests of the CQL parser and its translation to SQL.
+ * @FilePath: /biblio-matrix/sru_test.go
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCqlLikePattern(t *testing.T) {
+	tests := []struct {
+		term     string
+		anchored bool
+		want     string
+	}{
+		{"三体", false, "%三体%"},
+		{"三体", true, "三体"},
+		{"san*", true, "san%"},
+		{"l?u", false, "%l_u%"},
+		{"100%", true, "100\\%"},
+		{"a_b[c]", true, "a\\_b\\[c]"},
+		{"a\\\\b", true, "a\\\\b"},
+		{"a\\b", true, "ab"},
+		{"\\*", true, "*"},
+		{"\\?x", true, "?x"},
+		{"", false, "%%"},
+	}
+	for _, tt := range tests {
+		if got := cqlLikePattern(tt.term, tt.anchored); got != tt.want {
+			t.Errorf("cqlLikePattern(%q, %v) = %q, want %q", tt.term, tt.anchored, got, tt.want)
+		}
+	}
+}
+
+func TestParseCql(t *testing.T) {
+	isbn := "(BOOKS.ISBN<>'' AND BOOKS.ISBN LIKE ? ESCAPE '\\')"
+	id := "(BOOKS.ID<>'' AND BOOKS.ID LIKE ? ESCAPE '\\')"
+	publisher := "(BOOKS.PUBLISHER<>'' AND BOOKS.PUBLISHER LIKE ? ESCAPE '\\')"
+	year := "CASE WHEN BOOKS.PUB_YEAR>0 THEN CAST(BOOKS.PUB_YEAR AS VARCHAR(11)) ELSE '' END"
+	subjects := "(BOOKS.CLC<>'' AND BOOKS.CLC LIKE ? ESCAPE '\\') OR (BOOKS.DDC<>'' AND BOOKS.DDC LIKE ? ESCAPE '\\') OR " +
+		"EXISTS (SELECT * FROM BOOK_SUBJECTS L WHERE L.ID=BOOKS.ID AND L.SUBJECT<>'' AND L.SUBJECT LIKE ? ESCAPE '\\')"
+	tests := []struct {
+		query string
+		where string
+		args  []any
+	}{
+		{"bath.isbn = 978-7-5366-9293-0", "(" + isbn + ")", []any{"%9787536692930%"}},
+		{"isbn == 9787536692930", "(" + isbn + ")", []any{"9787536692930"}},
+		{"rec.identifier exact \"1001\"", "(" + id + ")", []any{"1001"}},
+		{"id = 10*", "(" + id + ")", []any{"%10%%"}},
+		{"ID <> 1001", "NOT (" + id + ")", []any{"%1001%"}},
+		{"dc.publisher = \"人民  文学\"", "(" + publisher + ")", []any{"%人民 文学%"}},
+		{"dc.publisher any \"人民 文学\"", "((" + publisher + ") OR (" + publisher + "))", []any{"%人民%", "%文学%"}},
+		{"dc.publisher all \"人民 文学\"", "((" + publisher + ") AND (" + publisher + "))", []any{"%人民%", "%文学%"}},
+		{"dc.publisher all \"\"", "1=0", []any{}},
+		{"year >= 2000", "((" + year + "<>'' AND TRY_CAST(" + year + " AS BIGINT)>=?))", []any{int64(2000)}},
+		{"dc.date < abc", "((" + year + "<>'' AND " + year + "<?))", []any{"abc"}},
+		{"dc.subject = I247", "(" + subjects + ")", []any{"%I247%", "%I247%", "%I247%"}},
+		{"id = 1 and isbn = 978", "((" + id + ") AND (" + isbn + "))", []any{"%1%", "%978%"}},
+		{"id = 1 OR isbn = 978 not id = 2", "(((" + id + ") OR (" + isbn + ")) AND NOT (" + id + "))", []any{"%1%", "%978%", "%2%"}},
+		{"id = 1 and (isbn = 978 or id = 2)", "((" + id + ") AND ((" + isbn + ") OR (" + id + ")))", []any{"%1%", "%978%", "%2%"}},
+	}
+	for _, tt := range tests {
+		node, err := ParseCql(tt.query)
+		if err != nil {
+			t.Errorf("ParseCql(%q) failed: %v", tt.query, err)
+			continue
+		}
+		args := make([]any, 0)
+		where := node.Sql(&args)
+		if where != tt.where {
+			t.Errorf("ParseCql(%q) = %s, want %s", tt.query, where, tt.where)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("ParseCql(%q) args = %v, want %v", tt.query, args, tt.args)
+		}
+	}
+}
+
+func TestParseCqlServerChoice(t *testing.T) {
+	node, err := ParseCql("三体")
+	if err != nil {
+		t.Fatalf("ParseCql failed: %v", err)
+	}
+	args := make([]any, 0)
+	node.Sql(&args)
+	// One parameter for each source of cql.serverChoice.
+	if len(args) != len(findCqlIndex("cql.serverChoice").Sources) {
+		t.Errorf("got %d args, want one per source", len(args))
+	}
+	for _, arg := range args {
+		if arg != "%三体%" {
+			t.Errorf("arg = %v, want %%三体%%", arg)
+		}
+	}
+}
+
+func TestParseCqlErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		code  string
+	}{
+		{"foo = x", "16"},
+		{"title within x", "19"},
+		{"title / x", "20"},
+		{"(title = x", "13"},
+		{"title = x)", "10"},
+		{"title prox x", "37"},
+		{"title = x y", "10"},
+		{"title =", "10"},
+		{"= x", "10"},
+		{"\"x", "10"},
+		{"", "10"},
+	}
+	for _, tt := range tests {
+		_, err := ParseCql(tt.query)
+		diag, ok := err.(*SruDiagnostic)
+		if !ok {
+			t.Errorf("ParseCql(%q) = %v, want diagnostic %s", tt.query, err, tt.code)
+			continue
+		}
+		if diag.Uri != SruDiagPrefix+tt.code {
+			t.Errorf("ParseCql(%q) = %s, want diagnostic %s", tt.query, diag.Uri, tt.code)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-20 00:36:20
+ * @LastEditTime: 2026-10-20 03:13:00
+ * @LastEditors: FunctionSir
+ * @Description: Signed access and refresh tokens, and their revocation.
+ * @FilePath: /biblio-matrix/tokens.go
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+type TokenClaims struct {
+	Role string `json:"role"` // "admin" or "reader"
+	Type string `json:"typ"`  // "access" or "refresh"
+	// Asked to be remembered, so that the refresh cookie outlives the browser.
+	Remember bool `json:"rem,omitempty"`
+	// When the user logged in, kept through refreshes, so that sessions end
+	// SessionTTL (or RememberMeTTL) after it.
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Login time of the session of a token. Tokens issued before auth_time
+// was added count from when they were issued.
+func (c TokenClaims) Authenticated() time.Time {
+	if c.AuthTime != nil {
+		return c.AuthTime.Time
+	}
+	return c.IssuedAt.Time
+}
+
+// Tokens of a login or a refresh.
+type TokenPair struct {
+	Access         string
+	AccessExpires  time.Time
+	Refresh        string
+	RefreshExpires time.Time
+}
+
+// Signs tokens with the first key, and verifies them with any key, so that
+// keys can be rotated by putting a new key first and keeping the old ones
+// until tokens signed by them expire.
+type TokenSigner struct {
+	kid        string
+	signingKey ed25519.PrivateKey
+	keys       map[string]ed25519.PublicKey
+}
+
+// Nil unless signed tokens are used.
+var Signer *TokenSigner
+
+var AccessTokenTTL time.Duration
+var RefreshTokenTTL time.Duration
+
+const TokenIssuer = "biblio-matrix"
+
+// The revocation list is reloaded this often, so that revocations by other
+// server instances are seen.
+const RevocationsReloadInterval = 30 * time.Second
+
+// Times in tokens are of this precision, so that tokens issued in the same
+// second as a revocation are told apart.
+const TokenTimePrecision = time.Millisecond
+
+func init() {
+	// Times are parsed as floats, 1.830 may come back as 1.829999, so they are
+	// kept finer and rounded back to TokenTimePrecision after parsing.
+	jwt.TimePrecision = time.Microsecond
+}
+
+// Load keys from "KID:PATH" pairs separated by commas, the first one must be
+// a private key. Others can be public keys of retired private keys.
+func NewTokenSigner(spec string) (*TokenSigner, error) {
+	s := &TokenSigner{keys: make(map[string]ed25519.PublicKey)}
+	for i, pair := range strings.Split(spec, ",") {
+		kid, path, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || kid == "" {
+			return nil, errors.New("illegal token key: " + pair)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if private, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+			s.keys[kid] = private.(ed25519.PrivateKey).Public().(ed25519.PublicKey)
+			if i == 0 {
+				s.kid, s.signingKey = kid, private.(ed25519.PrivateKey)
+			}
+			continue
+		}
+		public, err := jwt.ParseEdPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, errors.New("no Ed25519 key in " + path)
+		}
+		if i == 0 {
+			return nil, errors.New("the first token key must be a private key")
+		}
+		s.keys[kid] = public.(ed25519.PublicKey)
+	}
+	return s, nil
+}
+
+// Generate an Ed25519 private key in PKCS #8 PEM.
+func GenTokenKey() ([]byte, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Tokens never outlive the session, which ends SessionLifetime after login.
+func (s *TokenSigner) sign(username string, isAdmin bool, remember bool, authTime time.Time, typ string, ttl time.Duration) (string, TokenClaims, error) {
+	now := time.Now().Truncate(TokenTimePrecision)
+	role := RoleName(isAdmin)
+	authTime = authTime.Truncate(TokenTimePrecision)
+	exp := now.Add(ttl)
+	if end := authTime.Add(SessionLifetime(remember)); end.Before(exp) {
+		exp = end
+	}
+	claims := TokenClaims{Role: role, Type: typ, Remember: remember, AuthTime: jwt.NewNumericDate(authTime), RegisteredClaims: jwt.RegisteredClaims{
+		Issuer: TokenIssuer, Subject: username, ID: uuid.NewString(), IssuedAt: jwt.NewNumericDate(now), ExpiresAt: jwt.NewNumericDate(exp)}}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = s.kid
+	signed, err := token.SignedString(s.signingKey)
+	return signed, claims, err
+}
+
+func (s *TokenSigner) NewAccessToken(username string, isAdmin bool, remember bool, authTime time.Time) (string, time.Time, error) {
+	token, claims, err := s.sign(username, isAdmin, remember, authTime, "access", AccessTokenTTL)
+	return token, claims.ExpiresAt.Time, err
+}
+
+func (s *TokenSigner) NewRefreshToken(username string, isAdmin bool, remember bool, authTime time.Time) (string, time.Time, error) {
+	token, claims, err := s.sign(username, isAdmin, remember, authTime, "refresh", RefreshTokenTTL)
+	return token, claims.ExpiresAt.Time, err
+}
+
+// An access token and a refresh token, of a session logged in at authTime.
+func (s *TokenSigner) NewTokens(username string, isAdmin bool, remember bool, authTime time.Time) (TokenPair, error) {
+	var pair TokenPair
+	var err error
+	pair.Access, pair.AccessExpires, err = s.NewAccessToken(username, isAdmin, remember, authTime)
+	if err != nil {
+		return pair, err
+	}
+	pair.Refresh, pair.RefreshExpires, err = s.NewRefreshToken(username, isAdmin, remember, authTime)
+	return pair, err
+}
+
+// Verify a token of the type given, revoked tokens are refused.
+func (s *TokenSigner) Verify(token string, typ string) (TokenClaims, error) {
+	var claims TokenClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := s.keys[kid]
+		if !ok {
+			return nil, errors.New("unknown key")
+		}
+		return crypto.PublicKey(key), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}), jwt.WithIssuer(TokenIssuer),
+		jwt.WithExpirationRequired(), jwt.WithIssuedAt())
+	if err != nil {
+		return claims, err
+	}
+	if claims.Type != typ || claims.IssuedAt == nil || claims.ID == "" {
+		return claims, errors.New("wrong type of token")
+	}
+	claims.IssuedAt.Time = claims.IssuedAt.Round(TokenTimePrecision)
+	if claims.AuthTime != nil {
+		claims.AuthTime.Time = claims.AuthTime.Round(TokenTimePrecision)
+	}
+	if Revocations.Revoked(claims) {
+		return claims, errors.New("token revoked")
+	}
+	return claims, nil
+}
+
+// Revoked tokens, a token is revoked by its ID, or by being issued before a
+// time, to a user of a role or to anyone. Entries are kept until tokens they
+// match expire.
+type RevocationList struct {
+	lock     sync.RWMutex
+	ids      map[string]bool
+	users    map[TokenUser]time.Time
+	everyone time.Time
+}
+
+// A user of a role, an admin and a reader may have the same name. Entries
+// of an empty role, revoked before roles were kept, match both.
+type TokenUser struct {
+	Username string
+	Role     string
+}
+
+var Revocations = &RevocationList{ids: make(map[string]bool), users: make(map[TokenUser]time.Time)}
+
+func (l *RevocationList) Revoked(c TokenClaims) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	issued := c.IssuedAt.Truncate(TokenTimePrecision)
+	if l.ids[c.ID] || !issued.After(l.everyone) {
+		return true
+	}
+	for _, user := range []TokenUser{{c.Subject, c.Role}, {c.Subject, ""}} {
+		if before, ok := l.users[user]; ok && !issued.After(before) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *RevocationList) add(id string, user TokenUser, before time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	switch {
+	case id != "":
+		l.ids[id] = true
+	case user.Username != "":
+		if before.After(l.users[user]) {
+			l.users[user] = before
+		}
+	case before.After(l.everyone):
+		l.everyone = before
+	}
+}
+
+// Returned by RevokeToken if the token was revoked before, maybe by another
+// server instance not reloaded yet.
+var ErrTokenRevoked = errors.New("token revoked already")
+
+// Revoke a token by its ID, expires is when the token expires. The unique
+// index on JTI makes this the check too, only one of concurrent revocations
+// of a token succeeds.
+func RevokeToken(id string, expires time.Time) error {
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "INSERT INTO TOKEN_REVOCATIONS (JTI,USERNAME,\"ROLE\",ISSUED_BEFORE,EXPIRES) VALUES (?,?,?,?,?)")
+	_, err := stmt.Exec(id, nil, nil, nil, expires.UTC())
+	if IsDuplicateKey(err) {
+		err = ErrTokenRevoked
+	}
+	if err == nil || err == ErrTokenRevoked {
+		Revocations.add(id, TokenUser{}, time.Time{})
+	}
+	return err
+}
+
+// Revoke all tokens issued until before, to the user, or to anyone if the
+// username is empty. Tokens issued in the same millisecond are revoked too.
+func RevokeTokensBefore(user TokenUser, before time.Time) error {
+	before = before.Truncate(TokenTimePrecision)
+	if user.Username == "" {
+		user.Role = ""
+	}
+	db := DbOpen(DbConn)
+	stmt := DbPrepare(db, "INSERT INTO TOKEN_REVOCATIONS (JTI,USERNAME,\"ROLE\",ISSUED_BEFORE,EXPIRES) VALUES (?,?,?,?,?)")
+	_, err := stmt.Exec(nil, NullString(user.Username), NullString(user.Role), before.UTC(), before.Add(max(AccessTokenTTL, RefreshTokenTTL)).UTC())
+	if err == nil {
+		Revocations.add("", user, before)
+	}
+	return err
+}
+
+// Reload the revocation list from the database, purging expired entries.
+func LoadRevocations() error {
+	db := DbOpen(DbConn)
+	now := time.Now().UTC()
+	if _, err := db.Exec("DELETE FROM TOKEN_REVOCATIONS WHERE EXPIRES<=?", now); err != nil {
+		return err
+	}
+	rows, err := db.Query("SELECT COALESCE(JTI,''),COALESCE(USERNAME,''),COALESCE(\"ROLE\",''),COALESCE(ISSUED_BEFORE,CAST(0 AS DATETIME)) FROM TOKEN_REVOCATIONS")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	ids := make(map[string]bool)
+	users := make(map[TokenUser]time.Time)
+	var everyone time.Time
+	for rows.Next() {
+		var id string
+		var user TokenUser
+		var before time.Time
+		// A partial list would drop revocations, the previous one is kept.
+		if err = rows.Scan(&id, &user.Username, &user.Role, &before); err != nil {
+			return err
+		}
+		switch {
+		case id != "":
+			ids[id] = true
+		case user.Username != "":
+			if before.After(users[user]) {
+				users[user] = before
+			}
+		case before.After(everyone):
+			everyone = before
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	Revocations.lock.Lock()
+	Revocations.ids, Revocations.users, Revocations.everyone = ids, users, everyone
+	Revocations.lock.Unlock()
+	return nil
+}
+
+// Reload the revocation list every interval, should run as a goroutine.
+func RunRevocationsReloader(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := LoadRevocations(); err != nil {
+			log.Println("Failed to reload token revocations: " + err.Error())
+		}
+	}
+}
+
+// Signed access tokens as sessions. Nothing is stored, so Put does nothing,
+// and deleting a session revokes its token.
+type signedSessionStore struct{}
+
+func (signedSessionStore) Get(token string) (Session, bool) {
+	claims, err := Signer.Verify(token, "access")
+	if err != nil {
+		return Session{}, false
+	}
+	return Session{TokenHash: HashToken(token), Username: claims.Subject, IsAdmin: claims.Role == "admin",
+		Created: claims.Authenticated(), Expires: claims.ExpiresAt.Time, LastSeen: claims.IssuedAt.Time, Remember: claims.Remember}, true
+}
+
+func (signedSessionStore) Put(s Session) error {
+	return nil
+}
+
+// Idleness is checked on refreshing instead, see refreshHandler.
+func (signedSessionStore) Touch(token string, seen time.Time) {
+}
+
+func (signedSessionStore) Delete(token string) {
+	claims, err := Signer.Verify(token, "access")
+	if err != nil {
+		return
+	}
+	if err = RevokeToken(claims.ID, claims.ExpiresAt.Time); err != nil && err != ErrTokenRevoked {
+		log.Println("Failed to revoke token: " + err.Error())
+	}
+}
+
+// Tokens are not stored, so they can not be listed.
+func (signedSessionStore) List(username string) []Session {
+	return nil
+}
+
+// Nor can they be found by hashes, /revoke/session is not implemented.
+func (signedSessionStore) DeleteHash(hash string) {
+}
+
+func (signedSessionStore) DeleteUser(username string, isAdmin bool) {
+	if err := RevokeTokensBefore(TokenUser{username, RoleName(isAdmin)}, time.Now()); err != nil {
+		log.Println("Failed to revoke tokens: " + err.Error())
+	}
+}
+
+func (signedSessionStore) Clear() {
+	if err := RevokeTokensBefore(TokenUser{}, time.Now()); err != nil {
+		log.Println("Failed to revoke tokens: " + err.Error())
+	}
+}
+
+// Set the refresh token cookie, only sent to /refresh and /deauth. Scripts
+// never need it, so it is always HttpOnly. It lasts until the browser is
+// closed unless remembered.
+func setRefreshCookies(w http.ResponseWriter, token string, exp time.Time, remember bool) {
+	if !remember {
+		exp = time.Time{}
+	}
+	for _, path := range []string{"/refresh", "/deauth"} {
+		http.SetCookie(w, &http.Cookie{Name: "refresh", Value: token, Path: path, Expires: exp, HttpOnly: true, Secure: CookieSecure, SameSite: http.SameSiteStrictMode})
+	}
+}
+
+// Exchange a refresh token (cookie "refresh", or form value "refresh") for
+// a new access token and a new refresh token, the old one is revoked. The
+// session is idle since the access token issued with the refresh token
+// expired, as clients refresh once it does, so sessions not remembered idle
+// longer than SessionIdleTimeout are refused.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if Signer == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	refresh := r.PostFormValue("refresh")
+	if cookie, err := r.Cookie("refresh"); refresh == "" && err == nil {
+		refresh = cookie.Value
+	}
+	claims, err := Signer.Verify(refresh, "refresh")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	idle := time.Since(claims.IssuedAt.Time.Add(AccessTokenTTL))
+	if SessionIdleTimeout > 0 && !claims.Remember && idle > SessionIdleTimeout {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	// Revoked first, so that a stolen refresh token can be used only once,
+	// even with instances not knowing the revocations of each other yet.
+	err = RevokeToken(claims.ID, claims.ExpiresAt.Time)
+	if err == ErrTokenRevoked {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	isAdmin := claims.Role == "admin"
+	tokens, err := Signer.NewTokens(claims.Subject, isAdmin, claims.Remember, claims.Authenticated())
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	setTokenCookie(w, tokens.Access, tokens.AccessExpires)
+	setRefreshCookies(w, tokens.Refresh, tokens.RefreshExpires, claims.Remember)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"status": "success", "admin": isAdmin, "token": tokens.Access, "expires": tokens.AccessExpires,
+		"refresh": tokens.Refresh, "refresh_expires": tokens.RefreshExpires})
+}
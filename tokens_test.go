@@ -0,0 +1,223 @@
+/*
+ * @Author: FunctionSir
+ * @License: AGPLv3
+ * @Date: 2026-10-20 02:33:00
+ * @LastEditTime: 2026-10-20 02:52:00
+ * @LastEditors: FunctionSir
+ * @Description: Tests of signed tokens and their revocation.
+ * @FilePath: /biblio-matrix/tokens_test.go
+ */
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	mssql "github.com/microsoft/go-mssqldb"
+)
+
+func newTestSigner(t *testing.T, kid string) *TokenSigner {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &TokenSigner{kid: kid, signingKey: private, keys: map[string]ed25519.PublicKey{kid: public}}
+}
+
+func TestVerifyToken(t *testing.T) {
+	AccessTokenTTL, RefreshTokenTTL, SessionTTL = 15*time.Minute, time.Hour, time.Hour
+	signer := newTestSigner(t, "k1")
+	other := newTestSigner(t, "k2")
+	forged := newTestSigner(t, "k1") // Known kid, but another key.
+	access, _, err := signer.NewAccessToken("alice", false, false, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, _, err := signer.NewRefreshToken("alice", false, false, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, _, _ := other.NewAccessToken("alice", false, false, time.Now())
+	forgedToken, _, _ := forged.NewAccessToken("alice", true, false, time.Now())
+	now := time.Now()
+	claims := TokenClaims{Role: "admin", Type: "access", RegisteredClaims: jwt.RegisteredClaims{Issuer: TokenIssuer, Subject: "alice",
+		ID: "x", IssuedAt: jwt.NewNumericDate(now), ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour))}}
+	// HS256 keyed with the public key, as if it were the secret.
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	hs.Header["kid"] = "k1"
+	hsToken, err := hs.SignedString([]byte(signer.keys["k1"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	none.Header["kid"] = "k1"
+	noneToken, err := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noKid := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	noKidToken, err := noKid.SignedString(signer.signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		token string
+		typ   string
+		ok    bool
+	}{
+		{"access", access, "access", true},
+		{"refresh", refresh, "refresh", true},
+		{"refresh as access", refresh, "access", false},
+		{"access as refresh", access, "refresh", false},
+		{"unknown kid", otherToken, "access", false},
+		{"wrong key", forgedToken, "access", false},
+		{"no kid", noKidToken, "access", false},
+		{"alg HS256", hsToken, "access", false},
+		{"alg none", noneToken, "access", false},
+		{"garbage", "a.b.c", "access", false},
+	}
+	for _, tt := range tests {
+		_, err := signer.Verify(tt.token, tt.typ)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Verify() error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestVerifyTokenTime(t *testing.T) {
+	AccessTokenTTL, SessionTTL = 15*time.Minute, time.Hour
+	signer := newTestSigner(t, "k1")
+	// Issue times are checked by the millisecond, and parsing must not move
+	// them to the one before, or tokens issued right after a revocation
+	// would be revoked.
+	for range 200 {
+		token, _, err := signer.NewAccessToken("alice", false, false, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := signer.Verify(token, "access")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var issued TokenClaims
+		if _, _, err = jwt.NewParser().ParseUnverified(token, &issued); err != nil {
+			t.Fatal(err)
+		}
+		want := issued.IssuedAt.Round(TokenTimePrecision)
+		if !claims.IssuedAt.Equal(want) || !claims.IssuedAt.Equal(claims.IssuedAt.Truncate(TokenTimePrecision)) {
+			t.Fatalf("issued at %v, want %v", claims.IssuedAt.Time, want)
+		}
+		time.Sleep(37 * time.Microsecond)
+	}
+}
+
+func TestTokenLifetime(t *testing.T) {
+	AccessTokenTTL, RefreshTokenTTL = 15*time.Minute, 7*24*time.Hour
+	SessionTTL, RememberMeTTL = 24*time.Hour, 30*24*time.Hour
+	signer := newTestSigner(t, "k1")
+	now := time.Now()
+	tests := []struct {
+		name     string
+		remember bool
+		authTime time.Time
+		want     time.Time // Expiry of the refresh token
+	}{
+		{"just logged in", false, now, now.Add(SessionTTL)},
+		{"logged in long ago", false, now.Add(-23 * time.Hour), now.Add(time.Hour)},
+		{"remembered", true, now, now.Add(RefreshTokenTTL)},
+		{"remembered long ago", true, now.Add(-29 * 24 * time.Hour), now.Add(24 * time.Hour)},
+	}
+	for _, tt := range tests {
+		tokens, err := signer.NewTokens("alice", false, tt.remember, tt.authTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := tokens.RefreshExpires.Sub(tt.want); d < -time.Second || d > time.Second {
+			t.Errorf("%s: refresh expires at %v, want %v", tt.name, tokens.RefreshExpires, tt.want)
+		}
+		if tokens.AccessExpires.After(tokens.RefreshExpires) {
+			t.Errorf("%s: access token outlives the refresh token", tt.name)
+		}
+		claims, err := signer.Verify(tokens.Refresh, "refresh")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !claims.Authenticated().Equal(tt.authTime.Truncate(TokenTimePrecision)) {
+			t.Errorf("%s: auth_time = %v, want %v", tt.name, claims.Authenticated(), tt.authTime)
+		}
+	}
+	// Refreshing a session past its end gives expired tokens.
+	tokens, _ := signer.NewTokens("alice", false, false, now.Add(-25*time.Hour))
+	if _, err := signer.Verify(tokens.Refresh, "refresh"); err == nil {
+		t.Error("refresh token of an ended session verified")
+	}
+}
+
+func TestRevokedBefore(t *testing.T) {
+	before := time.Date(2026, 10, 20, 2, 0, 0, 123_000_000, time.UTC)
+	issued := func(username string, role string, at time.Time) TokenClaims {
+		return TokenClaims{Role: role, RegisteredClaims: jwt.RegisteredClaims{Subject: username, ID: fmt.Sprint(at.UnixNano()), IssuedAt: jwt.NewNumericDate(at)}}
+	}
+	l := &RevocationList{ids: make(map[string]bool), users: make(map[TokenUser]time.Time)}
+	l.add("", TokenUser{"alice", "reader"}, before)
+	l.add("", TokenUser{"carol", ""}, before) // Revoked before roles were kept.
+	tests := []struct {
+		name   string
+		claims TokenClaims
+		want   bool
+	}{
+		{"earlier", issued("alice", "reader", before.Add(-time.Second)), true},
+		{"same millisecond", issued("alice", "reader", before), true},
+		{"same millisecond, later", issued("alice", "reader", before.Add(999*time.Microsecond)), true},
+		{"next millisecond", issued("alice", "reader", before.Add(time.Millisecond)), false},
+		{"admin of the same name", issued("alice", "admin", before.Add(-time.Second)), false},
+		{"another user", issued("bob", "reader", before.Add(-time.Second)), false},
+		{"no role, reader", issued("carol", "reader", before), true},
+		{"no role, admin", issued("carol", "admin", before), true},
+	}
+	for _, tt := range tests {
+		if got := l.Revoked(tt.claims); got != tt.want {
+			t.Errorf("%s: Revoked() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	l.add("", TokenUser{}, before)
+	if !l.Revoked(issued("bob", "admin", before)) {
+		t.Error("token of bob issued in the same millisecond as revoking everyone's not revoked")
+	}
+}
+
+// Refreshing takes the unique index on JTI as the check, so a refresh token
+// used again must be told apart from other failures.
+func TestRefreshReuse(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{mssql.Error{Number: 2601}, true},
+		{mssql.Error{Number: 2627}, true},
+		{fmt.Errorf("insert: %w", mssql.Error{Number: 2627}), true},
+		{mssql.Error{Number: 547}, false},
+		{ErrTokenRevoked, false},
+	}
+	for _, tt := range tests {
+		if got := IsDuplicateKey(tt.err); got != tt.want {
+			t.Errorf("IsDuplicateKey(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+	l := &RevocationList{ids: make(map[string]bool), users: make(map[TokenUser]time.Time)}
+	claims := TokenClaims{Type: "refresh", RegisteredClaims: jwt.RegisteredClaims{Subject: "alice", ID: "jti-1", IssuedAt: jwt.NewNumericDate(time.Now())}}
+	if l.Revoked(claims) {
+		t.Fatal("fresh refresh token revoked")
+	}
+	l.add(claims.ID, TokenUser{}, time.Time{})
+	if !l.Revoked(claims) {
+		t.Error("used refresh token not revoked")
+	}
+}